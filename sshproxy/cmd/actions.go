@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"os/exec"
+	"slices"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// Events that run actions.
+const (
+	eventBan         = "ban"
+	eventUnban       = "unban"
+	eventManualBan   = "manual_ban"
+	eventManualUnban = "manual_unban"
+)
+
+var actionEvents = []string{eventBan, eventUnban, eventManualBan, eventManualUnban}
+
+// actionQueueSize is how many events may wait for each action before
+// further ones are dropped.
+const actionQueueSize = 1000
+
+// ActionEvent is a change to a ban list, as passed to actions.
+type ActionEvent struct {
+	// Event is ban (from the logs), unban (expired), manual_ban or
+	// manual_unban (through the admin API).
+	Event string `json:"event"`
+	// Addr is the banned address or prefix.
+	Addr string `json:"addr"`
+	// Route is set for route ban lists.
+	Route string `json:"route,omitempty"`
+	// Duration is the length of a ban, or "permanent". Until is when it
+	// ends. Both are empty for unbans.
+	Duration string     `json:"duration,omitempty"`
+	Until    *time.Time `json:"until,omitempty"`
+	// Score and Bans are the failure score behind a ban of an address
+	// and how many times it has been banned.
+	Score float64   `json:"score,omitempty"`
+	Bans  int       `json:"bans,omitempty"`
+	Time  time.Time `json:"time"`
+}
+
+// banEvent describes the ban info as event on route at now.
+func banEvent(event string, info BanInfo, route string, now time.Time) ActionEvent {
+	ev := ActionEvent{Event: event, Addr: formatPrefix(info.Prefix), Route: route, Score: info.Score, Bans: info.Count, Time: now}
+	if info.Until.IsZero() {
+		ev.Duration = "permanent"
+	} else {
+		ev.Duration = info.Until.Sub(now).Round(time.Second).String()
+		ev.Until = &info.Until
+	}
+	return ev
+}
+
+// unbanEvent describes lifting the ban of p as event on route at now.
+func unbanEvent(event string, p netip.Prefix, route string, now time.Time) ActionEvent {
+	return ActionEvent{Event: event, Addr: formatPrefix(p), Route: route, Time: now}
+}
+
+// action is a configured action and the events waiting for it.
+type action struct {
+	ActionConfig
+	args  []*template.Template
+	queue chan ActionEvent
+}
+
+// Actions runs webhooks and commands for ban list changes. Each action
+// has a queue and a goroutine of its own, so a slow action neither delays
+// others nor the caller, and sees events in order.
+type Actions struct {
+	logger  *slog.Logger
+	metrics *Metrics
+	client  *http.Client
+	actions []*action
+	// ctx is canceled to abort the actions in flight on Close.
+	ctx       context.Context
+	cancel    context.CancelFunc
+	wg        sync.WaitGroup
+	closeOnce sync.Once
+
+	mu     sync.RWMutex
+	closed bool
+}
+
+// NewActions starts the actions in configs, which must be valid.
+func NewActions(configs []ActionConfig, logger *slog.Logger, metrics *Metrics) (*Actions, error) {
+	a := &Actions{logger: logger, metrics: metrics, client: &http.Client{}}
+	for _, c := range configs {
+		args, err := c.templates()
+		if err != nil {
+			return nil, fmt.Errorf("action %s: %w", c.Name, err)
+		}
+		a.actions = append(a.actions, &action{ActionConfig: c.withDefaults(), args: args, queue: make(chan ActionEvent, actionQueueSize)})
+	}
+	a.ctx, a.cancel = context.WithCancel(context.Background())
+	for _, act := range a.actions {
+		a.wg.Add(1)
+		go func() {
+			defer a.wg.Done()
+			for ev := range act.queue {
+				a.run(act, ev)
+			}
+		}()
+	}
+	return a, nil
+}
+
+// Notify queues ev for the actions configured for its event. It never
+// blocks: events for an action whose queue is full are dropped. A nil
+// Actions does nothing.
+func (a *Actions) Notify(ev ActionEvent) {
+	if a == nil {
+		return
+	}
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if a.closed {
+		return
+	}
+	for _, act := range a.actions {
+		if !act.runsOn(ev.Event) {
+			continue
+		}
+		select {
+		case act.queue <- ev:
+		default:
+			a.logger.Warn("Dropped action event, queue full", "action", act.Name, "event", ev.Event, "addr", ev.Addr)
+			a.metrics.actions.WithLabelValues(act.Name, "dropped").Inc()
+		}
+	}
+}
+
+// Close lets the actions finish the queued events. Those still running
+// when ctx is done are aborted and the rest are dropped. A nil Actions,
+// or one already closed, does nothing.
+func (a *Actions) Close(ctx context.Context) {
+	if a == nil {
+		return
+	}
+	a.closeOnce.Do(func() {
+		a.mu.Lock()
+		a.closed = true
+		for _, act := range a.actions {
+			close(act.queue)
+		}
+		a.mu.Unlock()
+		done := make(chan struct{})
+		go func() {
+			a.wg.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-ctx.Done():
+			a.logger.Warn("Aborting actions still running at the shutdown deadline")
+			a.cancel()
+			<-done
+		}
+		a.cancel()
+	})
+}
+
+// run runs act for ev, retrying failed attempts.
+func (a *Actions) run(act *action, ev ActionEvent) {
+	if a.ctx.Err() != nil {
+		a.metrics.actions.WithLabelValues(act.Name, "dropped").Inc()
+		return
+	}
+	delay := act.RetryDelay
+	var err error
+	for attempt := 1; ; attempt++ {
+		if err = a.attempt(act, ev); err == nil {
+			a.logger.Debug("Ran action", "action", act.Name, "event", ev.Event, "addr", ev.Addr)
+			a.metrics.actions.WithLabelValues(act.Name, "ok").Inc()
+			return
+		}
+		if attempt == act.MaxAttempts || errors.Is(err, errPermanent) {
+			break
+		}
+		a.logger.Debug("Retrying action", "action", act.Name, "event", ev.Event, "addr", ev.Addr, "error", err)
+		select {
+		case <-time.After(delay):
+		case <-a.ctx.Done():
+		}
+		if a.ctx.Err() != nil {
+			break
+		}
+		delay *= 2
+	}
+	a.logger.Error("Action failed", "action", act.Name, "event", ev.Event, "addr", ev.Addr, "error", err)
+	a.metrics.actions.WithLabelValues(act.Name, "failed").Inc()
+}
+
+// errPermanent marks failures that retrying does not help with.
+var errPermanent = errors.New("not retried")
+
+func (a *Actions) attempt(act *action, ev ActionEvent) error {
+	ctx, cancel := context.WithTimeout(a.ctx, act.Timeout)
+	defer cancel()
+	payload, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	if act.URL != "" {
+		return a.post(ctx, act, payload)
+	}
+	return a.exec(ctx, act, ev, payload)
+}
+
+// post sends payload to the webhook. Client errors other than 408 and 429
+// are not retried.
+func (a *Actions) post(ctx context.Context, act *action, payload []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, act.URL, bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("%w: %w", errPermanent, err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "sshproxy")
+	for k, v := range act.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	switch {
+	case resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode < 500 && resp.StatusCode != http.StatusRequestTimeout && resp.StatusCode != http.StatusTooManyRequests:
+		return fmt.Errorf("%w: %s", errPermanent, resp.Status)
+	}
+	return errors.New(resp.Status)
+}
+
+// exec runs the command with its arguments expanded for ev and payload
+// on stdin.
+func (a *Actions) exec(ctx context.Context, act *action, ev ActionEvent, payload []byte) error {
+	args := make([]string, len(act.args))
+	for i, t := range act.args {
+		var b strings.Builder
+		if err := t.Execute(&b, ev); err != nil {
+			return fmt.Errorf("%w: %w", errPermanent, err)
+		}
+		args[i] = b.String()
+	}
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stdin = bytes.NewReader(payload)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		if out := strings.TrimSpace(string(out)); out != "" {
+			return fmt.Errorf("%w: %.200s", err, out)
+		}
+		return err
+	}
+	return nil
+}
+
+func (c ActionConfig) runsOn(event string) bool {
+	return len(c.Events) == 0 || slices.Contains(c.Events, event)
+}
+
+// templates parses the command's arguments.
+func (c ActionConfig) templates() ([]*template.Template, error) {
+	args := make([]*template.Template, len(c.Command))
+	for i, arg := range c.Command {
+		t, err := template.New(fmt.Sprint("command.", i)).Parse(arg)
+		if err != nil {
+			return nil, err
+		}
+		if err := t.Execute(io.Discard, ActionEvent{}); err != nil {
+			return nil, err
+		}
+		args[i] = t
+	}
+	return args, nil
+}
+
+func (c ActionConfig) withDefaults() ActionConfig {
+	c.Timeout = cmp.Or(c.Timeout, 10*time.Second)
+	c.MaxAttempts = cmp.Or(c.MaxAttempts, 3)
+	c.RetryDelay = cmp.Or(c.RetryDelay, time.Second)
+	return c
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// startWebhook runs a webhook that answers with the statuses in order,
+// then 200, and sends the events it receives to the returned channel.
+func startWebhook(t *testing.T, statuses ...int) (string, chan ActionEvent) {
+	t.Helper()
+	events := make(chan ActionEvent, 10)
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Authorization") != "Bearer hook" || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("unexpected request %s with headers %v", r.Method, r.Header)
+		}
+		if n := int(calls.Add(1)); n <= len(statuses) {
+			w.WriteHeader(statuses[n-1])
+			return
+		}
+		var ev ActionEvent
+		if err := json.NewDecoder(r.Body).Decode(&ev); err != nil {
+			t.Errorf("invalid payload: %v", err)
+		}
+		events <- ev
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL, events
+}
+
+func newTestActions(t *testing.T, configs ...ActionConfig) (*Actions, *Metrics) {
+	t.Helper()
+	metrics := NewMetrics(NewBanList(EscalationPolicy{}))
+	a, err := NewActions(configs, slog.New(slog.NewTextHandler(io.Discard, nil)), metrics)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a, metrics
+}
+
+func receive(t *testing.T, events chan ActionEvent) ActionEvent {
+	t.Helper()
+	select {
+	case ev := <-events:
+		return ev
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event received")
+		return ActionEvent{}
+	}
+}
+
+func TestActions_Webhook(t *testing.T) {
+	url, events := startWebhook(t, http.StatusServiceUnavailable, http.StatusTooManyRequests)
+	a, metrics := newTestActions(t, ActionConfig{
+		Name:       "hook",
+		Events:     []string{eventBan, eventManualBan},
+		URL:        url,
+		Headers:    map[string]string{"Authorization": "Bearer hook"},
+		RetryDelay: time.Millisecond,
+	})
+
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	a.Notify(unbanEvent(eventUnban, netip.MustParsePrefix("10.0.0.2/32"), "", now))
+	a.Notify(banEvent(eventBan, BanInfo{Prefix: netip.MustParsePrefix("10.0.0.1/32"), Until: now.Add(time.Hour), Count: 2, Score: 5.5}, "box2", now))
+	a.Notify(banEvent(eventManualBan, BanInfo{Prefix: netip.MustParsePrefix("203.0.113.0/24")}, "", now))
+
+	// The third attempt gets through.
+	ev := receive(t, events)
+	if ev.Event != eventBan || ev.Addr != "10.0.0.1" || ev.Route != "box2" || ev.Duration != "1h0m0s" ||
+		ev.Until == nil || !ev.Until.Equal(now.Add(time.Hour)) || ev.Score != 5.5 || ev.Bans != 2 || !ev.Time.Equal(now) {
+		t.Fatalf("unexpected ban event %+v", ev)
+	}
+	if ev := receive(t, events); ev.Event != eventManualBan || ev.Addr != "203.0.113.0/24" || ev.Duration != "permanent" || ev.Until != nil {
+		t.Fatalf("unexpected manual ban event %+v", ev)
+	}
+	a.Close(context.Background())
+	select {
+	case ev := <-events:
+		t.Fatalf("unban sent to an action not configured for it: %+v", ev)
+	default:
+	}
+	wantMetrics(t, metrics, `sshproxy_actions_total{action="hook",result="ok"} 2`)
+	// Events after Close are ignored.
+	a.Notify(banEvent(eventBan, BanInfo{Prefix: netip.MustParsePrefix("10.0.0.3/32")}, "", now))
+}
+
+func TestActions_WebhookFailure(t *testing.T) {
+	rejecting, _ := startWebhook(t, http.StatusBadRequest)
+	failing, _ := startWebhook(t, 500, 500, 500)
+	a, metrics := newTestActions(t,
+		ActionConfig{Name: "rejecting", URL: rejecting, Headers: map[string]string{"Authorization": "Bearer hook"}, RetryDelay: time.Millisecond},
+		ActionConfig{Name: "failing", URL: failing, Headers: map[string]string{"Authorization": "Bearer hook"}, MaxAttempts: 3, RetryDelay: time.Millisecond},
+	)
+	a.Notify(unbanEvent(eventManualUnban, netip.MustParsePrefix("10.0.0.1/32"), "", time.Now()))
+	a.Close(context.Background())
+	// A client error is not retried, so the rejecting webhook would only
+	// have accepted a second attempt.
+	wantMetrics(t, metrics,
+		`sshproxy_actions_total{action="failing",result="failed"} 1`,
+		`sshproxy_actions_total{action="rejecting",result="failed"} 1`,
+	)
+}
+
+func TestActions_Command(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "out")
+	a, metrics := newTestActions(t, ActionConfig{
+		Name:    "cmd",
+		Command: []string{"sh", "-c", `printf '%s %s\n' "$0" "$1" >>` + out + ` && cat >>` + out, "{{.Event}}", "{{.Addr}}"},
+	})
+	a.Notify(unbanEvent(eventManualUnban, netip.MustParsePrefix("10.0.0.1/32"), "box2", time.Now()))
+	a.Close(context.Background())
+	wantMetrics(t, metrics, `sshproxy_actions_total{action="cmd",result="ok"} 1`)
+	data, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	args, payload, _ := strings.Cut(string(data), "\n")
+	var ev ActionEvent
+	if args != "manual_unban 10.0.0.1" || json.Unmarshal([]byte(payload), &ev) != nil || ev.Route != "box2" {
+		t.Fatalf("unexpected command output %q", data)
+	}
+}
+
+func TestActions_Close(t *testing.T) {
+	a, metrics := newTestActions(t, ActionConfig{Name: "slow", Command: []string{"sleep", "10"}})
+	a.Notify(unbanEvent(eventUnban, netip.MustParsePrefix("10.0.0.1/32"), "", time.Now()))
+	a.Notify(unbanEvent(eventUnban, netip.MustParsePrefix("10.0.0.2/32"), "", time.Now()))
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	a.Close(ctx)
+	if time.Since(start) > 5*time.Second {
+		t.Fatal("Close waited for the running command")
+	}
+	wantMetrics(t, metrics,
+		`sshproxy_actions_total{action="slow",result="dropped"} 1`,
+		`sshproxy_actions_total{action="slow",result="failed"} 1`,
+	)
+}
+
+func TestProxy_Actions(t *testing.T) {
+	url, events := startWebhook(t)
+	var now atomic.Pointer[time.Time]
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	now.Store(&start)
+	src := make(fakeSource, 10)
+	for i := range 5 {
+		src <- LogEntry{Time: start, Message: fmt.Sprintf("Failed password for root from 198.51.100.9 port %d ssh2", 40000+i)}
+	}
+	p := startTestProxy(t, startEcho(t).Addr().String(), src, func() time.Time { return *now.Load() }, func(c *Config) {
+		c.Actions = []ActionConfig{{Name: "hook", URL: url, Headers: map[string]string{"Authorization": "Bearer hook"}}}
+	})
+	defer p.Shutdown(context.Background())
+
+	if ev := receive(t, events); ev.Event != eventBan || ev.Addr != "198.51.100.9" || ev.Duration != "10m0s" || ev.Bans != 1 {
+		t.Fatalf("unexpected ban event %+v", ev)
+	}
+	later := start.Add(time.Hour)
+	now.Store(&later)
+	select {
+	case p.reload <- struct{}{}:
+	default:
+	}
+	if ev := receive(t, events); ev.Event != eventUnban || ev.Addr != "198.51.100.9" || !ev.Time.Equal(later) {
+		t.Fatalf("unexpected unban event %+v", ev)
+	}
+}
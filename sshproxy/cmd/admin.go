@@ -0,0 +1,299 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// adminServer serves the admin HTTP API:
+//
+//	GET    /bans           active bans with expiry and failure scores
+//	POST   /bans           ban an address or prefix
+//	DELETE /bans/{addr}    lift the ban of an address or prefix
+//	GET    /failures       failure scores from the latest log parser pass
+//
+// Bans go to the shared ban list unless they name a route with a ban list
+// of its own. Bans and failures of such routes are listed with the route.
+type adminServer struct {
+	cfg     *atomic.Pointer[Config]
+	banList *BanList
+	routes  map[string]*banScope
+	tallies *Tallies
+	metrics *Metrics
+	actions *Actions
+	logger  *slog.Logger
+}
+
+func newAdminHandler(cfg *atomic.Pointer[Config], banList *BanList, routes map[string]*banScope, tallies *Tallies, metrics *Metrics, actions *Actions, logger *slog.Logger) http.Handler {
+	s := &adminServer{cfg: cfg, banList: banList, routes: routes, tallies: tallies, metrics: metrics, actions: actions, logger: logger}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /bans", s.listBans)
+	mux.HandleFunc("POST /bans", s.ban)
+	mux.HandleFunc("DELETE /bans/{addr...}", s.unban)
+	mux.HandleFunc("GET /failures", s.failures)
+	return s.authorize(mux)
+}
+
+// listenAdmin listens on a TCP address or, with a "unix:" prefix, on a
+// unix socket that only the owner can connect to. A stale socket left by
+// a previous run is removed.
+func listenAdmin(addr string) (net.Listener, error) {
+	path, ok := strings.CutPrefix(addr, "unix:")
+	if !ok {
+		return net.Listen("tcp", addr)
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0o600); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+// authorize checks the bearer token from the current configuration, so
+// that a reload can rotate it.
+func (s *adminServer) authorize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := s.cfg.Load().Admin.Token
+		if token != "" {
+			got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+				writeError(w, http.StatusUnauthorized, "invalid or missing token")
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+type adminBan struct {
+	Addr      string     `json:"addr"`
+	Route     string     `json:"route,omitempty"`
+	Until     *time.Time `json:"until,omitempty"`
+	Permanent bool       `json:"permanent,omitempty"`
+	Bans      int        `json:"bans,omitempty"`
+	Score     float64    `json:"score,omitempty"`
+}
+
+func (s *adminServer) listBans(w http.ResponseWriter, r *http.Request) {
+	bans := []adminBan{}
+	for _, info := range s.banList.List() {
+		bans = append(bans, newAdminBan(info))
+	}
+	for name, scope := range s.routes {
+		for _, info := range scope.banList.List() {
+			b := newAdminBan(info)
+			b.Route = name
+			bans = append(bans, b)
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"bans": bans})
+}
+
+// routeBanList returns the ban list of route, or the shared one if route
+// is empty.
+func (s *adminServer) routeBanList(route string) (*BanList, bool) {
+	if route == "" {
+		return s.banList, true
+	}
+	scope, ok := s.routes[route]
+	if !ok {
+		return nil, false
+	}
+	return scope.banList, true
+}
+
+func (s *adminServer) routeLogger(route string) *slog.Logger {
+	if route == "" {
+		return s.logger
+	}
+	return s.logger.With("route", route)
+}
+
+func newAdminBan(info BanInfo) adminBan {
+	b := adminBan{Addr: formatPrefix(info.Prefix), Bans: info.Count, Score: info.Score}
+	if info.Until.IsZero() {
+		b.Permanent = true
+	} else {
+		b.Until = &info.Until
+	}
+	return b
+}
+
+type banRequest struct {
+	Addr string `json:"addr"`
+	// Duration is a Go duration or "permanent". Empty means the next
+	// escalation step for an address, or ban.duration for a prefix.
+	Duration string `json:"duration"`
+	// Route names a route with a ban list of its own. Empty means the
+	// shared ban list.
+	Route string `json:"route"`
+}
+
+func (s *adminServer) ban(w http.ResponseWriter, r *http.Request) {
+	var req banRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body: "+err.Error())
+		return
+	}
+	prefixes, err := parsePrefixes([]string{req.Addr})
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	p := prefixes[0]
+	banList, ok := s.routeBanList(req.Route)
+	if !ok {
+		writeError(w, http.StatusBadRequest, "no ban list for route "+req.Route)
+		return
+	}
+	if p.IsSingleIP() && banList.Allowed(p.Addr()) {
+		writeError(w, http.StatusConflict, "address is allowlisted")
+		return
+	}
+	cfg := s.cfg.Load()
+	switch req.Duration {
+	case "":
+		if p.IsSingleIP() {
+			banList.Escalate(p.Addr(), 0)
+		} else {
+			banList.BanPrefix(p, cfg.Ban.Duration)
+		}
+	case "permanent":
+		banList.BanPrefix(p, permanentBan)
+	default:
+		d, err := time.ParseDuration(req.Duration)
+		if err != nil || d <= 0 {
+			writeError(w, http.StatusBadRequest, "duration must be positive or \"permanent\"")
+			return
+		}
+		banList.BanPrefix(p, d)
+	}
+	s.metrics.bans.WithLabelValues("admin").Inc()
+	s.sync(r.Context(), banList)
+	for _, info := range banList.List() {
+		if info.Prefix == p {
+			if info.Until.IsZero() {
+				s.routeLogger(req.Route).Warn("Banned permanently through admin API", "addr", formatPrefix(p))
+			} else {
+				s.routeLogger(req.Route).Info("Banned through admin API", "addr", formatPrefix(p), "until", info.Until)
+			}
+			s.actions.Notify(banEvent(eventManualBan, info, req.Route, time.Now()))
+			b := newAdminBan(info)
+			b.Route = req.Route
+			writeJSON(w, http.StatusOK, b)
+			return
+		}
+	}
+	// Only an expired or concurrently lifted ban gets here.
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *adminServer) unban(w http.ResponseWriter, r *http.Request) {
+	prefixes, err := parsePrefixes([]string{r.PathValue("addr")})
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	p := prefixes[0]
+	route := r.URL.Query().Get("route")
+	banList, ok := s.routeBanList(route)
+	if !ok {
+		writeError(w, http.StatusBadRequest, "no ban list for route "+route)
+		return
+	}
+	if !banList.Unban(p) {
+		writeError(w, http.StatusNotFound, "not banned")
+		return
+	}
+	s.routeLogger(route).Info("Unbanned through admin API", "addr", formatPrefix(p))
+	s.metrics.unbans.WithLabelValues("admin").Inc()
+	s.actions.Notify(unbanEvent(eventManualUnban, p, route, time.Now()))
+	s.sync(r.Context(), banList)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// sync pushes a manual change to the shared store right away instead of
+// waiting for the next periodic sync.
+func (s *adminServer) sync(ctx context.Context, banList *BanList) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	if err := banList.Sync(ctx); err != nil {
+		s.logger.Error("Failed to sync bans with store", "error", err)
+	}
+}
+
+type adminFailure struct {
+	Addr  netip.Addr `json:"addr"`
+	Route string     `json:"route,omitempty"`
+	Score float64    `json:"score"`
+}
+
+func (s *adminServer) failures(w http.ResponseWriter, r *http.Request) {
+	at, scores := s.tallies.Get()
+	failures := make([]adminFailure, 0, len(scores))
+	for addr, score := range scores {
+		failures = append(failures, adminFailure{Addr: addr, Score: score})
+	}
+	for name, scope := range s.routes {
+		routeAt, scores := scope.tallies.Get()
+		if routeAt.After(at) {
+			at = routeAt
+		}
+		for addr, score := range scores {
+			failures = append(failures, adminFailure{Addr: addr, Route: name, Score: score})
+		}
+	}
+	sort.Slice(failures, func(i, j int) bool {
+		if failures[i].Score != failures[j].Score {
+			return failures[i].Score > failures[j].Score
+		}
+		if failures[i].Addr != failures[j].Addr {
+			return failures[i].Addr.Less(failures[j].Addr)
+		}
+		return failures[i].Route < failures[j].Route
+	})
+	resp := map[string]any{
+		"threshold": s.cfg.Load().Ban.Threshold,
+		"failures":  failures,
+	}
+	if !at.IsZero() {
+		resp["updated"] = at
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// formatPrefix writes single addresses without a prefix length.
+func formatPrefix(p netip.Prefix) string {
+	if p.IsSingleIP() {
+		return p.Addr().String()
+	}
+	return p.String()
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
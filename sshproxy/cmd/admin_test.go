@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestAdmin serves the admin API for the shared ban scope and a route
+// "box2" with its own, which are returned by name.
+func newTestAdmin(t *testing.T, token string) (*httptest.Server, *BanList, map[string]*banScope) {
+	t.Helper()
+	cfg := &Config{Ban: BanConfig{Threshold: 5, Duration: 10 * time.Minute}, Admin: AdminConfig{Token: token}}
+	cfg.Ban.Allowlist = []string{"192.168.0.0/16"}
+	var current atomic.Pointer[Config]
+	current.Store(cfg)
+	banList := NewBanList(EscalationPolicy{Steps: []time.Duration{time.Hour, permanentBan}})
+	banList.SetPrefixes(cfg.Prefixes())
+	box2 := &banScope{name: "box2", banList: NewBanList(EscalationPolicy{Steps: []time.Duration{time.Hour}}), tallies: &Tallies{}}
+	tallies := &Tallies{}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	srv := httptest.NewServer(newAdminHandler(&current, banList, map[string]*banScope{"box2": box2}, tallies, NewMetrics(banList), nil, logger))
+	t.Cleanup(srv.Close)
+	return srv, banList, map[string]*banScope{"": {banList: banList, tallies: tallies}, "box2": box2}
+}
+
+func adminRequest(t *testing.T, srv *httptest.Server, method, path, body string, out any) int {
+	t.Helper()
+	req, err := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, path, err)
+	}
+	defer resp.Body.Close()
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			t.Fatalf("%s %s: decoding response: %v", method, path, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func TestAdmin_Auth(t *testing.T) {
+	srv, _, _ := newTestAdmin(t, "secret")
+	for _, auth := range []string{"", "Bearer wrong", "secret"} {
+		req, _ := http.NewRequest("GET", srv.URL+"/bans", nil)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		resp, err := srv.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("Authorization %q: got status %d", auth, resp.StatusCode)
+		}
+	}
+	if code := adminRequest(t, srv, "GET", "/bans", "", nil); code != http.StatusOK {
+		t.Fatalf("valid token: got status %d", code)
+	}
+}
+
+func TestAdmin_BanUnban(t *testing.T) {
+	srv, banList, _ := newTestAdmin(t, "secret")
+	banList.Escalate(netip.MustParseAddr("10.0.0.1"), 6.5)
+
+	var ban adminBan
+	if code := adminRequest(t, srv, "POST", "/bans", `{"addr": "10.0.0.1"}`, &ban); code != http.StatusOK {
+		t.Fatalf("ban: got status %d", code)
+	}
+	if !ban.Permanent || ban.Bans != 2 {
+		t.Fatalf("repeat ban did not escalate: %+v", ban)
+	}
+	if code := adminRequest(t, srv, "POST", "/bans", `{"addr": "::ffff:203.0.113.0/120", "duration": "2h"}`, &ban); code != http.StatusOK {
+		t.Fatalf("ban prefix: got status %d", code)
+	}
+	if ban.Addr != "203.0.113.0/24" || ban.Until == nil || time.Until(*ban.Until) < 119*time.Minute {
+		t.Fatalf("unexpected prefix ban %+v", ban)
+	}
+	if !banList.IsBanned(netip.MustParseAddr("203.0.113.50")) {
+		t.Fatal("prefix ban not applied")
+	}
+
+	for _, body := range []string{`{"addr": "office"}`, `{"addr": "10.0.0.2", "duration": "-1h"}`, `{`} {
+		if code := adminRequest(t, srv, "POST", "/bans", body, nil); code != http.StatusBadRequest {
+			t.Errorf("ban %s: got status %d", body, code)
+		}
+	}
+	if code := adminRequest(t, srv, "POST", "/bans", `{"addr": "192.168.1.1"}`, nil); code != http.StatusConflict {
+		t.Errorf("ban of allowlisted address: got status %d", code)
+	}
+
+	var list struct{ Bans []adminBan }
+	adminRequest(t, srv, "GET", "/bans", "", &list)
+	if len(list.Bans) != 2 || list.Bans[0].Addr != "10.0.0.1" || list.Bans[0].Score != 0 || list.Bans[1].Addr != "203.0.113.0/24" {
+		t.Fatalf("unexpected ban list %+v", list.Bans)
+	}
+
+	if code := adminRequest(t, srv, "DELETE", "/bans/203.0.113.0/24", "", nil); code != http.StatusNoContent {
+		t.Fatalf("unban prefix: got status %d", code)
+	}
+	if code := adminRequest(t, srv, "DELETE", "/bans/10.0.0.1", "", nil); code != http.StatusNoContent {
+		t.Fatalf("unban address: got status %d", code)
+	}
+	if code := adminRequest(t, srv, "DELETE", "/bans/10.0.0.1", "", nil); code != http.StatusNotFound {
+		t.Fatalf("second unban: got status %d", code)
+	}
+	if len(banList.List()) != 0 {
+		t.Fatalf("bans left after unban: %+v", banList.List())
+	}
+}
+
+func TestAdmin_RouteBans(t *testing.T) {
+	srv, banList, _ := newTestAdmin(t, "secret")
+
+	var ban adminBan
+	if code := adminRequest(t, srv, "POST", "/bans", `{"addr": "10.0.0.1", "route": "box2"}`, &ban); code != http.StatusOK {
+		t.Fatalf("route ban: got status %d", code)
+	}
+	if ban.Route != "box2" || ban.Until == nil {
+		t.Fatalf("unexpected route ban %+v", ban)
+	}
+	if banList.IsBanned(netip.MustParseAddr("10.0.0.1")) {
+		t.Fatal("route ban applied to the shared ban list")
+	}
+	if code := adminRequest(t, srv, "POST", "/bans", `{"addr": "10.0.0.1", "route": "box9"}`, nil); code != http.StatusBadRequest {
+		t.Fatalf("ban on unknown route: got status %d", code)
+	}
+
+	var list struct{ Bans []adminBan }
+	adminRequest(t, srv, "GET", "/bans", "", &list)
+	if len(list.Bans) != 1 || list.Bans[0].Addr != "10.0.0.1" || list.Bans[0].Route != "box2" {
+		t.Fatalf("unexpected ban list %+v", list.Bans)
+	}
+
+	if code := adminRequest(t, srv, "DELETE", "/bans/10.0.0.1", "", nil); code != http.StatusNotFound {
+		t.Fatalf("shared unban of route ban: got status %d", code)
+	}
+	if code := adminRequest(t, srv, "DELETE", "/bans/10.0.0.1?route=box2", "", nil); code != http.StatusNoContent {
+		t.Fatalf("route unban: got status %d", code)
+	}
+}
+
+func TestAdmin_Failures(t *testing.T) {
+	srv, _, scopes := newTestAdmin(t, "secret")
+	at := time.Now().Truncate(time.Second)
+	scopes[""].tallies.Set(at, map[netip.Addr]float64{
+		netip.MustParseAddr("10.0.0.1"): 1.5,
+		netip.MustParseAddr("10.0.0.2"): 4,
+	})
+	// Failures of routes with their own ban list are listed with the route.
+	scopes["box2"].tallies.Set(at.Add(-time.Second), map[netip.Addr]float64{
+		netip.MustParseAddr("10.0.0.1"): 2,
+	})
+	var resp struct {
+		Updated   time.Time
+		Threshold float64
+		Failures  []adminFailure
+	}
+	if code := adminRequest(t, srv, "GET", "/failures", "", &resp); code != http.StatusOK {
+		t.Fatalf("failures: got status %d", code)
+	}
+	if !resp.Updated.Equal(at) || resp.Threshold != 5 || len(resp.Failures) != 3 ||
+		resp.Failures[0].Addr != netip.MustParseAddr("10.0.0.2") || resp.Failures[0].Score != 4 ||
+		resp.Failures[1] != (adminFailure{Addr: netip.MustParseAddr("10.0.0.1"), Route: "box2", Score: 2}) ||
+		resp.Failures[2].Route != "" {
+		t.Fatalf("unexpected failures %+v", resp)
+	}
+}
+
+func TestListenAdmin_Unix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "admin.sock")
+	for i := 0; i < 2; i++ {
+		// The second listen replaces the socket left by the first.
+		ln, err := listenAdmin("unix:" + path)
+		if err != nil {
+			t.Fatalf("listenAdmin: %v", err)
+		}
+		if i == 1 {
+			conn, err := net.Dial("unix", path)
+			if err != nil {
+				t.Fatalf("dial: %v", err)
+			}
+			conn.Close()
+		}
+		if l, ok := ln.(*net.UnixListener); ok {
+			l.SetUnlinkOnClose(false)
+		}
+		ln.Close()
+	}
+}
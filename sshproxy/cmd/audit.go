@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"sync"
+	"time"
+)
+
+// How a session ended, as recorded in AuditRecord.Ended.
+const (
+	endClientClosed   = "client_closed"
+	endUpstreamClosed = "upstream_closed"
+	endClientError    = "client_error"
+	endUpstreamError  = "upstream_error"
+	endDialFailed     = "dial_failed"
+	endUpstreamAuth   = "upstream_auth"
+	endRejected       = "rejected"
+	endShutdown       = "shutdown"
+)
+
+// AuditRecord describes one client connection, from accept to close.
+type AuditRecord struct {
+	Route      string     `json:"route"`
+	ClientIP   netip.Addr `json:"client_ip"`
+	ClientPort uint16     `json:"client_port"`
+	// Software is the client's SSH software, from its identification
+	// string.
+	Software string `json:"client_software,omitempty"`
+	// User and Fingerprint are set for clients authenticated in
+	// terminate mode.
+	User            string    `json:"user,omitempty"`
+	Fingerprint     string    `json:"fingerprint,omitempty"`
+	Upstream        string    `json:"upstream"`
+	Start           time.Time `json:"start"`
+	End             time.Time `json:"end"`
+	Duration        float64   `json:"duration_seconds"`
+	BytesUpstream   int64     `json:"bytes_upstream"`
+	BytesDownstream int64     `json:"bytes_downstream"`
+	Ended           string    `json:"ended"`
+	// Reason is why a rejected connection was turned away, as in the
+	// reason label of sshproxy_connections_rejected_total.
+	Reason string `json:"reason,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// sessionResult is how a forwarded session went, for its audit record.
+type sessionResult struct {
+	ended  string
+	reason string
+	err    error
+	// upstream and downstream count the bytes forwarded to the target
+	// and to the client.
+	upstream, downstream int64
+	user, fingerprint    string
+}
+
+// endOnce keeps how a session ended first, since closing one side ends
+// the other as well.
+type endOnce struct {
+	once  sync.Once
+	ended string
+	err   error
+}
+
+func (e *endOnce) set(ended string, err error) {
+	e.once.Do(func() { e.ended, e.err = ended, err })
+}
+
+// endOf classifies the end of copying from a side, with err as returned
+// by io.Copy and readErr the error reading from src, if any. Connections
+// closed by Shutdown count as ended by the shutdown.
+func (p *Proxy) endOf(fromClient bool, err, readErr error) (string, error) {
+	switch {
+	case err == nil || errors.Is(err, io.EOF):
+		if fromClient {
+			return endClientClosed, nil
+		}
+		return endUpstreamClosed, nil
+	case p.forced.Load() && errors.Is(err, net.ErrClosed):
+		return endShutdown, nil
+	}
+	// Reading from the client and writing to it both fail on its side.
+	if fromClient == (readErr != nil) {
+		return endClientError, err
+	}
+	return endUpstreamError, err
+}
+
+// errReader remembers the error returned by its reader other than io.EOF,
+// to tell read errors from write errors after io.Copy.
+type errReader struct {
+	r   io.Reader
+	err error
+}
+
+func (e *errReader) Read(p []byte) (int, error) {
+	n, err := e.r.Read(p)
+	if err != nil && err != io.EOF {
+		e.err = err
+	}
+	return n, err
+}
+
+// AuditLog appends AuditRecords to a file as JSON lines. When a record
+// would grow the file past maxSize, the file is renamed to path.1, older
+// files move up to path.2 and so on, and a new file is started. Only
+// maxBackups old files are kept.
+type AuditLog struct {
+	mu         sync.Mutex
+	path       string
+	maxSize    int64
+	maxBackups int
+	f          *os.File
+	size       int64
+}
+
+// OpenAuditLog opens the audit log at path for appending.
+func OpenAuditLog(path string, maxSize int64, maxBackups int) (*AuditLog, error) {
+	a := &AuditLog{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := a.open(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *AuditLog) open() error {
+	f, err := os.OpenFile(a.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o640)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	a.f, a.size = f, info.Size()
+	return nil
+}
+
+// Write appends rec as one line.
+func (a *AuditLog) Write(rec AuditRecord) error {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.f == nil {
+		// A failed rotation left no file open.
+		if err := a.open(); err != nil {
+			return err
+		}
+	}
+	if a.size > 0 && a.size+int64(len(line)) > a.maxSize {
+		if err := a.rotate(); err != nil {
+			return fmt.Errorf("rotating %s: %w", a.path, err)
+		}
+	}
+	n, err := a.f.Write(line)
+	a.size += int64(n)
+	return err
+}
+
+func (a *AuditLog) rotate() error {
+	err := a.f.Close()
+	a.f = nil
+	if err != nil {
+		return err
+	}
+	if a.maxBackups == 0 {
+		if err := os.Remove(a.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return a.open()
+	}
+	for i := a.maxBackups - 1; i > 0; i-- {
+		err := os.Rename(a.backup(i), a.backup(i+1))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	if err := os.Rename(a.path, a.backup(1)); err != nil {
+		return err
+	}
+	return a.open()
+}
+
+func (a *AuditLog) backup(i int) string {
+	return fmt.Sprintf("%s.%d", a.path, i)
+}
+
+// Close closes the file.
+func (a *AuditLog) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.f == nil {
+		return nil
+	}
+	err := a.f.Close()
+	a.f = nil
+	return err
+}
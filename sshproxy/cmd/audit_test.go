@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readAudit returns the records in the audit log at path.
+func readAudit(t *testing.T, path string) []AuditRecord {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var recs []AuditRecord
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var rec AuditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			t.Fatalf("invalid audit line %q: %v", scanner.Text(), err)
+		}
+		recs = append(recs, rec)
+	}
+	return recs
+}
+
+func TestAuditLog_Rotate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	a, err := OpenAuditLog(path, 500, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	for i := range 10 {
+		rec := AuditRecord{Route: "default", ClientIP: netip.MustParseAddr("203.0.113.7"), ClientPort: uint16(40000 + i), Ended: endClientClosed}
+		if err := a.Write(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var total int
+	for _, name := range []string{path, path + ".1", path + ".2"} {
+		info, err := os.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() > 500 {
+			t.Errorf("%s has %d bytes, over the limit", name, info.Size())
+		}
+		total += len(readAudit(t, name))
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("more backups than configured: %v", err)
+	}
+	// The newest records are in the current file.
+	recs := readAudit(t, path)
+	if total >= 10 || recs[len(recs)-1].ClientPort != 40009 {
+		t.Fatalf("unexpected records after rotation: %d kept, last %+v", total, recs[len(recs)-1])
+	}
+}
+
+func TestProxy_Audit(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	target := startEcho(t).Addr().String()
+	p := startTestProxy(t, target, make(fakeSource), time.Now, func(c *Config) {
+		c.Audit.Path = path
+		c.Handshake.Timeout = time.Second
+	})
+
+	// A session the client ends.
+	conn := dialSSH(t, p)
+	io.WriteString(conn, "ping")
+	got := make([]byte, len("SSH-2.0-Test\r\nping"))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	// A session still open at shutdown.
+	open := dialSSH(t, p)
+	defer open.Close()
+	if _, err := io.ReadFull(open, got[:len("SSH-2.0-Test\r\n")]); err != nil {
+		t.Fatal(err)
+	}
+	// A banned client.
+	p.banList.Ban(netip.MustParseAddr("127.0.0.1"), time.Hour)
+	banned, err := net.Dial("tcp", p.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	banned.SetReadDeadline(time.Now().Add(5 * time.Second))
+	banned.Read(make([]byte, 1))
+	banned.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	p.Shutdown(ctx)
+
+	ended := make(map[string]AuditRecord)
+	for _, rec := range readAudit(t, path) {
+		ended[rec.Ended] = rec
+	}
+	if len(ended) != 3 {
+		t.Fatalf("unexpected audit records %+v", ended)
+	}
+	closed := ended[endClientClosed]
+	if closed.Route != "default" || closed.ClientIP != netip.MustParseAddr("127.0.0.1") || closed.ClientPort == 0 ||
+		closed.Upstream != target || closed.Software != "Test" ||
+		closed.BytesUpstream != int64(len(got)) || closed.BytesDownstream != int64(len(got)) ||
+		closed.End.Before(closed.Start) || closed.Duration < 0 {
+		t.Errorf("unexpected record of a closed session %+v", closed)
+	}
+	if rec := ended[endRejected]; rec.Reason != "banned" || rec.BytesUpstream != 0 {
+		t.Errorf("unexpected record of a banned client %+v", rec)
+	}
+	if rec := ended[endShutdown]; rec.BytesDownstream != int64(len("SSH-2.0-Test\r\n")) || rec.Error != "" {
+		t.Errorf("unexpected record of a session closed at shutdown %+v", rec)
+	}
+	data, _ := os.ReadFile(path)
+	if !strings.Contains(string(data), `"ended":"client_closed"`) {
+		t.Errorf("unexpected audit log format:\n%s", data)
+	}
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// permanentBan is the escalation step for bans that never expire.
+const permanentBan time.Duration = -1
+
+// EscalationPolicy decides how long successive bans of the same address
+// last. The n-th ban uses Steps[n-1], or the last step once they run out.
+// An address that stays unbanned for ForgiveAfter starts over at the first
+// step.
+type EscalationPolicy struct {
+	Steps        []time.Duration
+	ForgiveAfter time.Duration
+}
+
+func (p EscalationPolicy) step(prior int) time.Duration {
+	if len(p.Steps) == 0 {
+		return 0
+	}
+	return p.Steps[min(prior, len(p.Steps)-1)]
+}
+
+// banHistory remembers past bans of one address.
+type banHistory struct {
+	count int       // bans since the history was last forgiven
+	until time.Time // expiry of the latest ban, zero if permanent
+	score float64   // failure score that triggered the latest ban
+}
+
+// BanList stores banned IPs and prefixes and their expiry. A zero expiry is
+// a permanent ban. Addresses in the allowlist are never banned, addresses
+// in the denylist always are. All addresses are normalized with
+// normalizeAddr.
+//
+// With a BanStore, bans are shared with other replicas through Sync;
+// escalation histories stay local to this process.
+type BanList struct {
+	sync.RWMutex
+	bans map[netip.Addr]time.Time
+	// ranges holds bans of whole prefixes made through the admin API.
+	ranges  map[netip.Prefix]time.Time
+	history map[netip.Addr]*banHistory
+	policy  EscalationPolicy
+	allow   []netip.Prefix
+	deny    []netip.Prefix
+	store   BanStore
+	// pending holds addresses and prefixes whose ban changed since the
+	// last Sync. Addresses are stored as single-address prefixes.
+	pending map[netip.Prefix]struct{}
+	// now returns the current time, time.Now unless set with SetClock.
+	now func() time.Time
+}
+
+func NewBanList(policy EscalationPolicy) *BanList {
+	return &BanList{
+		bans:    make(map[netip.Addr]time.Time),
+		ranges:  make(map[netip.Prefix]time.Time),
+		history: make(map[netip.Addr]*banHistory),
+		policy:  policy,
+		pending: make(map[netip.Prefix]struct{}),
+		now:     time.Now,
+	}
+}
+
+// SetClock replaces the function used to tell the current time.
+func (b *BanList) SetClock(now func() time.Time) {
+	b.Lock()
+	b.now = now
+	b.Unlock()
+}
+
+// SetPolicy replaces the escalation policy. Existing bans keep their expiry.
+func (b *BanList) SetPolicy(policy EscalationPolicy) {
+	b.Lock()
+	b.policy = policy
+	b.Unlock()
+}
+
+// SetPrefixes replaces the allowlist and denylist.
+func (b *BanList) SetPrefixes(allow, deny []netip.Prefix) {
+	b.Lock()
+	b.allow = allow
+	b.deny = deny
+	b.Unlock()
+}
+
+// Allowed reports whether addr is in the allowlist.
+func (b *BanList) Allowed(addr netip.Addr) bool {
+	b.RLock()
+	defer b.RUnlock()
+	return containsAddr(b.allow, normalizeAddr(addr))
+}
+
+func (b *BanList) IsBanned(addr netip.Addr) bool {
+	addr = normalizeAddr(addr)
+	b.RLock()
+	defer b.RUnlock()
+	if containsAddr(b.allow, addr) {
+		return false
+	}
+	if containsAddr(b.deny, addr) {
+		return true
+	}
+	now := b.now()
+	if until, ok := b.bans[addr]; ok && active(until, now) {
+		return true
+	}
+	for p, until := range b.ranges {
+		if p.Contains(addr) && active(until, now) {
+			return true
+		}
+	}
+	return false
+}
+
+func active(until, now time.Time) bool {
+	return until.IsZero() || now.Before(until)
+}
+
+// Ban bans addr for duration, or permanently if duration is permanentBan,
+// and records it in the address's history. Allowlisted addresses are left
+// alone.
+func (b *BanList) Ban(addr netip.Addr, duration time.Duration) {
+	addr = normalizeAddr(addr)
+	b.Lock()
+	defer b.Unlock()
+	if containsAddr(b.allow, addr) {
+		return
+	}
+	b.ban(addr, duration, 0, b.now())
+}
+
+// BanPrefix bans every address in p for duration, or permanently if
+// duration is permanentBan. A single-address prefix is the same as Ban.
+// Allowlisted addresses within p stay reachable.
+func (b *BanList) BanPrefix(p netip.Prefix, duration time.Duration) {
+	p = normalizePrefix(p)
+	if p.IsSingleIP() {
+		b.Ban(p.Addr(), duration)
+		return
+	}
+	b.Lock()
+	defer b.Unlock()
+	var until time.Time
+	if duration != permanentBan {
+		until = b.now().Add(duration)
+	}
+	b.ranges[p] = until
+	b.changed(p)
+}
+
+// Unban lifts the ban of an address or prefix and reports whether there
+// was one. An unbanned address also loses its history, so a later ban
+// starts over at the first escalation step.
+func (b *BanList) Unban(p netip.Prefix) bool {
+	p = normalizePrefix(p)
+	b.Lock()
+	defer b.Unlock()
+	var ok bool
+	if p.IsSingleIP() {
+		_, ok = b.bans[p.Addr()]
+		delete(b.bans, p.Addr())
+		delete(b.history, p.Addr())
+	} else {
+		_, ok = b.ranges[p]
+		delete(b.ranges, p)
+	}
+	if ok {
+		b.changed(p)
+	}
+	return ok
+}
+
+// Escalate bans addr for the next step of the escalation policy and
+// returns the duration used and how many times addr has now been banned.
+// The count is 0 if addr is allowlisted and was not banned. score is the
+// failure score that triggered the ban, kept for reporting.
+func (b *BanList) Escalate(addr netip.Addr, score float64) (time.Duration, int) {
+	addr = normalizeAddr(addr)
+	b.Lock()
+	defer b.Unlock()
+	if containsAddr(b.allow, addr) {
+		return 0, 0
+	}
+	now := b.now()
+	prior := 0
+	if h, ok := b.history[addr]; ok && !b.forgiven(h, now) {
+		prior = h.count
+	}
+	duration := b.policy.step(prior)
+	return duration, b.ban(addr, duration, score, now)
+}
+
+func (b *BanList) ban(addr netip.Addr, duration time.Duration, score float64, now time.Time) int {
+	var until time.Time
+	if duration != permanentBan {
+		until = now.Add(duration)
+	}
+	b.bans[addr] = until
+	b.changed(hostPrefix(addr))
+	h, ok := b.history[addr]
+	if !ok || b.forgiven(h, now) {
+		h = &banHistory{}
+		b.history[addr] = h
+	}
+	h.count++
+	h.until = until
+	h.score = score
+	return h.count
+}
+
+// changed queues p to be written on the next Sync.
+func (b *BanList) changed(p netip.Prefix) {
+	if b.store != nil {
+		b.pending[p] = struct{}{}
+	}
+}
+
+// BanInfo describes an active ban.
+type BanInfo struct {
+	Prefix netip.Prefix
+	Until  time.Time // zero if permanent
+	// Count is how many times the address has been banned and Score the
+	// failure score behind the latest ban. Both are zero for prefixes.
+	Count int
+	Score float64
+}
+
+// List returns the active bans, ordered by address.
+func (b *BanList) List() []BanInfo {
+	b.RLock()
+	defer b.RUnlock()
+	now := b.now()
+	list := make([]BanInfo, 0, len(b.bans)+len(b.ranges))
+	for addr, until := range b.bans {
+		if !active(until, now) {
+			continue
+		}
+		info := BanInfo{Prefix: hostPrefix(addr), Until: until}
+		if h, ok := b.history[addr]; ok {
+			info.Count, info.Score = h.count, h.score
+		}
+		list = append(list, info)
+	}
+	for p, until := range b.ranges {
+		if active(until, now) {
+			list = append(list, BanInfo{Prefix: p, Until: until})
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		a, b := list[i].Prefix, list[j].Prefix
+		if a.Addr() != b.Addr() {
+			return a.Addr().Less(b.Addr())
+		}
+		return a.Bits() < b.Bits()
+	})
+	return list
+}
+
+func (b *BanList) forgiven(h *banHistory, now time.Time) bool {
+	return !h.until.IsZero() && now.Sub(h.until) > b.policy.ForgiveAfter
+}
+
+// Len returns the number of banned addresses and prefixes, including
+// expired bans not yet cleaned up.
+func (b *BanList) Len() int {
+	b.RLock()
+	defer b.RUnlock()
+	return len(b.bans) + len(b.ranges)
+}
+
+// Cleanup drops expired bans and histories past the forgiveness period and
+// returns the addresses and prefixes whose bans were dropped.
+func (b *BanList) Cleanup() []netip.Prefix {
+	b.Lock()
+	defer b.Unlock()
+	now := b.now()
+	var expired []netip.Prefix
+	for addr, until := range b.bans {
+		if !active(until, now) {
+			delete(b.bans, addr)
+			expired = append(expired, netip.PrefixFrom(addr, addr.BitLen()))
+		}
+	}
+	for p, until := range b.ranges {
+		if !active(until, now) {
+			delete(b.ranges, p)
+			expired = append(expired, p)
+		}
+	}
+	for addr, h := range b.history {
+		if b.forgiven(h, now) {
+			delete(b.history, addr)
+		}
+	}
+	return expired
+}
+
+// normalizeAddr maps IPv4-mapped IPv6 addresses such as ::ffff:10.0.0.1,
+// as returned by dual-stack listeners, to plain IPv4 and drops IPv6 zones,
+// so that the same client always has the same key.
+func normalizeAddr(addr netip.Addr) netip.Addr {
+	return addr.Unmap().WithZone("")
+}
+
+// hostPrefix returns the prefix covering just addr.
+func hostPrefix(addr netip.Addr) netip.Prefix {
+	return netip.PrefixFrom(addr, addr.BitLen())
+}
+
+// parseAddr parses and normalizes an IP address.
+func parseAddr(s string) (netip.Addr, error) {
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	return normalizeAddr(addr), nil
+}
+
+// normalizePrefix masks p and rewrites IPv4-mapped IPv6 prefixes as IPv4.
+func normalizePrefix(p netip.Prefix) netip.Prefix {
+	if addr := p.Addr(); addr.Is4In6() && p.Bits() >= 96 {
+		p = netip.PrefixFrom(addr.Unmap(), p.Bits()-96)
+	}
+	return p.Masked()
+}
+
+// parsePrefixes parses CIDR prefixes. A bare address is a prefix covering
+// just that address.
+func parsePrefixes(list []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(list))
+	for _, s := range list {
+		s = strings.TrimSpace(s)
+		var p netip.Prefix
+		if strings.Contains(s, "/") {
+			var err error
+			if p, err = netip.ParsePrefix(s); err != nil {
+				return nil, err
+			}
+		} else {
+			addr, err := netip.ParseAddr(s)
+			if err != nil {
+				return nil, fmt.Errorf("invalid address or prefix %q", s)
+			}
+			p = hostPrefix(addr.WithZone(""))
+		}
+		prefixes = append(prefixes, normalizePrefix(p))
+	}
+	return prefixes, nil
+}
+
+func containsAddr(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, p := range prefixes {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
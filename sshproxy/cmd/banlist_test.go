@@ -0,0 +1,153 @@
+package main
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestBanList_Escalate(t *testing.T) {
+	b := NewBanList(EscalationPolicy{
+		Steps:        []time.Duration{10 * time.Minute, time.Hour, permanentBan},
+		ForgiveAfter: 24 * time.Hour,
+	})
+	addr := netip.MustParseAddr("1.2.3.4")
+	for i, want := range []time.Duration{10 * time.Minute, time.Hour, permanentBan, permanentBan} {
+		d, count := b.Escalate(addr, 5)
+		if d != want || count != i+1 {
+			t.Fatalf("ban %d: got %v (count %d), want %v", i+1, d, count, want)
+		}
+	}
+	if !b.IsBanned(addr) {
+		t.Fatal("expected permanent ban")
+	}
+	if until := b.bans[addr]; !until.IsZero() {
+		t.Fatalf("permanent ban has expiry %v", until)
+	}
+	b.Cleanup()
+	if !b.IsBanned(addr) || b.history[addr] == nil {
+		t.Fatal("cleanup dropped a permanent ban")
+	}
+}
+
+func TestBanList_Forgiveness(t *testing.T) {
+	b := NewBanList(EscalationPolicy{
+		Steps:        []time.Duration{10 * time.Minute, time.Hour},
+		ForgiveAfter: 24 * time.Hour,
+	})
+	addr := netip.MustParseAddr("1.2.3.4")
+	b.Escalate(addr, 5)
+
+	// Ban expired an hour ago: still within the forgiveness period.
+	b.bans[addr] = time.Now().Add(-time.Hour)
+	b.history[addr].until = b.bans[addr]
+	b.Cleanup()
+	if b.IsBanned(addr) {
+		t.Fatal("expired ban still active")
+	}
+	if d, count := b.Escalate(addr, 5); d != time.Hour || count != 2 {
+		t.Fatalf("repeat offender got %v (count %d)", d, count)
+	}
+
+	// Ban expired two days ago: history resets.
+	b.bans[addr] = time.Now().Add(-48 * time.Hour)
+	b.history[addr].until = b.bans[addr]
+	if d, count := b.Escalate(addr, 5); d != 10*time.Minute || count != 1 {
+		t.Fatalf("forgiven address got %v (count %d)", d, count)
+	}
+
+	b.bans[addr] = time.Now().Add(-48 * time.Hour)
+	b.history[addr].until = b.bans[addr]
+	b.Cleanup()
+	if len(b.bans) != 0 || len(b.history) != 0 {
+		t.Fatalf("cleanup left %v %v", b.bans, b.history)
+	}
+}
+
+func TestBanList_Normalization(t *testing.T) {
+	b := NewBanList(EscalationPolicy{Steps: []time.Duration{time.Hour}})
+	b.Ban(netip.MustParseAddr("::ffff:10.0.0.1"), time.Hour)
+	if !b.IsBanned(netip.MustParseAddr("10.0.0.1")) {
+		t.Fatal("IPv4-mapped ban does not match IPv4 address")
+	}
+	b.Ban(netip.MustParseAddr("2001:db8::1"), time.Hour)
+	if !b.IsBanned(netip.MustParseAddr("2001:db8::1%eth0")) {
+		t.Fatal("zoned address does not match ban")
+	}
+	if b.IsBanned(netip.MustParseAddr("2001:db8::2")) {
+		t.Fatal("unrelated address banned")
+	}
+}
+
+func TestBanList_Prefixes(t *testing.T) {
+	allow, err := parsePrefixes([]string{"10.0.0.0/8", "2001:db8::/32", "192.168.1.5"})
+	if err != nil {
+		t.Fatalf("parsePrefixes: %v", err)
+	}
+	deny, err := parsePrefixes([]string{"::ffff:203.0.113.0/120"})
+	if err != nil {
+		t.Fatalf("parsePrefixes: %v", err)
+	}
+	if deny[0] != netip.MustParsePrefix("203.0.113.0/24") {
+		t.Fatalf("IPv4-mapped prefix not normalized: %v", deny[0])
+	}
+	b := NewBanList(EscalationPolicy{Steps: []time.Duration{time.Hour}})
+	b.SetPrefixes(allow, deny)
+
+	for _, s := range []string{"10.1.2.3", "::ffff:10.1.2.3", "2001:db8:1::1", "192.168.1.5"} {
+		addr := netip.MustParseAddr(s)
+		if _, count := b.Escalate(addr, 5); count != 0 || b.IsBanned(addr) {
+			t.Errorf("allowlisted %s was banned", s)
+		}
+	}
+	if !b.IsBanned(netip.MustParseAddr("203.0.113.9")) {
+		t.Fatal("denylisted address not banned")
+	}
+	b.Escalate(netip.MustParseAddr("192.168.1.6"), 5)
+	if !b.IsBanned(netip.MustParseAddr("192.168.1.6")) {
+		t.Fatal("address outside allowlist not banned")
+	}
+
+	if _, err := parsePrefixes([]string{"10.0.0.0/33"}); err == nil {
+		t.Fatal("expected error for invalid prefix")
+	}
+	if _, err := parsePrefixes([]string{"office"}); err == nil {
+		t.Fatal("expected error for invalid address")
+	}
+}
+
+func TestBanList_Ranges(t *testing.T) {
+	b := NewBanList(EscalationPolicy{Steps: []time.Duration{time.Hour}})
+	allow, _ := parsePrefixes([]string{"10.0.0.1"})
+	b.SetPrefixes(allow, nil)
+	b.BanPrefix(netip.MustParsePrefix("10.0.0.0/24"), time.Hour)
+	b.BanPrefix(netip.MustParsePrefix("::ffff:192.0.2.9/128"), permanentBan)
+	if !b.IsBanned(netip.MustParseAddr("10.0.0.200")) {
+		t.Fatal("address in banned range not rejected")
+	}
+	if b.IsBanned(netip.MustParseAddr("10.0.0.1")) {
+		t.Fatal("allowlisted address in banned range rejected")
+	}
+	if !b.IsBanned(netip.MustParseAddr("192.0.2.9")) {
+		t.Fatal("single-address prefix not banned")
+	}
+
+	list := b.List()
+	if len(list) != 2 || list[0].Prefix != netip.MustParsePrefix("10.0.0.0/24") ||
+		list[1].Prefix != netip.MustParsePrefix("192.0.2.9/32") || !list[1].Until.IsZero() || list[1].Count != 1 {
+		t.Fatalf("unexpected list %+v", list)
+	}
+
+	if !b.Unban(netip.MustParsePrefix("10.0.0.0/24")) || b.IsBanned(netip.MustParseAddr("10.0.0.200")) {
+		t.Fatal("range not unbanned")
+	}
+	if !b.Unban(netip.MustParsePrefix("192.0.2.9/32")) || b.IsBanned(netip.MustParseAddr("192.0.2.9")) {
+		t.Fatal("address not unbanned")
+	}
+	if b.history[netip.MustParseAddr("192.0.2.9")] != nil {
+		t.Fatal("unban kept the escalation history")
+	}
+	if b.Unban(netip.MustParsePrefix("10.0.0.0/24")) {
+		t.Fatal("unban of missing ban reported success")
+	}
+}
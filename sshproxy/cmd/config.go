@@ -0,0 +1,926 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"net/url"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the sshproxy configuration. It is read from a YAML file, with
+// the environment variables providing defaults for the keys they cover.
+type Config struct {
+	Listen   string `yaml:"listen"`
+	Target   string `yaml:"target"`
+	LogLevel string `yaml:"log_level"`
+	// ShutdownTimeout is how long sessions may take to end after SIGTERM
+	// before they are closed.
+	ShutdownTimeout time.Duration     `yaml:"shutdown_timeout"`
+	Ban             BanConfig         `yaml:"ban"`
+	LogSources      []LogSourceConfig `yaml:"log_sources"`
+	Persistence     PersistenceConfig `yaml:"persistence"`
+	Store           StoreConfig       `yaml:"store"`
+	Admin           AdminConfig       `yaml:"admin"`
+	Metrics         MetricsConfig     `yaml:"metrics"`
+	// ProxyProtocol configures the PROXY protocol on both sides of the
+	// proxy.
+	ProxyProtocol ProxyProtocolConfig `yaml:"proxy_protocol"`
+	Handshake     HandshakeConfig     `yaml:"handshake"`
+	Terminate     TerminateConfig     `yaml:"terminate"`
+	Limits        LimitsConfig        `yaml:"limits"`
+	Audit         AuditConfig         `yaml:"audit"`
+	GeoIP         GeoIPConfig         `yaml:"geoip"`
+	// Actions are run when bans are made or lifted.
+	Actions []ActionConfig `yaml:"actions"`
+	Export  ExportConfig   `yaml:"export"`
+	Knock   KnockConfig    `yaml:"knock"`
+	Tarpit  TarpitConfig   `yaml:"tarpit"`
+	// Routes are further listen addresses, each forwarding to its own
+	// target. Listen and Target, if set, form the first route.
+	Routes []RouteConfig `yaml:"routes"`
+}
+
+// RouteConfig is a listen address and the target it forwards to.
+type RouteConfig struct {
+	// Name identifies the route in logs and the admin API. It defaults
+	// to Listen.
+	Name   string `yaml:"name"`
+	Listen string `yaml:"listen"`
+	Target string `yaml:"target"`
+	// Bans is "shared" (the default) to use the ban list of the whole
+	// proxy, or "route" to give the route a ban list of its own. Bans in
+	// the shared list apply to every route either way.
+	Bans string `yaml:"bans"`
+	// LogSources are further logs to read failures from, such as the
+	// target's auth log. They feed the ban list the route uses.
+	LogSources []LogSourceConfig `yaml:"log_sources"`
+}
+
+// BanConfig is the ban policy applied by the log parser.
+type BanConfig struct {
+	Threshold    float64            `yaml:"threshold"`
+	Window       time.Duration      `yaml:"window"`
+	Duration     time.Duration      `yaml:"duration"`
+	ScanInterval time.Duration      `yaml:"scan_interval"`
+	RetryDelay   time.Duration      `yaml:"retry_delay"`
+	RuleWeights  map[string]float64 `yaml:"rule_weights"`
+	// Escalation lists the durations of successive bans of the same
+	// address, e.g. [10m, 1h, 24h, permanent]. Empty means every ban
+	// lasts Duration.
+	Escalation   []string      `yaml:"escalation"`
+	ForgiveAfter time.Duration `yaml:"forgive_after"`
+	// Allowlist holds addresses and CIDR prefixes that are never banned,
+	// Denylist those that are always rejected.
+	Allowlist []string `yaml:"allowlist"`
+	Denylist  []string `yaml:"denylist"`
+}
+
+// PersistenceConfig selects where ban state is saved across restarts.
+type PersistenceConfig struct {
+	Type     string        `yaml:"type"` // "" (disabled) or "file"
+	Path     string        `yaml:"path"`
+	Interval time.Duration `yaml:"interval"`
+}
+
+// StoreConfig selects a store for sharing bans between replicas.
+type StoreConfig struct {
+	Type         string        `yaml:"type"` // "" (local only) or "redis"
+	Address      string        `yaml:"address"`
+	Username     string        `yaml:"username"`
+	Password     string        `yaml:"password"`
+	DB           int           `yaml:"db"`
+	Prefix       string        `yaml:"prefix"`
+	SyncInterval time.Duration `yaml:"sync_interval"`
+}
+
+// AdminConfig enables the admin HTTP API.
+type AdminConfig struct {
+	// Listen is a TCP address, or "unix:" followed by a socket path.
+	// Empty disables the API.
+	Listen string `yaml:"listen"`
+	// Token, if set, must be sent as "Authorization: Bearer <token>".
+	Token string `yaml:"token"`
+}
+
+// MetricsConfig enables the Prometheus metrics endpoint.
+type MetricsConfig struct {
+	// Listen is the TCP address serving /metrics. Empty disables it.
+	Listen string `yaml:"listen"`
+}
+
+// ProxyProtocolConfig controls PROXY protocol headers.
+type ProxyProtocolConfig struct {
+	// Upstream is the header version sent to the target, "v1" or "v2".
+	// Empty sends none.
+	Upstream string `yaml:"upstream"`
+	// Trusted lists the addresses and CIDR prefixes of load balancers
+	// that must start each connection with a PROXY protocol v1 or v2
+	// header. Other clients may not send one.
+	Trusted []string `yaml:"trusted"`
+}
+
+// HandshakeConfig controls the check that clients speak SSH before a
+// connection is forwarded.
+type HandshakeConfig struct {
+	// Timeout is how long a client has to send its identification
+	// string. 0, the default, forwards connections without checking.
+	Timeout time.Duration `yaml:"timeout"`
+	// ProbeWeight is the failure weight of a client that sends something
+	// else or nothing in time. 0 only rejects it.
+	ProbeWeight float64 `yaml:"probe_weight"`
+}
+
+// TerminateConfig enables terminating SSH in the proxy. Clients then
+// authenticate against AuthorizedKeys, and the proxy logs in to the target
+// on their behalf with UpstreamKey.
+type TerminateConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// HostKeys are the private key files the proxy presents to clients.
+	HostKeys       []string `yaml:"host_keys"`
+	AuthorizedKeys string   `yaml:"authorized_keys"`
+	UpstreamKey    string   `yaml:"upstream_key"`
+	// UpstreamUser is the user to log in to the target as, whichever user
+	// the client logged in as. All authorized keys share it.
+	UpstreamUser string `yaml:"upstream_user"`
+	// KnownHosts holds the host keys of the target.
+	KnownHosts string `yaml:"known_hosts"`
+	// FailureWeight is the failure weight of each key or password tried
+	// by a connection that ends without authenticating.
+	FailureWeight float64 `yaml:"failure_weight"`
+}
+
+// LimitsConfig caps how fast and how many connections clients may open.
+// A zero rate or cap disables that limit.
+type LimitsConfig struct {
+	// Rate is the number of new connections per second allowed from one
+	// address, with bursts of up to Burst.
+	Rate  float64 `yaml:"rate"`
+	Burst int     `yaml:"burst"`
+	// PrefixRate and PrefixBurst do the same for all addresses in an
+	// IPv4Prefix or IPv6Prefix sized network.
+	PrefixRate  float64 `yaml:"prefix_rate"`
+	PrefixBurst int     `yaml:"prefix_burst"`
+	IPv4Prefix  int     `yaml:"ipv4_prefix"`
+	IPv6Prefix  int     `yaml:"ipv6_prefix"`
+	// MaxSessionsPerIP and MaxSessions cap the connections open at once,
+	// from one address and in total.
+	MaxSessionsPerIP int `yaml:"max_sessions_per_ip"`
+	MaxSessions      int `yaml:"max_sessions"`
+}
+
+// AuditConfig enables the session audit log.
+type AuditConfig struct {
+	// Path is the JSON-lines file every connection is recorded in. Empty
+	// disables the audit log.
+	Path string `yaml:"path"`
+	// MaxSizeMB is the size in megabytes at which the file is rotated,
+	// keeping MaxBackups old files.
+	MaxSizeMB  int `yaml:"max_size_mb"`
+	MaxBackups int `yaml:"max_backups"`
+}
+
+// GeoIPConfig admits or rejects clients by the country and autonomous
+// system of their address, as found in local MaxMind databases.
+type GeoIPConfig struct {
+	// Databases are the .mmdb files addresses are looked up in, such as
+	// GeoLite2-Country and GeoLite2-ASN. Empty disables the policy.
+	Databases []string `yaml:"databases"`
+	// AllowCountries and AllowASNs, if either is set, admit only clients
+	// from those countries (ISO 3166-1 alpha-2 codes) or networks.
+	AllowCountries []string `yaml:"allow_countries"`
+	AllowASNs      []uint   `yaml:"allow_asns"`
+	// DenyCountries and DenyASNs reject clients from those countries or
+	// networks, even if the allow lists admit them.
+	DenyCountries []string `yaml:"deny_countries"`
+	DenyASNs      []uint   `yaml:"deny_asns"`
+	// CheckInterval is how often the databases are checked for changes.
+	CheckInterval time.Duration `yaml:"check_interval"`
+}
+
+// ActionConfig is a webhook or command run on changes to the ban lists.
+// Exactly one of URL and Command is set.
+type ActionConfig struct {
+	// Name identifies the action in logs and metrics.
+	Name string `yaml:"name"`
+	// Events are the changes the action runs on: ban, unban (expired),
+	// manual_ban and manual_unban (through the admin API). Empty means
+	// all of them.
+	Events []string `yaml:"events"`
+	// URL is a webhook the event is POSTed to as JSON, with Headers.
+	URL     string            `yaml:"url"`
+	Headers map[string]string `yaml:"headers"`
+	// Command is run with the event as JSON on stdin. Its arguments are
+	// Go templates of the event, e.g. "{{.Addr}}".
+	Command []string `yaml:"command"`
+	// Timeout bounds each attempt. A failed attempt is retried after
+	// RetryDelay, doubling each time, up to MaxAttempts attempts in all.
+	// Zero values mean 10s, 3 attempts and 1s.
+	Timeout     time.Duration `yaml:"timeout"`
+	MaxAttempts int           `yaml:"max_attempts"`
+	RetryDelay  time.Duration `yaml:"retry_delay"`
+}
+
+// ExportConfig enables writing the active bans to files for the
+// firewall. Each format is written if its path is set.
+type ExportConfig struct {
+	// Interval is how often the files are brought up to date.
+	Interval time.Duration `yaml:"interval"`
+	// IPSet is an "ipset restore" file filling the sets IPSetName (IPv4)
+	// and IPSetName followed by 6 (IPv6).
+	IPSet     string `yaml:"ipset"`
+	IPSetName string `yaml:"ipset_name"`
+	// NFTables is an "nft -f" script filling the sets banned_ipv4 and
+	// banned_ipv6 in the inet table NFTablesTable.
+	NFTables      string `yaml:"nftables"`
+	NFTablesTable string `yaml:"nftables_table"`
+	// HostsDeny is a hosts.deny fragment denying the bans to the daemon
+	// list HostsDenyDaemons.
+	HostsDeny        string `yaml:"hosts_deny"`
+	HostsDenyDaemons string `yaml:"hosts_deny_daemons"`
+}
+
+func (c ExportConfig) enabled() bool {
+	return c.IPSet != "" || c.NFTables != "" || c.HostsDeny != ""
+}
+
+// KnockConfig enables the port knocking gate: connections are only
+// forwarded from addresses that recently connected to each of Ports in
+// order.
+type KnockConfig struct {
+	// Ports are the listen addresses of the knock ports, in sequence
+	// order. Empty disables the gate.
+	Ports []string `yaml:"ports"`
+	// Timeout is the time from the first knock to the last.
+	Timeout time.Duration `yaml:"timeout"`
+	// Unlock is how long an address may open connections after
+	// completing the sequence.
+	Unlock time.Duration `yaml:"unlock"`
+	// Routes are the names of the gated routes. Empty means all routes.
+	Routes []string `yaml:"routes"`
+	// FailureWeight is the failure weight of a failed sequence.
+	FailureWeight float64 `yaml:"failure_weight"`
+}
+
+// TarpitConfig holds the connections of banned clients open, feeding
+// them a slow, endless SSH banner, instead of closing them.
+type TarpitConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// MaxConnections caps the connections held at once. Banned clients
+	// over it are closed as usual.
+	MaxConnections int `yaml:"max_connections"`
+	// Interval is the delay between banner lines.
+	Interval time.Duration `yaml:"interval"`
+	// LineLength is the longest banner line, CRLF included.
+	LineLength int `yaml:"line_length"`
+	// BufferSize is the size of the kernel send and receive buffers of a
+	// held connection.
+	BufferSize int `yaml:"buffer_size"`
+	// MaxDuration is how long a connection is held at most. Zero means
+	// until the client gives up.
+	MaxDuration time.Duration `yaml:"max_duration"`
+}
+
+func (c TarpitConfig) validate() error {
+	if c.MaxConnections <= 0 {
+		return errors.New("tarpit.max_connections must be positive")
+	}
+	if c.Interval <= 0 {
+		return errors.New("tarpit.interval must be positive")
+	}
+	// RFC 4253 limits banner lines to 255 characters.
+	if c.LineLength < 3 || c.LineLength > 255 {
+		return errors.New("tarpit.line_length must be between 3 and 255")
+	}
+	if c.BufferSize <= 0 {
+		return errors.New("tarpit.buffer_size must be positive")
+	}
+	if c.MaxDuration < 0 {
+		return errors.New("tarpit.max_duration must not be negative")
+	}
+	return nil
+}
+
+// gates reports whether the route is behind the knock gate.
+func (c KnockConfig) gates(route string) bool {
+	return len(c.Ports) > 0 && (len(c.Routes) == 0 || slices.Contains(c.Routes, route))
+}
+
+// LogSourceConfig describes one log to read failures from.
+type LogSourceConfig struct {
+	Path     string `yaml:"path"`
+	Format   string `yaml:"format"`
+	Timezone string `yaml:"timezone"`
+}
+
+// defaultConfig returns the built-in defaults, overridden by the
+// SSHPROXY_* environment variables.
+func defaultConfig() (Config, error) {
+	cfg := Config{
+		LogLevel:        "info",
+		ShutdownTimeout: 30 * time.Second,
+		Ban: BanConfig{
+			Threshold:    5,
+			Window:       10 * time.Minute,
+			Duration:     10 * time.Minute,
+			ScanInterval: 60 * time.Second,
+			RetryDelay:   30 * time.Second,
+			ForgiveAfter: 24 * time.Hour,
+		},
+		Persistence: PersistenceConfig{Interval: time.Minute},
+		Store:       StoreConfig{Prefix: "sshproxy:", SyncInterval: 5 * time.Second},
+		Terminate:   TerminateConfig{FailureWeight: 1},
+		Limits:      LimitsConfig{Burst: 10, PrefixBurst: 50, IPv4Prefix: 24, IPv6Prefix: 64},
+		Audit:       AuditConfig{MaxSizeMB: 100, MaxBackups: 5},
+		GeoIP:       GeoIPConfig{CheckInterval: time.Minute},
+		Knock:       KnockConfig{Timeout: 10 * time.Second, Unlock: time.Minute, FailureWeight: 1},
+		Tarpit:      TarpitConfig{MaxConnections: 1000, Interval: 10 * time.Second, LineLength: 32, BufferSize: 1024},
+		Export:      ExportConfig{Interval: 30 * time.Second, IPSetName: "sshproxy", NFTablesTable: "sshproxy", HostsDenyDaemons: "sshd"},
+	}
+	if password := os.Getenv("SSHPROXY_STORE_PASSWORD"); password != "" {
+		cfg.Store.Password = password
+	}
+	if token := os.Getenv("SSHPROXY_ADMIN_TOKEN"); token != "" {
+		cfg.Admin.Token = token
+	}
+	// Unknown levels in the environment have always meant "info".
+	if level := os.Getenv("SSHPROXY_LOG_LEVEL"); level != "" {
+		if _, err := parseLogLevel(level); err == nil {
+			cfg.LogLevel = level
+		}
+	}
+	src := LogSourceConfig{
+		Path:     os.Getenv("SSHPROXY_AUTH_LOG"),
+		Format:   os.Getenv("SSHPROXY_LOG_FORMAT"),
+		Timezone: os.Getenv("SSHPROXY_LOG_TZ"),
+	}
+	if src.Path == "" {
+		src.Path = "/var/log/auth.log"
+	}
+	cfg.LogSources = []LogSourceConfig{src}
+	if env := os.Getenv("SSHPROXY_RULE_WEIGHTS"); env != "" {
+		weights, err := parseRuleWeights(env)
+		if err != nil {
+			return cfg, fmt.Errorf("SSHPROXY_RULE_WEIGHTS: %w", err)
+		}
+		cfg.Ban.RuleWeights = weights
+	}
+	return cfg, nil
+}
+
+// loadConfig builds the configuration from the defaults, the YAML file at
+// path (if any) and overrides of the form "ban.threshold=10". Unknown keys
+// are an error.
+func loadConfig(path string, overrides []string) (Config, error) {
+	cfg, err := defaultConfig()
+	if err != nil {
+		return cfg, err
+	}
+	// Start from the defaults so that overrides can refer to entries, such
+	// as log_sources.0, that only exist there.
+	var tree map[string]any
+	data, err := yaml.Marshal(cfg)
+	if err != nil {
+		return cfg, err
+	}
+	if err := yaml.Unmarshal(data, &tree); err != nil {
+		return cfg, err
+	}
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return cfg, err
+		}
+		var file map[string]any
+		if err := yaml.Unmarshal(data, &file); err != nil {
+			return cfg, fmt.Errorf("%s: %w", path, err)
+		}
+		mergeConfigTree(tree, file)
+	}
+	for _, o := range overrides {
+		key, value, ok := strings.Cut(o, "=")
+		if !ok {
+			return cfg, fmt.Errorf("invalid override %q, expected key=value", o)
+		}
+		if err := setConfigKey(tree, strings.Split(key, "."), parseConfigValue(value)); err != nil {
+			return cfg, fmt.Errorf("override %q: %w", key, err)
+		}
+	}
+	data, err = yaml.Marshal(tree)
+	if err != nil {
+		return cfg, err
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&cfg); err != nil {
+		return cfg, err
+	}
+	return cfg, nil
+}
+
+// mergeConfigTree copies src into dst, merging nested mappings and
+// replacing everything else.
+func mergeConfigTree(dst, src map[string]any) {
+	for k, v := range src {
+		if sv, ok := v.(map[string]any); ok {
+			if dv, ok := dst[k].(map[string]any); ok {
+				mergeConfigTree(dv, sv)
+				continue
+			}
+		}
+		dst[k] = v
+	}
+}
+
+// parseConfigValue interprets an override value as a YAML scalar, so
+// numbers and booleans keep their type, falling back to the raw string.
+func parseConfigValue(value string) any {
+	var v any
+	if err := yaml.Unmarshal([]byte(value), &v); err != nil || v == nil {
+		return value
+	}
+	switch v.(type) {
+	case map[string]any, []any:
+		return value
+	}
+	return v
+}
+
+func setConfigKey(node map[string]any, path []string, value any) error {
+	if len(path) == 1 {
+		node[path[0]] = value
+		return nil
+	}
+	next, ok := node[path[0]]
+	if !ok || next == nil {
+		child := map[string]any{}
+		node[path[0]] = child
+		return setConfigKey(child, path[1:], value)
+	}
+	switch child := next.(type) {
+	case map[string]any:
+		return setConfigKey(child, path[1:], value)
+	case []any:
+		i, err := strconv.Atoi(path[1])
+		if err != nil || i < 0 || i >= len(child) {
+			return fmt.Errorf("invalid index %q into %s", path[1], path[0])
+		}
+		if len(path) == 2 {
+			child[i] = value
+			return nil
+		}
+		elem, ok := child[i].(map[string]any)
+		if !ok {
+			return fmt.Errorf("%s.%d is not a mapping", path[0], i)
+		}
+		return setConfigKey(elem, path[2:], value)
+	default:
+		return fmt.Errorf("%s is not a mapping", path[0])
+	}
+}
+
+// Validate reports the first invalid setting.
+func (c *Config) Validate() error {
+	if c.Listen == "" && len(c.Routes) == 0 {
+		return errors.New("listen address is required")
+	}
+	if c.Listen != "" && c.Target == "" {
+		return errors.New("target address is required")
+	}
+	if err := c.validateRoutes(); err != nil {
+		return err
+	}
+	if _, err := parseLogLevel(c.LogLevel); err != nil {
+		return err
+	}
+	if c.Ban.Threshold <= 0 {
+		return errors.New("ban.threshold must be positive")
+	}
+	for name, d := range map[string]time.Duration{
+		"ban.window":        c.Ban.Window,
+		"ban.duration":      c.Ban.Duration,
+		"ban.scan_interval": c.Ban.ScanInterval,
+		"ban.retry_delay":   c.Ban.RetryDelay,
+		"ban.forgive_after": c.Ban.ForgiveAfter,
+		"shutdown_timeout":  c.ShutdownTimeout,
+	} {
+		if d <= 0 {
+			return fmt.Errorf("%s must be positive", name)
+		}
+	}
+	if _, err := c.Escalation(); err != nil {
+		return fmt.Errorf("ban.escalation: %w", err)
+	}
+	if _, err := c.Rules(); err != nil {
+		return fmt.Errorf("ban.rule_weights: %w", err)
+	}
+	if _, err := parsePrefixes(c.Ban.Allowlist); err != nil {
+		return fmt.Errorf("ban.allowlist: %w", err)
+	}
+	if _, err := parsePrefixes(c.Ban.Denylist); err != nil {
+		return fmt.Errorf("ban.denylist: %w", err)
+	}
+	switch c.Persistence.Type {
+	case "":
+	case "file":
+		if c.Persistence.Path == "" {
+			return errors.New("persistence.path is required")
+		}
+		if c.Persistence.Interval <= 0 {
+			return errors.New("persistence.interval must be positive")
+		}
+	default:
+		return fmt.Errorf("persistence.type: unknown type %q", c.Persistence.Type)
+	}
+	switch c.Store.Type {
+	case "":
+	case "redis":
+		if c.Store.Address == "" {
+			return errors.New("store.address is required")
+		}
+		if c.Store.SyncInterval <= 0 {
+			return errors.New("store.sync_interval must be positive")
+		}
+	default:
+		return fmt.Errorf("store.type: unknown type %q", c.Store.Type)
+	}
+	if c.Admin.Listen != "" && !strings.HasPrefix(c.Admin.Listen, "unix:") {
+		host, _, err := net.SplitHostPort(c.Admin.Listen)
+		if err != nil {
+			return fmt.Errorf("admin.listen: %w", err)
+		}
+		if c.Admin.Token == "" && !isLoopback(host) {
+			return errors.New("admin.token is required unless admin.listen is a loopback address or unix socket")
+		}
+	}
+	if c.Metrics.Listen != "" {
+		if _, _, err := net.SplitHostPort(c.Metrics.Listen); err != nil {
+			return fmt.Errorf("metrics.listen: %w", err)
+		}
+	}
+	if _, err := proxyProtocolVersion(c.ProxyProtocol.Upstream); err != nil {
+		return fmt.Errorf("proxy_protocol.upstream: %w", err)
+	}
+	if _, err := parsePrefixes(c.ProxyProtocol.Trusted); err != nil {
+		return fmt.Errorf("proxy_protocol.trusted: %w", err)
+	}
+	if c.Handshake.Timeout < 0 {
+		return errors.New("handshake.timeout must not be negative")
+	}
+	if c.Handshake.ProbeWeight < 0 {
+		return errors.New("handshake.probe_weight must not be negative")
+	}
+	if c.Terminate.Enabled {
+		if len(c.Terminate.HostKeys) == 0 {
+			return errors.New("terminate.host_keys is required")
+		}
+		for name, path := range map[string]string{
+			"terminate.authorized_keys": c.Terminate.AuthorizedKeys,
+			"terminate.upstream_key":    c.Terminate.UpstreamKey,
+			"terminate.upstream_user":   c.Terminate.UpstreamUser,
+			"terminate.known_hosts":     c.Terminate.KnownHosts,
+		} {
+			if path == "" {
+				return fmt.Errorf("%s is required", name)
+			}
+		}
+	}
+	if c.Terminate.FailureWeight < 0 {
+		return errors.New("terminate.failure_weight must not be negative")
+	}
+	if err := c.Limits.validate(); err != nil {
+		return err
+	}
+	if c.Audit.Path != "" && c.Audit.MaxSizeMB <= 0 {
+		return errors.New("audit.max_size_mb must be positive")
+	}
+	if c.Audit.MaxBackups < 0 {
+		return errors.New("audit.max_backups must not be negative")
+	}
+	if err := c.GeoIP.validate(); err != nil {
+		return err
+	}
+	if err := validateActions(c.Actions); err != nil {
+		return err
+	}
+	if err := c.Export.validate(); err != nil {
+		return err
+	}
+	if err := c.validateKnock(); err != nil {
+		return err
+	}
+	if err := c.Tarpit.validate(); err != nil {
+		return err
+	}
+	if len(c.LogSources) == 0 {
+		return errors.New("at least one log source is required")
+	}
+	return validateLogSources("log_sources", c.LogSources)
+}
+
+func (c *Config) validateRoutes() error {
+	names := make(map[string]bool)
+	listens := make(map[string]bool)
+	if c.Listen != "" {
+		names["default"], listens[c.Listen] = true, true
+	}
+	for i, r := range c.Routes {
+		key := fmt.Sprintf("routes.%d", i)
+		if r.Listen == "" {
+			return fmt.Errorf("%s: listen is required", key)
+		}
+		if r.Target == "" {
+			return fmt.Errorf("%s: target is required", key)
+		}
+		switch r.Bans {
+		case "", "shared", "route":
+		default:
+			return fmt.Errorf("%s: unknown bans %q, expected shared or route", key, r.Bans)
+		}
+		name := cmp.Or(r.Name, r.Listen)
+		if names[name] {
+			return fmt.Errorf("%s: duplicate name %q", key, name)
+		}
+		if listens[r.Listen] {
+			return fmt.Errorf("%s: duplicate listen address %q", key, r.Listen)
+		}
+		names[name], listens[r.Listen] = true, true
+		if err := validateLogSources(key+".log_sources", r.LogSources); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Config) validateKnock() error {
+	k := c.Knock
+	routes := c.AllRoutes()
+	for i, port := range k.Ports {
+		if _, _, err := net.SplitHostPort(port); err != nil {
+			return fmt.Errorf("knock.ports.%d: %w", i, err)
+		}
+		if slices.ContainsFunc(routes, func(r RouteConfig) bool { return r.Listen == port }) {
+			return fmt.Errorf("knock.ports.%d: %q is a route's listen address", i, port)
+		}
+	}
+	for _, name := range k.Routes {
+		if _, ok := c.Route(name); !ok {
+			return fmt.Errorf("knock.routes: unknown route %q", name)
+		}
+	}
+	if k.Timeout <= 0 || k.Unlock <= 0 {
+		return errors.New("knock.timeout and knock.unlock must be positive")
+	}
+	if k.FailureWeight < 0 {
+		return errors.New("knock.failure_weight must not be negative")
+	}
+	return nil
+}
+
+func validateActions(actions []ActionConfig) error {
+	names := make(map[string]bool)
+	for i, a := range actions {
+		key := fmt.Sprintf("actions.%d", i)
+		if a.Name == "" {
+			return fmt.Errorf("%s: name is required", key)
+		}
+		if names[a.Name] {
+			return fmt.Errorf("%s: duplicate name %q", key, a.Name)
+		}
+		names[a.Name] = true
+		if (a.URL == "") == (len(a.Command) == 0) {
+			return fmt.Errorf("%s: exactly one of url and command is required", key)
+		}
+		if a.URL != "" {
+			u, err := url.Parse(a.URL)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return fmt.Errorf("%s: url must be an http or https URL", key)
+			}
+		}
+		if _, err := a.templates(); err != nil {
+			return fmt.Errorf("%s.command: %w", key, err)
+		}
+		for _, event := range a.Events {
+			if !slices.Contains(actionEvents, event) {
+				return fmt.Errorf("%s: unknown event %q, expected one of %s", key, event, strings.Join(actionEvents, ", "))
+			}
+		}
+		if a.Timeout < 0 || a.MaxAttempts < 0 || a.RetryDelay < 0 {
+			return fmt.Errorf("%s: timeout, max_attempts and retry_delay must not be negative", key)
+		}
+	}
+	return nil
+}
+
+func validateLogSources(key string, sources []LogSourceConfig) error {
+	for i, src := range sources {
+		if src.Path == "" {
+			return fmt.Errorf("%s.%d: path is required", key, i)
+		}
+		switch src.Format {
+		case "", "text", "journal":
+		default:
+			return fmt.Errorf("%s.%d: unknown format %q", key, i, src.Format)
+		}
+		if _, err := src.location(); err != nil {
+			return fmt.Errorf("%s.%d: %w", key, i, err)
+		}
+	}
+	return nil
+}
+
+// AllRoutes returns the routes with their names filled in, starting with
+// the one formed by Listen and Target, which is named "default".
+func (c *Config) AllRoutes() []RouteConfig {
+	var routes []RouteConfig
+	if c.Listen != "" {
+		routes = append(routes, RouteConfig{Name: "default", Listen: c.Listen, Target: c.Target})
+	}
+	for _, r := range c.Routes {
+		r.Name = cmp.Or(r.Name, r.Listen)
+		routes = append(routes, r)
+	}
+	return routes
+}
+
+// Route returns the route called name.
+func (c *Config) Route(name string) (RouteConfig, bool) {
+	for _, r := range c.AllRoutes() {
+		if r.Name == name {
+			return r, true
+		}
+	}
+	return RouteConfig{}, false
+}
+
+// ScopeLogSources returns the log sources feeding each ban list, by the
+// name of the route owning it, or "" for the shared one.
+func (c *Config) ScopeLogSources() map[string][]LogSourceConfig {
+	scopes := map[string][]LogSourceConfig{"": slices.Clone(c.LogSources)}
+	for _, r := range c.AllRoutes() {
+		if r.Bans == "route" {
+			scopes[r.Name] = r.LogSources
+		} else {
+			scopes[""] = append(scopes[""], r.LogSources...)
+		}
+	}
+	return scopes
+}
+
+func (c LimitsConfig) validate() error {
+	if c.Rate < 0 || c.PrefixRate < 0 {
+		return errors.New("limits.rate and limits.prefix_rate must not be negative")
+	}
+	if c.Rate > 0 && c.Burst < 1 {
+		return errors.New("limits.burst must be at least 1")
+	}
+	if c.PrefixRate > 0 && c.PrefixBurst < 1 {
+		return errors.New("limits.prefix_burst must be at least 1")
+	}
+	if c.IPv4Prefix < 0 || c.IPv4Prefix > 32 {
+		return errors.New("limits.ipv4_prefix must be between 0 and 32")
+	}
+	if c.IPv6Prefix < 0 || c.IPv6Prefix > 128 {
+		return errors.New("limits.ipv6_prefix must be between 0 and 128")
+	}
+	if c.MaxSessionsPerIP < 0 || c.MaxSessions < 0 {
+		return errors.New("limits.max_sessions_per_ip and limits.max_sessions must not be negative")
+	}
+	return nil
+}
+
+func (c GeoIPConfig) validate() error {
+	rules := len(c.AllowCountries) + len(c.AllowASNs) + len(c.DenyCountries) + len(c.DenyASNs)
+	if rules > 0 && len(c.Databases) == 0 {
+		return errors.New("geoip.databases is required with allow or deny rules")
+	}
+	for _, code := range slices.Concat(c.AllowCountries, c.DenyCountries) {
+		if len(code) != 2 {
+			return fmt.Errorf("geoip: invalid country code %q", code)
+		}
+	}
+	if c.CheckInterval <= 0 {
+		return errors.New("geoip.check_interval must be positive")
+	}
+	return nil
+}
+
+// exportName matches valid ipset set and nftables table names.
+var exportName = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_]*$`)
+
+func (c ExportConfig) validate() error {
+	if c.Interval <= 0 {
+		return errors.New("export.interval must be positive")
+	}
+	// ipset names are at most 31 characters, including the "6-tmp" suffix.
+	if !exportName.MatchString(c.IPSetName) || len(c.IPSetName) > 26 {
+		return fmt.Errorf("export.ipset_name: invalid set name %q", c.IPSetName)
+	}
+	if !exportName.MatchString(c.NFTablesTable) {
+		return fmt.Errorf("export.nftables_table: invalid table name %q", c.NFTablesTable)
+	}
+	if strings.TrimSpace(c.HostsDenyDaemons) == "" || strings.ContainsAny(c.HostsDenyDaemons, ":\n") {
+		return fmt.Errorf("export.hosts_deny_daemons: invalid daemon list %q", c.HostsDenyDaemons)
+	}
+	return nil
+}
+
+// Rules returns the default rules with the configured weights applied.
+func (c *Config) Rules() (RuleSet, error) {
+	for name, w := range c.Ban.RuleWeights {
+		if w < 0 {
+			return nil, fmt.Errorf("negative weight for rule %q", name)
+		}
+	}
+	return DefaultRules().WithWeights(c.Ban.RuleWeights)
+}
+
+// Escalation returns the ban escalation policy.
+func (c *Config) Escalation() (EscalationPolicy, error) {
+	p := EscalationPolicy{ForgiveAfter: c.Ban.ForgiveAfter}
+	if len(c.Ban.Escalation) == 0 {
+		p.Steps = []time.Duration{c.Ban.Duration}
+		return p, nil
+	}
+	for i, s := range c.Ban.Escalation {
+		if s == "permanent" {
+			if i != len(c.Ban.Escalation)-1 {
+				return p, errors.New("permanent must be the last step")
+			}
+			p.Steps = append(p.Steps, permanentBan)
+			continue
+		}
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return p, err
+		}
+		if d <= 0 {
+			return p, fmt.Errorf("step %q must be positive", s)
+		}
+		p.Steps = append(p.Steps, d)
+	}
+	return p, nil
+}
+
+// isLoopback reports whether host names only the local machine.
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	addr, err := netip.ParseAddr(host)
+	return err == nil && addr.IsLoopback()
+}
+
+// TrustedProxies returns the parsed proxy_protocol.trusted prefixes.
+func (c *Config) TrustedProxies() []netip.Prefix {
+	trusted, _ := parsePrefixes(c.ProxyProtocol.Trusted)
+	return trusted
+}
+
+// Prefixes returns the parsed allowlist and denylist.
+func (c *Config) Prefixes() (allow, deny []netip.Prefix) {
+	allow, _ = parsePrefixes(c.Ban.Allowlist)
+	deny, _ = parsePrefixes(c.Ban.Denylist)
+	return allow, deny
+}
+
+func (s LogSourceConfig) location() (*time.Location, error) {
+	if s.Timezone == "" {
+		return time.Local, nil
+	}
+	return time.LoadLocation(s.Timezone)
+}
+
+func (s LogSourceConfig) open() (LogSource, error) {
+	loc, err := s.location()
+	if err != nil {
+		return nil, err
+	}
+	return newLogSource(s.Path, s.Format, loc)
+}
+
+func parseLogLevel(s string) (slog.Level, error) {
+	switch s {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "info", "":
+		return slog.LevelInfo, nil
+	case "warn":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	default:
+		return slog.LevelInfo, fmt.Errorf("unknown log level %q", s)
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfig(t *testing.T, data string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "sshproxy.yaml")
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	t.Setenv("SSHPROXY_AUTH_LOG", "/tmp/env-auth.log")
+	t.Setenv("SSHPROXY_LOG_LEVEL", "warn")
+	path := writeConfig(t, `
+listen: ":2244"
+target: localhost:2222
+ban:
+  threshold: 3
+  window: 5m
+  rule_weights:
+    invalid_user: 2
+log_sources:
+  - path: /var/log/auth.log
+    timezone: UTC
+  - path: "-"
+    format: journal
+`)
+	cfg, err := loadConfig(path, []string{"ban.duration=1h", "log_sources.1.format=text", "ban.rule_weights.preauth_closed=0"})
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+	if cfg.Listen != ":2244" || cfg.Target != "localhost:2222" || cfg.LogLevel != "warn" {
+		t.Fatalf("unexpected addresses or level: %+v", cfg)
+	}
+	if cfg.Ban.Threshold != 3 || cfg.Ban.Window != 5*time.Minute || cfg.Ban.Duration != time.Hour || cfg.Ban.ScanInterval != time.Minute {
+		t.Fatalf("unexpected ban config: %+v", cfg.Ban)
+	}
+	if cfg.Ban.RuleWeights["invalid_user"] != 2 || cfg.Ban.RuleWeights["preauth_closed"] != 0 {
+		t.Fatalf("unexpected rule weights: %v", cfg.Ban.RuleWeights)
+	}
+	if len(cfg.LogSources) != 2 || cfg.LogSources[0].Timezone != "UTC" || cfg.LogSources[1] != (LogSourceConfig{Path: "-", Format: "text"}) {
+		t.Fatalf("unexpected log sources: %+v", cfg.LogSources)
+	}
+}
+
+func TestLoadConfig_Defaults(t *testing.T) {
+	t.Setenv("SSHPROXY_AUTH_LOG", "/tmp/env-auth.log")
+	t.Setenv("SSHPROXY_LOG_FORMAT", "journal")
+	cfg, err := loadConfig("", []string{"listen=:2244", "target=localhost:2222", "log_sources.0.timezone=UTC"})
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+	if len(cfg.LogSources) != 1 || cfg.LogSources[0] != (LogSourceConfig{Path: "/tmp/env-auth.log", Format: "journal", Timezone: "UTC"}) {
+		t.Fatalf("unexpected log sources: %+v", cfg.LogSources)
+	}
+	if cfg.Ban.Threshold != 5 || cfg.Ban.Duration != 10*time.Minute || cfg.Ban.RetryDelay != 30*time.Second {
+		t.Fatalf("unexpected ban defaults: %+v", cfg.Ban)
+	}
+}
+
+func TestLoadConfig_Errors(t *testing.T) {
+	tests := []struct {
+		name      string
+		file      string
+		overrides []string
+		want      string
+	}{
+		{"unknown key", "listen: :1\ntarget: x:1\nbann: {}\n", nil, "bann"},
+		{"bad override", "", []string{"ban.threshold"}, "key=value"},
+		{"bad index", "log_sources: [{path: a}]\n", []string{"log_sources.3.path=b"}, "invalid index"},
+		{"missing target", "listen: :1\n", nil, "target"},
+		{"bad threshold", "listen: :1\ntarget: x:1\n", []string{"ban.threshold=0"}, "ban.threshold"},
+		{"bad duration", "listen: :1\ntarget: x:1\nban: {window: -1m}\n", nil, "ban.window"},
+		{"bad rule", "listen: :1\ntarget: x:1\nban: {rule_weights: {nope: 1}}\n", nil, "nope"},
+		{"bad format", "listen: :1\ntarget: x:1\nlog_sources: [{path: a, format: xml}]\n", nil, "format"},
+		{"bad timezone", "listen: :1\ntarget: x:1\nlog_sources: [{path: a, timezone: Mars/Base}]\n", nil, "Mars"},
+		{"bad allowlist", "listen: :1\ntarget: x:1\nban: {allowlist: [office]}\n", nil, "ban.allowlist"},
+		{"bad denylist", "listen: :1\ntarget: x:1\nban: {denylist: [10.0.0.0/40]}\n", nil, "ban.denylist"},
+		{"persistence without path", "listen: :1\ntarget: x:1\npersistence: {type: file}\n", nil, "persistence.path"},
+		{"bad persistence", "listen: :1\ntarget: x:1\npersistence: {type: s3}\n", nil, "persistence.type"},
+		{"store without address", "listen: :1\ntarget: x:1\nstore: {type: redis}\n", nil, "store.address"},
+		{"bad store", "listen: :1\ntarget: x:1\nstore: {type: etcd, address: x:1}\n", nil, "store.type"},
+		{"public admin without token", "listen: :1\ntarget: x:1\nadmin: {listen: \":9180\"}\n", nil, "admin.token"},
+		{"bad admin listen", "listen: :1\ntarget: x:1\nadmin: {listen: localhost}\n", nil, "admin.listen"},
+		{"bad proxy protocol", "listen: :1\ntarget: x:1\nproxy_protocol: {upstream: v3}\n", nil, "proxy_protocol.upstream"},
+		{"bad trusted proxy", "listen: :1\ntarget: x:1\nproxy_protocol: {trusted: [lb]}\n", nil, "proxy_protocol.trusted"},
+		{"negative handshake timeout", "listen: :1\ntarget: x:1\nhandshake: {timeout: -1s}\n", nil, "handshake.timeout"},
+		{"negative probe weight", "listen: :1\ntarget: x:1\nhandshake: {probe_weight: -1}\n", nil, "handshake.probe_weight"},
+		{"terminate without keys", "listen: :1\ntarget: x:1\nterminate: {enabled: true}\n", nil, "terminate.host_keys"},
+		{"terminate without known hosts", "listen: :1\ntarget: x:1\nterminate: {enabled: true, host_keys: [k], authorized_keys: a, upstream_key: u, upstream_user: deploy}\n", nil, "terminate.known_hosts"},
+		{"terminate without upstream user", "listen: :1\ntarget: x:1\nterminate: {enabled: true, host_keys: [k], authorized_keys: a, upstream_key: u, known_hosts: h}\n", nil, "terminate.upstream_user"},
+		{"limit without burst", "listen: :1\ntarget: x:1\nlimits: {rate: 1, burst: 0}\n", nil, "limits.burst"},
+		{"bad limit prefix", "listen: :1\ntarget: x:1\nlimits: {ipv4_prefix: 33}\n", nil, "limits.ipv4_prefix"},
+		{"bad metrics listen", "listen: :1\ntarget: x:1\nmetrics: {listen: \"9100\"}\n", nil, "metrics.listen"},
+		{"bad level", "listen: :1\ntarget: x:1\nlog_level: loud\n", nil, "loud"},
+		{"route without target", "routes: [{listen: \":2\"}]\n", nil, "routes.0: target"},
+		{"bad route bans", "routes: [{listen: \":2\", target: x:2, bans: own}]\n", nil, "routes.0: unknown bans"},
+		{"duplicate route listen", "listen: :1\ntarget: x:1\nroutes: [{listen: \":1\", target: x:2}]\n", nil, "duplicate listen"},
+		{"duplicate route name", "routes: [{name: a, listen: \":2\", target: x:2}, {name: a, listen: \":3\", target: x:3}]\n", nil, "routes.1: duplicate name"},
+		{"bad route log source", "routes: [{listen: \":2\", target: x:2, log_sources: [{path: a, format: xml}]}]\n", nil, "routes.0.log_sources.0"},
+		{"bad audit size", "listen: :1\ntarget: x:1\naudit: {path: a.log, max_size_mb: 0}\n", nil, "audit.max_size_mb"},
+		{"negative audit backups", "listen: :1\ntarget: x:1\naudit: {max_backups: -1}\n", nil, "audit.max_backups"},
+		{"geoip rules without database", "listen: :1\ntarget: x:1\ngeoip: {deny_countries: [CN]}\n", nil, "geoip.databases"},
+		{"action without name", "listen: :1\ntarget: x:1\nactions: [{url: \"http://x\"}]\n", nil, "actions.0: name"},
+		{"action with url and command", "listen: :1\ntarget: x:1\nactions: [{name: a, url: \"http://x\", command: [true]}]\n", nil, "exactly one"},
+		{"bad action url", "listen: :1\ntarget: x:1\nactions: [{name: a, url: \"x:1\"}]\n", nil, "actions.0: url"},
+		{"bad action event", "listen: :1\ntarget: x:1\nactions: [{name: a, url: \"http://x\", events: [banned]}]\n", nil, "banned"},
+		{"bad action template", "listen: :1\ntarget: x:1\nactions: [{name: a, command: [echo, \"{{.IP}}\"]}]\n", nil, "actions.0.command"},
+		{"bad ipset name", "listen: :1\ntarget: x:1\nexport: {ipset_name: \"ssh proxy\"}\n", nil, "export.ipset_name"},
+		{"bad nftables table", "listen: :1\ntarget: x:1\nexport: {nftables_table: \"\"}\n", nil, "export.nftables_table"},
+		{"bad knock port", "listen: :1\ntarget: x:1\nknock: {ports: [\"7001\"]}\n", nil, "knock.ports.0"},
+		{"knock port on route", "listen: :1\ntarget: x:1\nknock: {ports: [\":1\"]}\n", nil, "knock.ports.0"},
+		{"unknown knock route", "listen: :1\ntarget: x:1\nknock: {ports: [\":2\"], routes: [box9]}\n", nil, "knock.routes"},
+		{"zero knock timeout", "listen: :1\ntarget: x:1\nknock: {timeout: 0s}\n", nil, "knock.timeout"},
+		{"negative knock weight", "listen: :1\ntarget: x:1\nknock: {failure_weight: -1}\n", nil, "knock.failure_weight"},
+		{"zero tarpit cap", "listen: :1\ntarget: x:1\ntarpit: {enabled: true, max_connections: 0}\n", nil, "tarpit.max_connections"},
+		{"long tarpit line", "listen: :1\ntarget: x:1\ntarpit: {line_length: 256}\n", nil, "tarpit.line_length"},
+		{"zero tarpit buffer", "listen: :1\ntarget: x:1\ntarpit: {buffer_size: 0}\n", nil, "tarpit.buffer_size"},
+		{"zero export interval", "listen: :1\ntarget: x:1\nexport: {interval: 0s}\n", nil, "export.interval"},
+		{"bad country code", "listen: :1\ntarget: x:1\ngeoip: {databases: [c.mmdb], allow_countries: [Germany]}\n", nil, "Germany"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := ""
+			if tt.file != "" {
+				path = writeConfig(t, tt.file)
+			}
+			cfg, err := loadConfig(path, tt.overrides)
+			if err == nil {
+				err = cfg.Validate()
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("expected error containing %q, got %v", tt.want, err)
+			}
+		})
+	}
+}
+
+func TestConfig_Routes(t *testing.T) {
+	cfg := Config{
+		Listen:     ":2244",
+		Target:     "localhost:2222",
+		LogSources: []LogSourceConfig{{Path: "/var/log/auth.log"}},
+		Routes: []RouteConfig{
+			{Listen: ":2245", Target: "box1:22", LogSources: []LogSourceConfig{{Path: "/box1/auth.log"}}},
+			{Name: "box2", Listen: ":2246", Target: "box2:22", Bans: "route", LogSources: []LogSourceConfig{{Path: "/box2/auth.log"}}},
+		},
+	}
+	var names []string
+	for _, r := range cfg.AllRoutes() {
+		names = append(names, r.Name)
+	}
+	if strings.Join(names, ",") != "default,:2245,box2" {
+		t.Fatalf("route names %q", names)
+	}
+	if r, ok := cfg.Route("box2"); !ok || r.Target != "box2:22" {
+		t.Fatalf("Route(box2) = %+v, %v", r, ok)
+	}
+	scopes := cfg.ScopeLogSources()
+	if len(scopes) != 2 || len(scopes[""]) != 2 || scopes[""][1].Path != "/box1/auth.log" || scopes["box2"][0].Path != "/box2/auth.log" {
+		t.Fatalf("unexpected scope log sources %+v", scopes)
+	}
+	if len(cfg.LogSources) != 1 {
+		t.Fatalf("log sources modified: %+v", cfg.LogSources)
+	}
+}
+
+func TestConfig_Escalation(t *testing.T) {
+	cfg := Config{Ban: BanConfig{Duration: 5 * time.Minute, ForgiveAfter: time.Hour}}
+	p, err := cfg.Escalation()
+	if err != nil || len(p.Steps) != 1 || p.Steps[0] != 5*time.Minute || p.ForgiveAfter != time.Hour {
+		t.Fatalf("default policy %+v, %v", p, err)
+	}
+	cfg.Ban.Escalation = []string{"10m", "1h", "permanent"}
+	p, err = cfg.Escalation()
+	if err != nil || len(p.Steps) != 3 || p.Steps[2] != permanentBan {
+		t.Fatalf("policy %+v, %v", p, err)
+	}
+	for _, bad := range [][]string{{"permanent", "1h"}, {"soon"}, {"-1m"}} {
+		cfg.Ban.Escalation = bad
+		if _, err := cfg.Escalation(); err == nil {
+			t.Errorf("Escalation(%q) should fail", bad)
+		}
+	}
+}
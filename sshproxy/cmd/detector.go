@@ -0,0 +1,162 @@
+package main
+
+import (
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// maxClockSkew is how far in the future a failure may be dated. Later
+// ones, as logged under a wrong time zone, would never leave the window.
+const maxClockSkew = time.Minute
+
+type failure struct {
+	at     time.Time
+	weight float64
+}
+
+// Detector tallies weighted authentication failures per IP using the time
+// each failure was logged, not the time it was read.
+type Detector struct {
+	sync.Mutex
+	window time.Duration
+	fails  map[netip.Addr][]failure
+	// seen is the start of the latest completed pass over the logs:
+	// everything logged before it has been recorded.
+	seen time.Time
+	// replayedUntil is seen as restored from a snapshot. Entries logged up
+	// to then are already counted and are skipped when the logs are
+	// read again after a restart.
+	replayedUntil time.Time
+}
+
+func NewDetector(window time.Duration) *Detector {
+	return &Detector{window: window, fails: make(map[netip.Addr][]failure)}
+}
+
+// SetWindow changes the window for subsequent calls.
+func (d *Detector) SetWindow(window time.Duration) {
+	d.Lock()
+	d.window = window
+	d.Unlock()
+}
+
+// Record adds a failure of the given weight from ip that happened at t.
+// Failures already outside the window are dropped, so replaying an old log
+// on startup does not count against anyone, and so are those dated more
+// than maxClockSkew after now.
+func (d *Detector) Record(ip netip.Addr, t time.Time, weight float64, now time.Time) {
+	d.Lock()
+	defer d.Unlock()
+	if now.Sub(t) > d.window || t.Sub(now) > maxClockSkew || !t.After(d.replayedUntil) {
+		return
+	}
+	d.fails[ip] = append(d.fails[ip], failure{at: t, weight: weight})
+}
+
+// MarkSeen records that every entry logged before t has been passed to
+// Record.
+func (d *Detector) MarkSeen(t time.Time) {
+	d.Lock()
+	d.seen = t
+	d.Unlock()
+}
+
+// Scores forgets failures that have left the window and returns the sum of
+// the remaining failure weights per IP.
+func (d *Detector) Scores(now time.Time) map[netip.Addr]float64 {
+	d.Lock()
+	defer d.Unlock()
+	scores := make(map[netip.Addr]float64, len(d.fails))
+	for ip, fails := range d.fails {
+		recent := fails[:0]
+		score := 0.0
+		for _, f := range fails {
+			if now.Sub(f.at) <= d.window {
+				recent = append(recent, f)
+				score += f.weight
+			}
+		}
+		if len(recent) == 0 {
+			delete(d.fails, ip)
+			continue
+		}
+		d.fails[ip] = recent
+		scores[ip] = score
+	}
+	return scores
+}
+
+// Reset forgets all failures from ip, typically after it has been banned.
+func (d *Detector) Reset(ip netip.Addr) {
+	d.Lock()
+	delete(d.fails, ip)
+	d.Unlock()
+}
+
+// Tallies holds the failure scores from the latest pass of the log parser
+// for reporting. With a shared store they are the scores across replicas.
+type Tallies struct {
+	sync.RWMutex
+	at     time.Time
+	scores map[netip.Addr]float64
+}
+
+// Set replaces the tallies with scores computed at at. scores must not be
+// modified afterwards.
+func (t *Tallies) Set(at time.Time, scores map[netip.Addr]float64) {
+	t.Lock()
+	t.at, t.scores = at, scores
+	t.Unlock()
+}
+
+// Get returns the latest scores and when they were computed. The map must
+// not be modified.
+func (t *Tallies) Get() (time.Time, map[netip.Addr]float64) {
+	t.RLock()
+	defer t.RUnlock()
+	return t.at, t.scores
+}
+
+// failureQueueSize bounds the failures waiting for the log parser. Further
+// failures are dropped until it catches up.
+const failureQueueSize = 1024
+
+// FailureQueue passes failures seen by the proxy itself, rather than read
+// from a log, to the log parser.
+type FailureQueue struct {
+	entries chan FailureEntry
+	wake    chan<- struct{}
+}
+
+// NewFailureQueue returns a queue that signals wake, if not nil, whenever
+// a failure is added so that the parser picks it up early.
+func NewFailureQueue(wake chan<- struct{}) *FailureQueue {
+	return &FailureQueue{entries: make(chan FailureEntry, failureQueueSize), wake: wake}
+}
+
+// Add queues f without blocking. It reports false if the queue is full.
+func (q *FailureQueue) Add(f FailureEntry) bool {
+	select {
+	case q.entries <- f:
+	default:
+		return false
+	}
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// Drain calls fn for each queued failure.
+func (q *FailureQueue) Drain(fn func(FailureEntry)) {
+	for {
+		select {
+		case f := <-q.entries:
+			fn(f)
+		default:
+			return
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestDetector_Window(t *testing.T) {
+	now := time.Date(2025, time.March, 10, 12, 0, 0, 0, time.UTC)
+	a := netip.MustParseAddr("1.2.3.4")
+	b := netip.MustParseAddr("5.6.7.8")
+	d := NewDetector(10 * time.Minute)
+	d.Record(a, now.Add(-7*24*time.Hour), 1, now)
+	d.Record(a, now.Add(-5*time.Minute), 1, now)
+	d.Record(a, now.Add(-time.Minute), 0.5, now)
+	d.Record(b, now.Add(-9*time.Minute), 1, now)
+
+	scores := d.Scores(now)
+	if scores[a] != 1.5 || scores[b] != 1 {
+		t.Fatalf("unexpected scores: %v", scores)
+	}
+	scores = d.Scores(now.Add(2 * time.Minute))
+	if scores[a] != 1.5 {
+		t.Fatalf("unexpected score for 1.2.3.4: %v", scores)
+	}
+	if _, ok := scores[b]; ok {
+		t.Fatalf("expired failures still counted: %v", scores)
+	}
+	d.Reset(a)
+	if len(d.Scores(now)) != 0 {
+		t.Fatal("expected no failures after reset")
+	}
+}
+
+func TestDetector_Future(t *testing.T) {
+	now := time.Date(2025, time.March, 10, 12, 0, 0, 0, time.UTC)
+	a := netip.MustParseAddr("1.2.3.4")
+	d := NewDetector(10 * time.Minute)
+	// A little clock skew is tolerated, an hour ahead is not.
+	d.Record(a, now.Add(30*time.Second), 1, now)
+	d.Record(a, now.Add(time.Hour), 5, now)
+	if scores := d.Scores(now); scores[a] != 1 {
+		t.Fatalf("unexpected scores: %v", scores)
+	}
+}
+
+func TestFailureQueue(t *testing.T) {
+	wake := make(chan struct{}, 1)
+	q := NewFailureQueue(wake)
+	f := FailureEntry{Addr: netip.MustParseAddr("1.2.3.4"), Time: time.Now(), Weight: 1}
+	for i := 0; i < failureQueueSize; i++ {
+		if !q.Add(f) {
+			t.Fatalf("Add failed after %d entries", i)
+		}
+	}
+	if q.Add(f) {
+		t.Fatal("Add succeeded on a full queue")
+	}
+	select {
+	case <-wake:
+	default:
+		t.Fatal("Add did not wake the parser")
+	}
+	n := 0
+	q.Drain(func(FailureEntry) { n++ })
+	if n != failureQueueSize {
+		t.Fatalf("drained %d entries, want %d", n, failureQueueSize)
+	}
+}
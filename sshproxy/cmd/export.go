@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+)
+
+// Exporter writes banned addresses and prefixes to files that firewall
+// tooling can load: an ipset restore file, an nftables script and a
+// hosts.deny fragment. Each file is replaced atomically, and only when its
+// content changes.
+type Exporter struct {
+	// last holds the content last written to each path.
+	last map[string][]byte
+}
+
+func NewExporter() *Exporter {
+	return &Exporter{last: make(map[string][]byte)}
+}
+
+// Export writes prefixes, without the addresses in allow, in the formats
+// enabled in c. The allowlist wins over bans in the proxy, and must in
+// the firewall too.
+func (e *Exporter) Export(c ExportConfig, prefixes, allow []netip.Prefix) error {
+	prefixes = coalescePrefixes(subtractPrefixes(prefixes, allow))
+	var errs []error
+	for _, f := range []struct {
+		path   string
+		render func(ExportConfig, []netip.Prefix) []byte
+	}{
+		{c.IPSet, renderIPSet},
+		{c.NFTables, renderNFTables},
+		{c.HostsDeny, renderHostsDeny},
+	} {
+		if f.path == "" {
+			continue
+		}
+		data := f.render(c, prefixes)
+		if bytes.Equal(data, e.last[f.path]) {
+			continue
+		}
+		if err := writeFileAtomic(f.path, data, 0o644); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		e.last[f.path] = data
+	}
+	return errors.Join(errs...)
+}
+
+// coalescePrefixes returns prefixes sorted, without duplicates and
+// without those inside others, as nftables interval sets require.
+func coalescePrefixes(prefixes []netip.Prefix) []netip.Prefix {
+	sorted := make([]netip.Prefix, len(prefixes))
+	for i, p := range prefixes {
+		sorted[i] = p.Masked()
+	}
+	slices.SortFunc(sorted, func(a, b netip.Prefix) int {
+		if c := a.Addr().Compare(b.Addr()); c != 0 {
+			return c
+		}
+		return a.Bits() - b.Bits()
+	})
+	// Kept prefixes are disjoint, so one inside any of them is inside the
+	// last one kept.
+	var kept []netip.Prefix
+	for _, p := range sorted {
+		if n := len(kept); n > 0 && kept[n-1].Bits() <= p.Bits() && kept[n-1].Contains(p.Addr()) {
+			continue
+		}
+		kept = append(kept, p)
+	}
+	return kept
+}
+
+// subtractPrefixes returns prefixes without the addresses in allow. A
+// prefix containing an allowed one is split into the largest prefixes
+// around it.
+func subtractPrefixes(prefixes, allow []netip.Prefix) []netip.Prefix {
+	var out []netip.Prefix
+	for _, p := range prefixes {
+		out = appendWithout(out, p.Masked(), allow)
+	}
+	return out
+}
+
+func appendWithout(out []netip.Prefix, p netip.Prefix, allow []netip.Prefix) []netip.Prefix {
+	for _, a := range allow {
+		if !a.Overlaps(p) {
+			continue
+		}
+		if a.Bits() <= p.Bits() {
+			return out
+		}
+		lower, upper := halves(p)
+		return appendWithout(appendWithout(out, lower, allow), upper, allow)
+	}
+	return append(out, p)
+}
+
+// halves returns the two halves of the masked prefix p, which must hold
+// more than one address.
+func halves(p netip.Prefix) (lower, upper netip.Prefix) {
+	b := p.Addr().AsSlice()
+	b[p.Bits()/8] |= 0x80 >> (p.Bits() % 8)
+	addr, _ := netip.AddrFromSlice(b)
+	return netip.PrefixFrom(p.Addr(), p.Bits()+1), netip.PrefixFrom(addr, p.Bits()+1)
+}
+
+// splitFamilies returns the IPv4 and IPv6 prefixes.
+func splitFamilies(prefixes []netip.Prefix) (v4, v6 []netip.Prefix) {
+	for _, p := range prefixes {
+		if p.Addr().Is4() {
+			v4 = append(v4, p)
+		} else {
+			v6 = append(v6, p)
+		}
+	}
+	return v4, v6
+}
+
+// renderIPSet returns an "ipset restore" file that fills the hash:net sets
+// named c.IPSetName for IPv4 and c.IPSetName followed by 6 for IPv6,
+// creating them if needed. Each set is filled as a temporary set and
+// swapped in, so the kernel never sees a partial list. hash:net rejects
+// /0, so a ban of every address is added as its two halves.
+func renderIPSet(c ExportConfig, prefixes []netip.Prefix) []byte {
+	var b bytes.Buffer
+	v4, v6 := splitFamilies(prefixes)
+	for _, set := range []struct {
+		name, family string
+		prefixes     []netip.Prefix
+	}{
+		{c.IPSetName, "inet", v4},
+		{c.IPSetName + "6", "inet6", v6},
+	} {
+		var elems []netip.Prefix
+		for _, p := range set.prefixes {
+			if p.Bits() == 0 {
+				lower, upper := halves(p)
+				elems = append(elems, lower, upper)
+			} else {
+				elems = append(elems, p)
+			}
+		}
+		tmp := set.name + "-tmp"
+		maxElem := max(65536, len(elems))
+		fmt.Fprintf(&b, "create %s hash:net family %s -exist\n", set.name, set.family)
+		fmt.Fprintf(&b, "create %s hash:net family %s maxelem %d -exist\n", tmp, set.family, maxElem)
+		fmt.Fprintf(&b, "flush %s\n", tmp)
+		for _, p := range elems {
+			fmt.Fprintf(&b, "add %s %s\n", tmp, formatPrefix(p))
+		}
+		fmt.Fprintf(&b, "swap %s %s\n", tmp, set.name)
+		fmt.Fprintf(&b, "destroy %s\n", tmp)
+	}
+	return b.Bytes()
+}
+
+// renderNFTables returns an nftables script for "nft -f" that declares the
+// interval sets banned_ipv4 and banned_ipv6 in the inet table
+// c.NFTablesTable and replaces their elements. nft applies the script as
+// one transaction.
+func renderNFTables(c ExportConfig, prefixes []netip.Prefix) []byte {
+	var b bytes.Buffer
+	v4, v6 := splitFamilies(prefixes)
+	b.WriteString("# Banned by sshproxy.\n")
+	fmt.Fprintf(&b, "table inet %s {\n", c.NFTablesTable)
+	b.WriteString("\tset banned_ipv4 {\n\t\ttype ipv4_addr\n\t\tflags interval\n\t}\n")
+	b.WriteString("\tset banned_ipv6 {\n\t\ttype ipv6_addr\n\t\tflags interval\n\t}\n")
+	b.WriteString("}\n")
+	for _, set := range []struct {
+		name     string
+		prefixes []netip.Prefix
+	}{{"banned_ipv4", v4}, {"banned_ipv6", v6}} {
+		fmt.Fprintf(&b, "flush set inet %s %s\n", c.NFTablesTable, set.name)
+		if len(set.prefixes) == 0 {
+			continue
+		}
+		elems := make([]string, len(set.prefixes))
+		for i, p := range set.prefixes {
+			elems[i] = formatPrefix(p)
+		}
+		fmt.Fprintf(&b, "add element inet %s %s {\n\t%s\n}\n", c.NFTablesTable, set.name, strings.Join(elems, ",\n\t"))
+	}
+	return b.Bytes()
+}
+
+// renderHostsDeny returns a hosts.deny fragment denying each prefix to
+// c.HostsDenyDaemons, in the net/mask form for IPv4 prefixes and the
+// [net]/bits form for IPv6 that TCP wrappers understand.
+func renderHostsDeny(c ExportConfig, prefixes []netip.Prefix) []byte {
+	var b bytes.Buffer
+	b.WriteString("# Banned by sshproxy.\n")
+	for _, p := range prefixes {
+		var pattern string
+		switch {
+		case p.Addr().Is4() && p.IsSingleIP():
+			pattern = p.Addr().String()
+		case p.Addr().Is4():
+			pattern = p.Addr().String() + "/" + net.IP(net.CIDRMask(p.Bits(), 32)).String()
+		case p.IsSingleIP():
+			pattern = "[" + p.Addr().String() + "]"
+		default:
+			pattern = fmt.Sprintf("[%s]/%d", p.Addr(), p.Bits())
+		}
+		fmt.Fprintf(&b, "%s: %s\n", c.HostsDenyDaemons, pattern)
+	}
+	return b.Bytes()
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCoalescePrefixes(t *testing.T) {
+	var in []netip.Prefix
+	for _, s := range []string{"10.1.2.3/32", "2001:db8::1/128", "10.0.0.0/8", "192.0.2.7/32", "10.1.0.0/16", "192.0.2.7/32", "2001:db8::/32", "198.51.100.9/24"} {
+		in = append(in, netip.MustParsePrefix(s))
+	}
+	var got []string
+	for _, p := range coalescePrefixes(in) {
+		got = append(got, p.String())
+	}
+	if want := "10.0.0.0/8 192.0.2.7/32 198.51.100.0/24 2001:db8::/32"; strings.Join(got, " ") != want {
+		t.Fatalf("got %v, want %s", got, want)
+	}
+}
+
+func TestSubtractPrefixes(t *testing.T) {
+	parse := func(list ...string) []netip.Prefix {
+		prefixes, err := parsePrefixes(list)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return prefixes
+	}
+	for _, tc := range []struct {
+		prefixes, allow []string
+		want            string
+	}{
+		{[]string{"10.0.0.0/8"}, nil, "10.0.0.0/8"},
+		{[]string{"10.0.0.0/8", "192.0.2.7"}, []string{"192.0.2.7", "2001:db8::/32"}, "10.0.0.0/8"},
+		{[]string{"10.0.0.0/8"}, []string{"10.0.0.0/7"}, ""},
+		{[]string{"10.0.0.0/30"}, []string{"10.0.0.2"}, "10.0.0.0/31 10.0.0.3/32"},
+		{[]string{"198.51.100.0/24"}, []string{"198.51.100.0/26", "198.51.100.128/26"}, "198.51.100.64/26 198.51.100.192/26"},
+		{[]string{"2001:db8::/126"}, []string{"2001:db8::3"}, "2001:db8::/127 2001:db8::2/128"},
+	} {
+		var got []string
+		for _, p := range subtractPrefixes(parse(tc.prefixes...), parse(tc.allow...)) {
+			got = append(got, p.String())
+		}
+		if strings.Join(got, " ") != tc.want {
+			t.Errorf("%v without %v: got %v, want %s", tc.prefixes, tc.allow, got, tc.want)
+		}
+	}
+}
+
+func TestExporter_Export(t *testing.T) {
+	dir := t.TempDir()
+	c := ExportConfig{
+		IPSet: filepath.Join(dir, "bans.ipset"), IPSetName: "sshproxy",
+		NFTables: filepath.Join(dir, "bans.nft"), NFTablesTable: "sshproxy",
+		HostsDeny: filepath.Join(dir, "hosts.deny"), HostsDenyDaemons: "sshd",
+	}
+	prefixes := []netip.Prefix{
+		netip.MustParsePrefix("203.0.113.7/32"),
+		netip.MustParsePrefix("198.51.100.0/24"),
+		netip.MustParsePrefix("2001:db8::1/128"),
+		netip.MustParsePrefix("2001:db8:1::/48"),
+	}
+	e := NewExporter()
+	if err := e.Export(c, prefixes, nil); err != nil {
+		t.Fatal(err)
+	}
+	for path, want := range map[string]string{
+		c.IPSet: `create sshproxy hash:net family inet -exist
+create sshproxy-tmp hash:net family inet maxelem 65536 -exist
+flush sshproxy-tmp
+add sshproxy-tmp 198.51.100.0/24
+add sshproxy-tmp 203.0.113.7
+swap sshproxy-tmp sshproxy
+destroy sshproxy-tmp
+create sshproxy6 hash:net family inet6 -exist
+create sshproxy6-tmp hash:net family inet6 maxelem 65536 -exist
+flush sshproxy6-tmp
+add sshproxy6-tmp 2001:db8::1
+add sshproxy6-tmp 2001:db8:1::/48
+swap sshproxy6-tmp sshproxy6
+destroy sshproxy6-tmp
+`,
+		c.NFTables: `# Banned by sshproxy.
+table inet sshproxy {
+	set banned_ipv4 {
+		type ipv4_addr
+		flags interval
+	}
+	set banned_ipv6 {
+		type ipv6_addr
+		flags interval
+	}
+}
+flush set inet sshproxy banned_ipv4
+add element inet sshproxy banned_ipv4 {
+	198.51.100.0/24,
+	203.0.113.7
+}
+flush set inet sshproxy banned_ipv6
+add element inet sshproxy banned_ipv6 {
+	2001:db8::1,
+	2001:db8:1::/48
+}
+`,
+		c.HostsDeny: `# Banned by sshproxy.
+sshd: 198.51.100.0/255.255.255.0
+sshd: 203.0.113.7
+sshd: [2001:db8::1]
+sshd: [2001:db8:1::]/48
+`,
+	} {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != want {
+			t.Errorf("%s:\n%s\nwant:\n%s", filepath.Base(path), data, want)
+		}
+		if info, _ := os.Stat(path); info.Mode().Perm() != 0o644 {
+			t.Errorf("%s has mode %v", filepath.Base(path), info.Mode())
+		}
+	}
+
+	// Unchanged files are not rewritten.
+	os.Remove(c.HostsDeny)
+	if err := e.Export(c, prefixes, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(c.HostsDeny); !os.IsNotExist(err) {
+		t.Fatalf("unchanged file rewritten: %v", err)
+	}
+
+	// Empty sets are flushed.
+	if err := e.Export(c, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(c.NFTables); strings.Contains(string(data), "add element") || !strings.Contains(string(data), "flush set inet sshproxy banned_ipv4") {
+		t.Fatalf("unexpected empty nftables script:\n%s", data)
+	}
+
+	// Allowlisted addresses are cut out of the banned prefixes.
+	allow := []netip.Prefix{netip.MustParsePrefix("198.51.100.7/32")}
+	if err := e.Export(c, prefixes, allow); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := os.ReadFile(c.HostsDeny)
+	if strings.Contains(string(data), "198.51.100.0/255.255.255.0") || !strings.Contains(string(data), "sshd: 198.51.100.6\nsshd: 198.51.100.8/255.255.255.248\n") {
+		t.Fatalf("allowlisted address exported:\n%s", data)
+	}
+
+	// ipset takes a ban of every address as two halves.
+	every := []netip.Prefix{netip.MustParsePrefix("0.0.0.0/0"), netip.MustParsePrefix("::/0")}
+	if err := e.Export(c, every, nil); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(c.IPSet); strings.Contains(string(data), "/0\n") ||
+		!strings.Contains(string(data), "add sshproxy-tmp 0.0.0.0/1\nadd sshproxy-tmp 128.0.0.0/1\n") ||
+		!strings.Contains(string(data), "add sshproxy6-tmp ::/1\nadd sshproxy6-tmp 8000::/1\n") {
+		t.Fatalf("unexpected ipset file for /0:\n%s", data)
+	}
+
+	// A failed write is reported.
+	c.IPSet = filepath.Join(dir, "missing", "bans.ipset")
+	if err := e.Export(c, prefixes, nil); err == nil {
+		t.Fatal("write to a missing directory succeeded")
+	}
+}
+
+func TestProxy_Export(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hosts.deny")
+	p := startTestProxy(t, startEcho(t).Addr().String(), make(fakeSource), time.Now, func(c *Config) {
+		c.Ban.Denylist = []string{"192.0.2.0/24"}
+		c.Ban.Allowlist = []string{"192.0.2.128/25"}
+		c.Export.HostsDeny = path
+		c.Export.Interval = 10 * time.Millisecond
+	})
+	defer p.Shutdown(context.Background())
+
+	// The denylist is written at startup, without the allowlist, and bans
+	// once they are made.
+	if data, err := os.ReadFile(path); err != nil || !strings.Contains(string(data), "sshd: 192.0.2.0/255.255.255.128\n") {
+		t.Fatalf("denylist not exported: %q, %v", data, err)
+	}
+	p.banList.Ban(netip.MustParseAddr("203.0.113.7"), time.Hour)
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if data, _ := os.ReadFile(path); strings.Contains(string(data), "sshd: 203.0.113.7\n") {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("ban not exported")
+		}
+	}
+}
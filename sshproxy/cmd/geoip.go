@@ -0,0 +1,171 @@
+package main
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// Rules of the GeoIP policy that reject a client, as logged with the
+// rejection.
+const (
+	geoDenyCountry = "deny_countries"
+	geoDenyASN     = "deny_asns"
+	geoNotAllowed  = "not_allowed"
+)
+
+// GeoInfo is what the GeoIP databases know about an address.
+type GeoInfo struct {
+	// Country is the ISO 3166-1 alpha-2 code of the country the address
+	// is located in.
+	Country string
+	// ASN and Org identify the autonomous system announcing the address.
+	ASN uint
+	Org string
+}
+
+// geoRecord holds the fields of GeoLite2/GeoIP2 Country, City and ASN
+// records that GeoInfo is made of.
+type geoRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	ASN uint   `maxminddb:"autonomous_system_number"`
+	Org string `maxminddb:"autonomous_system_organization"`
+}
+
+// geoFile is a loaded database and the state of the file it was read
+// from.
+type geoFile struct {
+	path    string
+	modTime time.Time
+	size    int64
+	reader  *maxminddb.Reader
+}
+
+// GeoIP looks addresses up in a set of MaxMind databases, such as a
+// country and an ASN database. Databases are read into memory, so that a
+// file can be replaced while lookups are in flight.
+type GeoIP struct {
+	// mu serializes Load.
+	mu    sync.Mutex
+	files atomic.Pointer[[]*geoFile]
+}
+
+func NewGeoIP() *GeoIP {
+	return &GeoIP{}
+}
+
+// Load makes paths the databases to look addresses up in. Files that are
+// new or changed since the last call are read, the others are kept as
+// they are. A file that fails to load keeps its previous version, if any,
+// and is retried on the next call. Load returns the paths it read.
+func (g *GeoIP) Load(paths []string) (loaded []string, err error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	var old []*geoFile
+	if files := g.files.Load(); files != nil {
+		old = *files
+	}
+	var next []*geoFile
+	var errs []error
+	for _, path := range paths {
+		i := slices.IndexFunc(old, func(f *geoFile) bool { return f.path == path })
+		info, err := os.Stat(path)
+		if err != nil {
+			errs = append(errs, err)
+			if i >= 0 {
+				next = append(next, old[i])
+			}
+			continue
+		}
+		if i >= 0 && old[i].modTime.Equal(info.ModTime()) && old[i].size == info.Size() {
+			next = append(next, old[i])
+			continue
+		}
+		f, err := openGeoFile(path, info)
+		if err != nil {
+			errs = append(errs, err)
+			if i >= 0 {
+				next = append(next, old[i])
+			}
+			continue
+		}
+		next = append(next, f)
+		loaded = append(loaded, path)
+	}
+	g.files.Store(&next)
+	return loaded, errors.Join(errs...)
+}
+
+func openGeoFile(path string, info os.FileInfo) (*geoFile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	reader, err := maxminddb.FromBytes(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &geoFile{path: path, modTime: info.ModTime(), size: info.Size(), reader: reader}, nil
+}
+
+// Lookup returns what the databases know about addr. Each field is taken
+// from the first database that has it. found is false if no database
+// has a record for addr, as with private addresses.
+func (g *GeoIP) Lookup(addr netip.Addr) (info GeoInfo, found bool) {
+	files := g.files.Load()
+	if files == nil {
+		return GeoInfo{}, false
+	}
+	ip := normalizeAddr(addr).AsSlice()
+	for _, f := range *files {
+		var rec geoRecord
+		// Errors only come from malformed records, which count as missing.
+		if _, ok, err := f.reader.LookupNetwork(ip, &rec); err != nil || !ok {
+			continue
+		}
+		found = true
+		info.Country = cmp.Or(info.Country, strings.ToUpper(rec.Country.ISOCode))
+		if info.ASN == 0 {
+			info.ASN, info.Org = rec.ASN, rec.Org
+		}
+	}
+	return info, found
+}
+
+// reject returns the rule that rejects a client with info, or "" if it is
+// admitted. The deny lists take precedence over the allow lists. Clients
+// unknown to the databases are admitted.
+func (c GeoIPConfig) reject(info GeoInfo, found bool) string {
+	country := func(codes []string) bool {
+		return info.Country != "" && slices.ContainsFunc(codes, func(code string) bool {
+			return strings.EqualFold(code, info.Country)
+		})
+	}
+	asn := func(asns []uint) bool {
+		return info.ASN != 0 && slices.Contains(asns, info.ASN)
+	}
+	switch {
+	case !found:
+		return ""
+	case country(c.DenyCountries):
+		return geoDenyCountry
+	case asn(c.DenyASNs):
+		return geoDenyASN
+	case len(c.AllowCountries) == 0 && len(c.AllowASNs) == 0:
+		return ""
+	case country(c.AllowCountries) || asn(c.AllowASNs):
+		return ""
+	}
+	return geoNotAllowed
+}
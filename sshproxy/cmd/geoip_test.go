@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// mmdbValue appends v in the MaxMind DB data format. It handles the types
+// the fixtures use: strings, unsigned integers, maps and string slices.
+func mmdbValue(buf *bytes.Buffer, v any) {
+	// Sizes from 29 to 284 take an extra byte. Longer values are not
+	// needed.
+	control := func(typ, size int) {
+		low := min(size, 29)
+		if typ <= 7 {
+			buf.WriteByte(byte(typ<<5 | low))
+		} else {
+			buf.Write([]byte{byte(low), byte(typ - 7)})
+		}
+		if low == 29 {
+			buf.WriteByte(byte(size - 29))
+		}
+	}
+	uint := func(typ int, n uint64) {
+		b := binary.BigEndian.AppendUint64(nil, n)
+		for len(b) > 0 && b[0] == 0 {
+			b = b[1:]
+		}
+		control(typ, len(b))
+		buf.Write(b)
+	}
+	switch v := v.(type) {
+	case string:
+		control(2, len(v))
+		buf.WriteString(v)
+	case uint16:
+		uint(5, uint64(v))
+	case uint32:
+		uint(6, uint64(v))
+	case uint64:
+		uint(9, v)
+	case []string:
+		control(11, len(v))
+		for _, s := range v {
+			mmdbValue(buf, s)
+		}
+	case map[string]any:
+		control(7, len(v))
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		slices.Sort(keys)
+		for _, k := range keys {
+			mmdbValue(buf, k)
+			mmdbValue(buf, v[k])
+		}
+	default:
+		panic("unsupported mmdb value")
+	}
+}
+
+// writeMMDB writes an IPv6 MaxMind database with 32-bit records that maps
+// each network to its record. IPv4 networks go in the ::/96 subtree, where
+// readers look them up.
+func writeMMDB(t *testing.T, path, dbType string, records map[string]map[string]any) {
+	t.Helper()
+	// A record is 0 for no data, n > 0 for node n and -1-offset for data
+	// at offset. Node 0 is the root, which no record points to.
+	nodes := [][2]int{{0, 0}}
+	var data bytes.Buffer
+	for network, rec := range records {
+		prefix := netip.MustParsePrefix(network)
+		addr, bits := prefix.Addr().As16(), prefix.Bits()
+		if prefix.Addr().Is4() {
+			addr, bits = [16]byte{}, bits+96
+			copy(addr[12:], prefix.Addr().AsSlice())
+		}
+		node := 0
+		for i := range bits {
+			bit := addr[i/8] >> (7 - i%8) & 1
+			if i == bits-1 {
+				nodes[node][bit] = -1 - data.Len()
+				break
+			}
+			if nodes[node][bit] == 0 {
+				nodes = append(nodes, [2]int{})
+				nodes[node][bit] = len(nodes) - 1
+			}
+			node = nodes[node][bit]
+		}
+		mmdbValue(&data, rec)
+	}
+
+	var buf bytes.Buffer
+	for _, node := range nodes {
+		for _, rec := range node {
+			switch {
+			case rec == 0:
+				rec = len(nodes)
+			case rec < 0:
+				rec = len(nodes) + 16 + (-1 - rec)
+			}
+			buf.Write(binary.BigEndian.AppendUint32(nil, uint32(rec)))
+		}
+	}
+	buf.Write(make([]byte, 16))
+	buf.Write(data.Bytes())
+	buf.WriteString("\xab\xcd\xefMaxMind.com")
+	mmdbValue(&buf, map[string]any{
+		"binary_format_major_version": uint16(2),
+		"binary_format_minor_version": uint16(0),
+		"build_epoch":                 uint64(time.Now().Unix()),
+		"database_type":               dbType,
+		"description":                 map[string]any{"en": "sshproxy test database"},
+		"ip_version":                  uint16(6),
+		"languages":                   []string{"en"},
+		"node_count":                  uint32(len(nodes)),
+		"record_size":                 uint16(32),
+	})
+	if err := os.WriteFile(path, buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func country(code string) map[string]any {
+	return map[string]any{"country": map[string]any{"iso_code": code}}
+}
+
+func asn(n uint32, org string) map[string]any {
+	return map[string]any{"autonomous_system_number": n, "autonomous_system_organization": org}
+}
+
+// writeGeoFixtures writes a country and an ASN database to dir.
+func writeGeoFixtures(t *testing.T, dir string) (countryDB, asnDB string) {
+	t.Helper()
+	countryDB, asnDB = filepath.Join(dir, "country.mmdb"), filepath.Join(dir, "asn.mmdb")
+	writeMMDB(t, countryDB, "GeoLite2-Country", map[string]map[string]any{
+		"203.0.113.0/24":  country("DE"),
+		"198.51.100.0/24": country("CN"),
+		"2001:db8::/32":   country("NL"),
+	})
+	writeMMDB(t, asnDB, "GeoLite2-ASN", map[string]map[string]any{
+		"198.51.100.0/24": asn(64500, "Example Hosting"),
+		"2001:db8::/32":   asn(64501, "Example Transit"),
+	})
+	return countryDB, asnDB
+}
+
+func TestWriteMMDB(t *testing.T) {
+	countryDB, _ := writeGeoFixtures(t, t.TempDir())
+	r, err := maxminddb.Open(countryDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if err := r.Verify(); err != nil {
+		t.Fatalf("invalid fixture: %v", err)
+	}
+}
+
+func TestGeoIP_Load(t *testing.T) {
+	dir := t.TempDir()
+	countryDB, asnDB := writeGeoFixtures(t, dir)
+	g := NewGeoIP()
+	if loaded, err := g.Load([]string{countryDB, asnDB}); err != nil || len(loaded) != 2 {
+		t.Fatalf("Load: %v, %v", loaded, err)
+	}
+	for _, tt := range []struct {
+		addr  string
+		want  GeoInfo
+		found bool
+	}{
+		{"203.0.113.7", GeoInfo{Country: "DE"}, true},
+		{"::ffff:198.51.100.9", GeoInfo{Country: "CN", ASN: 64500, Org: "Example Hosting"}, true},
+		{"2001:db8::1", GeoInfo{Country: "NL", ASN: 64501, Org: "Example Transit"}, true},
+		{"192.0.2.1", GeoInfo{}, false},
+		{"127.0.0.1", GeoInfo{}, false},
+	} {
+		if got, found := g.Lookup(netip.MustParseAddr(tt.addr)); got != tt.want || found != tt.found {
+			t.Errorf("Lookup(%s) = %+v, %v, want %+v, %v", tt.addr, got, found, tt.want, tt.found)
+		}
+	}
+
+	// Unchanged files are not read again.
+	if loaded, err := g.Load([]string{countryDB, asnDB}); err != nil || len(loaded) != 0 {
+		t.Fatalf("second Load: %v, %v", loaded, err)
+	}
+
+	// A replaced file is.
+	writeMMDB(t, countryDB, "GeoLite2-Country", map[string]map[string]any{"203.0.113.0/24": country("FR")})
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(countryDB, later, later)
+	if loaded, err := g.Load([]string{countryDB, asnDB}); err != nil || !slices.Equal(loaded, []string{countryDB}) {
+		t.Fatalf("Load after change: %v, %v", loaded, err)
+	}
+	if got, _ := g.Lookup(netip.MustParseAddr("203.0.113.7")); got.Country != "FR" {
+		t.Fatalf("changed database not used: %+v", got)
+	}
+
+	// A broken file keeps the version loaded before.
+	os.WriteFile(countryDB, []byte("not a database"), 0o644)
+	if _, err := g.Load([]string{countryDB, asnDB}); err == nil {
+		t.Fatal("broken database loaded")
+	}
+	if got, _ := g.Lookup(netip.MustParseAddr("203.0.113.7")); got.Country != "FR" {
+		t.Fatalf("previous database dropped: %+v", got)
+	}
+
+	// Databases no longer configured are dropped.
+	g.Load([]string{asnDB})
+	if got, _ := g.Lookup(netip.MustParseAddr("203.0.113.7")); got.Country != "" {
+		t.Fatalf("removed database still used: %+v", got)
+	}
+}
+
+func TestGeoIPConfig_Reject(t *testing.T) {
+	de := GeoInfo{Country: "DE", ASN: 64500}
+	cn := GeoInfo{Country: "CN", ASN: 64501}
+	for _, tt := range []struct {
+		name  string
+		cfg   GeoIPConfig
+		info  GeoInfo
+		found bool
+		want  string
+	}{
+		{"no rules", GeoIPConfig{}, cn, true, ""},
+		{"denied country", GeoIPConfig{DenyCountries: []string{"cn"}}, cn, true, geoDenyCountry},
+		{"other country", GeoIPConfig{DenyCountries: []string{"CN"}}, de, true, ""},
+		{"denied asn", GeoIPConfig{DenyASNs: []uint{64500}}, de, true, geoDenyASN},
+		{"allowed country", GeoIPConfig{AllowCountries: []string{"DE"}}, de, true, ""},
+		{"not allowed", GeoIPConfig{AllowCountries: []string{"DE"}}, cn, true, geoNotAllowed},
+		{"allowed asn", GeoIPConfig{AllowCountries: []string{"DE"}, AllowASNs: []uint{64501}}, cn, true, ""},
+		{"deny wins", GeoIPConfig{AllowCountries: []string{"DE"}, DenyASNs: []uint{64500}}, de, true, geoDenyASN},
+		{"unknown address", GeoIPConfig{AllowCountries: []string{"DE"}}, GeoInfo{}, false, ""},
+		{"unknown country", GeoIPConfig{AllowCountries: []string{"DE"}}, GeoInfo{ASN: 64500}, true, geoNotAllowed},
+	} {
+		if got := tt.cfg.reject(tt.info, tt.found); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestServeConn_GeoIP(t *testing.T) {
+	countryDB, asnDB := writeGeoFixtures(t, t.TempDir())
+	target := startEcho(t)
+	cfg := &Config{Target: target.Addr().String()}
+	cfg.GeoIP = GeoIPConfig{Databases: []string{countryDB, asnDB}, DenyCountries: []string{"CN"}}
+	cfg.Ban.Allowlist = []string{"198.51.100.200"}
+	p := newTestProxy(t, *cfg)
+	if _, err := p.geo.Load(cfg.GeoIP.Databases); err != nil {
+		t.Fatal(err)
+	}
+	connect := func(peer string) error {
+		client, server := net.Pipe()
+		defer client.Close()
+		go p.serveConn(peerConn{server, tcpAddr(peer)}, cfg, nil)
+		client.SetDeadline(time.Now().Add(5 * time.Second))
+		io.WriteString(client, "ping")
+		_, err := io.ReadFull(client, make([]byte, 4))
+		return err
+	}
+
+	if err := connect("203.0.113.7:40000"); err != nil {
+		t.Fatalf("client from an admitted country rejected: %v", err)
+	}
+	if err := connect("198.51.100.9:40000"); err == nil {
+		t.Fatal("client from a denied country admitted")
+	}
+	if err := connect("198.51.100.200:40000"); err != nil {
+		t.Fatalf("allowlisted client rejected: %v", err)
+	}
+	wantMetrics(t, p.metrics,
+		`sshproxy_connections_rejected_total{reason="geoip"} 1`,
+		`sshproxy_connections_accepted_total 2`,
+	)
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// maxIdentLen is the longest identification string allowed by RFC 4253,
+// including the CR LF.
+const maxIdentLen = 255
+
+var (
+	// errNotSSH is returned when a client sends something other than an
+	// SSH identification string.
+	errNotSSH = errors.New("not an SSH identification string")
+	// errNoIdent is returned when a client closes the connection without
+	// sending anything.
+	errNoIdent = errors.New("closed before sending an identification string")
+)
+
+// readIdent waits up to timeout for the client's SSH identification string,
+// such as "SSH-2.0-OpenSSH_9.6 Ubuntu", and returns it without the line
+// ending. The returned connection replays it, so it is still forwarded to
+// the target.
+func readIdent(conn net.Conn, timeout time.Duration) (net.Conn, string, error) {
+	r := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	defer conn.SetReadDeadline(time.Time{})
+	for {
+		b, _ := r.Peek(r.Buffered())
+		if i := bytes.IndexByte(b, '\n'); i >= 0 {
+			line := strings.TrimSuffix(string(b[:i]), "\r")
+			if !strings.HasPrefix(line, "SSH-2.0-") && !strings.HasPrefix(line, "SSH-1.99-") {
+				return nil, "", errNotSSH
+			}
+			return &peekedConn{Conn: conn, r: r}, line, nil
+		}
+		// Check what has arrived so far, so a probe is rejected as soon
+		// as it cannot be SSH.
+		if len(b) >= maxIdentLen || !bytes.HasPrefix([]byte("SSH-"), b[:min(len(b), 4)]) {
+			return nil, "", errNotSSH
+		}
+		if _, err := r.Peek(len(b) + 1); err != nil {
+			if errors.Is(err, io.EOF) {
+				if len(b) == 0 {
+					return nil, "", errNoIdent
+				}
+				return nil, "", errNotSSH
+			}
+			return nil, "", err
+		}
+	}
+}
+
+// identSoftware returns the software version from an identification
+// string, e.g. "OpenSSH_9.6" from "SSH-2.0-OpenSSH_9.6 Ubuntu".
+func identSoftware(ident string) string {
+	_, rest, _ := strings.Cut(ident, "-")
+	_, rest, _ = strings.Cut(rest, "-")
+	software, _, _ := strings.Cut(rest, " ")
+	return software
+}
+
+// peekedConn is a connection whose first bytes were read ahead.
+type peekedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *peekedConn) Read(p []byte) (int, error) { return c.r.Read(p) }
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadIdent(t *testing.T) {
+	tests := []struct {
+		name  string
+		send  string
+		close bool
+		ident string
+		err   error // nil with an empty ident means a timeout
+	}{
+		{"openssh", "SSH-2.0-OpenSSH_9.6p1 Ubuntu-3ubuntu13\r\nKEX", false, "SSH-2.0-OpenSSH_9.6p1 Ubuntu-3ubuntu13", nil},
+		{"bare newline", "SSH-2.0-Go\n", false, "SSH-2.0-Go", nil},
+		{"compat version", "SSH-1.99-PuTTY_Release_0.80\r\n", false, "SSH-1.99-PuTTY_Release_0.80", nil},
+		{"ssh 1", "SSH-1.5-old\r\n", false, "", errNotSSH},
+		// Probes are rejected without waiting for a full line.
+		{"http", "GET / HTTP/1.1\r\n", false, "", errNotSSH},
+		{"tls", "\x16\x03\x01\x02\x00\x01", false, "", errNotSSH},
+		{"too long", "SSH-2.0-" + strings.Repeat("x", maxIdentLen), false, "", errNotSSH},
+		{"partial", "SSH-2.0-", true, "", errNotSSH},
+		{"closed", "", true, "", errNoIdent},
+		{"silent", "", false, "", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			go func() {
+				client.Write([]byte(tt.send))
+				if tt.close {
+					client.Close()
+				}
+			}()
+			conn, ident, err := readIdent(server, 100*time.Millisecond)
+			if tt.ident == "" {
+				var netErr net.Error
+				if tt.err == nil && !(errors.As(err, &netErr) && netErr.Timeout()) {
+					t.Fatalf("readIdent error %v, want a timeout", err)
+				}
+				if tt.err != nil && !errors.Is(err, tt.err) {
+					t.Fatalf("readIdent error %v, want %v", err, tt.err)
+				}
+				return
+			}
+			if err != nil || ident != tt.ident {
+				t.Fatalf("readIdent = %q, %v, want %q", ident, err, tt.ident)
+			}
+			// Everything the client sent is still there for the target.
+			got := make([]byte, len(tt.send))
+			if _, err := io.ReadFull(conn, got); err != nil || string(got) != tt.send {
+				t.Fatalf("read %q, %v after identification", got, err)
+			}
+		})
+	}
+}
+
+func TestIdentSoftware(t *testing.T) {
+	for ident, want := range map[string]string{
+		"SSH-2.0-OpenSSH_9.6p1 Ubuntu-3ubuntu13": "OpenSSH_9.6p1",
+		"SSH-2.0-Go":                             "Go",
+		"SSH-1.99-PuTTY_Release_0.80":            "PuTTY_Release_0.80",
+	} {
+		if got := identSoftware(ident); got != want {
+			t.Errorf("identSoftware(%q) = %q, want %q", ident, got, want)
+		}
+	}
+}
+
+func TestServeConn_Handshake(t *testing.T) {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	received := make(chan string, 1)
+	go func() {
+		for {
+			conn, err := target.Accept()
+			if err != nil {
+				return
+			}
+			line, _ := bufio.NewReader(conn).ReadString('\n')
+			received <- line
+			conn.Close()
+		}
+	}()
+
+	cfg := &Config{Target: target.Addr().String()}
+	cfg.Handshake = HandshakeConfig{Timeout: time.Second, ProbeWeight: 2}
+	p := newTestProxy(t, *cfg)
+	metrics, failures := p.metrics, p.failures
+	connect := func(send string) net.Conn {
+		client, server := net.Pipe()
+		go p.serveConn(peerConn{server, tcpAddr("203.0.113.7:40000")}, cfg, nil)
+		client.Write([]byte(send))
+		return client
+	}
+
+	// An SSH client is forwarded with its identification string intact.
+	client := connect("SSH-2.0-OpenSSH_9.6\r\n")
+	select {
+	case line := <-received:
+		if line != "SSH-2.0-OpenSSH_9.6\r\n" {
+			t.Fatalf("target received %q", line)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("SSH client not forwarded")
+	}
+	client.Close()
+
+	// A probe is rejected and counted toward a ban.
+	client = connect("GET / HTTP/1.1\r\n")
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("probe not rejected: %v", err)
+	}
+	client.Close()
+	select {
+	case p := <-failures.entries:
+		if p.Addr != netip.MustParseAddr("203.0.113.7") || p.Weight != 2 {
+			t.Fatalf("unexpected probe %+v", p)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("probe not counted")
+	}
+	wantMetrics(t, metrics,
+		`sshproxy_connections_rejected_total{reason="not_ssh"} 1`,
+		`sshproxy_connections_accepted_total 1`,
+	)
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxJournalField bounds binary export fields so a corrupt length cannot
+// make the decoder buffer the whole stream.
+const maxJournalField = 1 << 20
+
+// journalSource decodes the output of `journalctl -o json` or
+// `journalctl -o export`. The format is detected per entry: JSON entries
+// are single lines starting with '{', export entries are blocks of
+// NAME=value lines terminated by an empty line.
+type journalSource struct {
+	lines lineReader
+
+	// Export entry being assembled.
+	fields map[string]string
+	// Binary export field being assembled: NAME, then a little-endian
+	// 64-bit length, the data and a newline.
+	binName string
+	binData []byte
+}
+
+func (s *journalSource) Poll(fn func(LogEntry)) error {
+	return s.lines.ReadLines(func(line string) {
+		if e, ok := s.feed(line); ok {
+			fn(e)
+		}
+	})
+}
+
+func (s *journalSource) Close() error {
+	return s.lines.Close()
+}
+
+func (s *journalSource) feed(line string) (LogEntry, bool) {
+	if s.binName != "" {
+		// Lines were split at '\n', which may be part of the length or
+		// the data, so put it back.
+		s.binData = append(s.binData, line...)
+		s.binData = append(s.binData, '\n')
+		if len(s.binData) < 8 {
+			return LogEntry{}, false
+		}
+		n := binary.LittleEndian.Uint64(s.binData[:8])
+		if n > maxJournalField {
+			s.binName, s.binData = "", nil
+			return LogEntry{}, false
+		}
+		if uint64(len(s.binData)-8) > n {
+			s.fields[s.binName] = string(s.binData[8 : 8+n])
+			s.binName, s.binData = "", nil
+		}
+		return LogEntry{}, false
+	}
+	if s.fields == nil && strings.HasPrefix(line, "{") {
+		return journalJSONEntry(line)
+	}
+	if line == "" {
+		fields := s.fields
+		s.fields = nil
+		if fields == nil {
+			return LogEntry{}, false
+		}
+		return journalEntry(fields)
+	}
+	if s.fields == nil {
+		s.fields = make(map[string]string)
+	}
+	if name, value, ok := strings.Cut(line, "="); ok {
+		s.fields[name] = value
+	} else {
+		s.binName = line
+	}
+	return LogEntry{}, false
+}
+
+// journalJSONEntry decodes one line of `journalctl -o json`. Values are
+// strings, arrays of bytes for non-UTF-8 data, or arrays of either when a
+// field occurs more than once.
+func journalJSONEntry(line string) (LogEntry, bool) {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(line), &raw); err != nil {
+		return LogEntry{}, false
+	}
+	fields := make(map[string]string, 3)
+	for _, name := range []string{"MESSAGE", "_SOURCE_REALTIME_TIMESTAMP", "__REALTIME_TIMESTAMP"} {
+		if v, ok := raw[name]; ok {
+			if s, ok := journalJSONValue(v); ok {
+				fields[name] = s
+			}
+		}
+	}
+	return journalEntry(fields)
+}
+
+func journalJSONValue(v json.RawMessage) (string, bool) {
+	var s string
+	if err := json.Unmarshal(v, &s); err == nil {
+		return s, true
+	}
+	var b []int
+	if err := json.Unmarshal(v, &b); err == nil {
+		buf := make([]byte, len(b))
+		for i, c := range b {
+			buf[i] = byte(c)
+		}
+		return string(buf), true
+	}
+	var multi []json.RawMessage
+	if err := json.Unmarshal(v, &multi); err == nil && len(multi) > 0 {
+		return journalJSONValue(multi[0])
+	}
+	return "", false
+}
+
+// journalEntry builds an entry from journal fields, preferring the time the
+// message was sent over the time journald received it.
+func journalEntry(fields map[string]string) (LogEntry, bool) {
+	msg, ok := fields["MESSAGE"]
+	if !ok {
+		return LogEntry{}, false
+	}
+	e := LogEntry{Message: msg}
+	for _, name := range []string{"_SOURCE_REALTIME_TIMESTAMP", "__REALTIME_TIMESTAMP"} {
+		if usec, err := strconv.ParseInt(fields[name], 10, 64); err == nil {
+			e.Time = time.UnixMicro(usec)
+			break
+		}
+	}
+	return e, true
+}
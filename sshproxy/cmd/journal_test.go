@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func pollAll(t *testing.T, src LogSource) []LogEntry {
+	t.Helper()
+	var entries []LogEntry
+	if err := src.Poll(func(e LogEntry) { entries = append(entries, e) }); err != nil {
+		t.Fatalf("Poll: %v", err)
+	}
+	return entries
+}
+
+// sliceLines serves a fixed set of lines once.
+type sliceLines []string
+
+func (s *sliceLines) ReadLines(fn func(line string)) error {
+	for _, line := range *s {
+		fn(line)
+	}
+	*s = nil
+	return nil
+}
+
+func (s *sliceLines) Close() error { return nil }
+
+func splitLines(data string) *sliceLines {
+	lines := sliceLines(strings.Split(strings.TrimSuffix(data, "\n"), "\n"))
+	return &lines
+}
+
+func TestJournalSource_JSON(t *testing.T) {
+	data := `{"__REALTIME_TIMESTAMP":"1700000001000000","_SOURCE_REALTIME_TIMESTAMP":"1700000000123456","MESSAGE":"Failed password for root from 10.0.0.1 port 22 ssh2","_COMM":"sshd"}
+{"__REALTIME_TIMESTAMP":"1700000002000000","MESSAGE":[73,110,118,97,108,105,100]}
+not json
+{"__REALTIME_TIMESTAMP":"1700000003000000"}
+`
+	src := &journalSource{lines: splitLines(data)}
+	entries := pollAll(t, src)
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 entries, got %+v", entries)
+	}
+	if entries[0].Message != "Failed password for root from 10.0.0.1 port 22 ssh2" {
+		t.Fatalf("unexpected message %q", entries[0].Message)
+	}
+	if !entries[0].Time.Equal(time.UnixMicro(1700000000123456)) {
+		t.Fatalf("expected source timestamp, got %v", entries[0].Time)
+	}
+	if entries[1].Message != "Invalid" || !entries[1].Time.Equal(time.UnixMicro(1700000002000000)) {
+		t.Fatalf("unexpected byte array entry %+v", entries[1])
+	}
+}
+
+func TestJournalSource_Export(t *testing.T) {
+	var buf bytes.Buffer
+	buf.WriteString("__REALTIME_TIMESTAMP=1700000001000000\n_SOURCE_REALTIME_TIMESTAMP=1700000000000000\n")
+	buf.WriteString("MESSAGE=Invalid user admin from 10.0.0.2 port 4242\n\n")
+	// Binary field whose length (10) is itself a newline byte and whose
+	// data contains a newline.
+	msg := "line1\nline"
+	buf.WriteString("__REALTIME_TIMESTAMP=1700000002000000\nMESSAGE\n")
+	binary.Write(&buf, binary.LittleEndian, uint64(len(msg)))
+	buf.WriteString(msg + "\n")
+	buf.WriteString("_PID=42\n\n")
+
+	src := &journalSource{lines: splitLines(buf.String() + "\n")}
+	entries := pollAll(t, src)
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 entries, got %+v", entries)
+	}
+	if entries[0].Message != "Invalid user admin from 10.0.0.2 port 4242" || !entries[0].Time.Equal(time.Unix(1700000000, 0)) {
+		t.Fatalf("unexpected first entry %+v", entries[0])
+	}
+	if entries[1].Message != msg || !entries[1].Time.Equal(time.Unix(1700000002, 0)) {
+		t.Fatalf("unexpected binary entry %+v", entries[1])
+	}
+}
+
+func TestJournalSource_ExportFile(t *testing.T) {
+	// Read from a file, a binary field keeps its carriage returns.
+	var buf bytes.Buffer
+	msg := "line1\r\nline2\r"
+	buf.WriteString("__REALTIME_TIMESTAMP=1700000002000000\nMESSAGE\n")
+	binary.Write(&buf, binary.LittleEndian, uint64(len(msg)))
+	buf.WriteString(msg + "\n\n")
+	path := filepath.Join(t.TempDir(), "journal.export")
+	appendFile(t, path, buf.String())
+	src, err := newLogSource(path, "journal", time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	if entries := pollAll(t, src); len(entries) != 1 || entries[0].Message != msg {
+		t.Fatalf("unexpected entries %q", entries)
+	}
+}
+
+func TestJournalSource_Stream(t *testing.T) {
+	r := strings.NewReader(`{"__REALTIME_TIMESTAMP":"1700000000000000","MESSAGE":"hello"}` + "\n")
+	src := &journalSource{lines: newStreamLines(r)}
+	var entries []LogEntry
+	deadline := time.Now().Add(2 * time.Second)
+	for len(entries) == 0 && time.Now().Before(deadline) {
+		src.Poll(func(e LogEntry) { entries = append(entries, e) })
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(entries) != 1 || entries[0].Message != "hello" {
+		t.Fatalf("unexpected entries %+v", entries)
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Results of a knock, as counted in sshproxy_knocks_total.
+const (
+	knockProgress = "progress"
+	knockUnlocked = "unlocked"
+	knockFailed   = "failed"
+)
+
+// knockSweepInterval is how often expired unlocks and stale sequences are
+// dropped.
+const knockSweepInterval = time.Minute
+
+// knockState is how far an address got in the knock sequence.
+type knockState struct {
+	next    int
+	started time.Time
+}
+
+// Knocker tracks the knock sequences clients are in and the addresses
+// that completed one. The sequence and limits are passed on every call,
+// so they can change on reload.
+type Knocker struct {
+	sync.Mutex
+	states   map[netip.Addr]*knockState
+	unlocked map[netip.Addr]time.Time
+	swept    time.Time
+}
+
+func NewKnocker() *Knocker {
+	return &Knocker{
+		states:   make(map[netip.Addr]*knockState),
+		unlocked: make(map[netip.Addr]time.Time),
+	}
+}
+
+// Knock records a connection from addr to the knock port port at now and
+// returns the result. A knock on the next port of the sequence within
+// c.Timeout of the first one moves addr along, and the last one unlocks
+// addr for c.Unlock. Any other knock fails the sequence, except that a
+// knock on the first port starts it over.
+func (k *Knocker) Knock(addr netip.Addr, port string, c KnockConfig, now time.Time) string {
+	addr = normalizeAddr(addr)
+	k.Lock()
+	defer k.Unlock()
+	k.sweep(c, now)
+	s, ok := k.states[addr]
+	switch {
+	case ok && now.Sub(s.started) <= c.Timeout && c.Ports[s.next] == port:
+		s.next++
+	case port == c.Ports[0]:
+		s = &knockState{next: 1, started: now}
+		k.states[addr] = s
+		if ok {
+			// The client gave up on a sequence in progress.
+			return knockFailed
+		}
+	default:
+		delete(k.states, addr)
+		return knockFailed
+	}
+	if s.next < len(c.Ports) {
+		return knockProgress
+	}
+	delete(k.states, addr)
+	k.unlocked[addr] = now.Add(c.Unlock)
+	return knockUnlocked
+}
+
+// Unlocked reports whether addr completed the sequence within c.Unlock
+// before now.
+func (k *Knocker) Unlocked(addr netip.Addr, now time.Time) bool {
+	k.Lock()
+	defer k.Unlock()
+	until, ok := k.unlocked[normalizeAddr(addr)]
+	return ok && now.Before(until)
+}
+
+// sweep drops expired unlocks and sequences past their timeout. It runs at
+// most once every knockSweepInterval.
+func (k *Knocker) sweep(c KnockConfig, now time.Time) {
+	if now.Sub(k.swept) < knockSweepInterval {
+		return
+	}
+	k.swept = now
+	for addr, until := range k.unlocked {
+		if !now.Before(until) {
+			delete(k.unlocked, addr)
+		}
+	}
+	for addr, s := range k.states {
+		if now.Sub(s.started) > c.Timeout {
+			delete(k.states, addr)
+		}
+	}
+}
+
+// knockMessages holds the log message for each result.
+var knockMessages = map[string]string{
+	knockProgress: "Port knock",
+	knockUnlocked: "Unlocked IP by port knock",
+	knockFailed:   "Failed port knock sequence",
+}
+
+// listenKnock opens the knock ports in c, each once.
+func listenKnock(c KnockConfig) ([]knockListener, error) {
+	var listeners []knockListener
+	for _, port := range c.Ports {
+		if slices.ContainsFunc(listeners, func(l knockListener) bool { return l.port == port }) {
+			continue
+		}
+		ln, err := net.Listen("tcp", port)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, knockListener{ln, port})
+	}
+	return listeners, nil
+}
+
+// knockListener is a knock port and the address it is configured as.
+type knockListener struct {
+	net.Listener
+	port string
+}
+
+// acceptKnocks counts each connection to l as a knock and closes it.
+// Nothing is read from it, except the PROXY protocol header from a trusted
+// proxy, which names the client the knock is counted for. Trusted proxies
+// send it right away, so it is read here, keeping the knocks in order.
+func (p *Proxy) acceptKnocks(l knockListener) {
+	for {
+		raw, err := l.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			p.Logger.Error("Failed to accept knock", "port", l.port, "error", err)
+			continue
+		}
+		conn, err := acceptProxyProtocol(raw, p.cfg.Load().TrustedProxies())
+		raw.Close()
+		if errors.Is(err, errProxyLocal) {
+			continue
+		}
+		if err != nil {
+			p.Logger.Warn("Rejected knock from trusted proxy", "proxy", raw.RemoteAddr(), "port", l.port, "error", err)
+			continue
+		}
+		remote, err := netip.ParseAddrPort(conn.RemoteAddr().String())
+		if err != nil {
+			p.Logger.Error("Failed to parse remote address", "error", err)
+			continue
+		}
+		p.knock(remote.Addr(), l.port)
+	}
+}
+
+// knock records a knock from addr on port. Addresses banned on every gated
+// route are ignored, and failed sequences are counted as failures in the
+// ban scope of each gated route if their weight is set.
+func (p *Proxy) knock(addr netip.Addr, port string) {
+	addr = normalizeAddr(addr)
+	c := p.cfg.Load().Knock
+	scopes := p.knockScopes(c)
+	if !slices.ContainsFunc(scopes, func(s *banScope) bool { return !p.banned(addr, s) }) {
+		return
+	}
+	now := p.Now()
+	result := p.knocker.Knock(addr, port, c, now)
+	p.metrics.knocks.WithLabelValues(result).Inc()
+	switch result {
+	case knockProgress:
+		p.Logger.Debug(knockMessages[result], "ip", addr, "port", port)
+	case knockUnlocked:
+		p.Logger.Info(knockMessages[result], "ip", addr, "until", now.Add(c.Unlock))
+	case knockFailed:
+		p.Logger.Info(knockMessages[result], "ip", addr, "port", port)
+		if c.FailureWeight == 0 {
+			return
+		}
+		for _, s := range scopes {
+			if !s.failures.Add(FailureEntry{Addr: addr, Time: now, Weight: c.FailureWeight}) {
+				p.Logger.Debug("Failure queue full, not counting failed knock", "ip", addr)
+			}
+		}
+	}
+}
+
+// knockScopes returns the ban scopes of the routes gated by c, each once,
+// with the shared scope standing for routes without their own.
+func (p *Proxy) knockScopes(c KnockConfig) []*banScope {
+	var scopes []*banScope
+	for _, r := range p.routes {
+		if !c.gates(r.name) {
+			continue
+		}
+		s := r.scope
+		if s == nil {
+			s = p.scopes[""]
+		}
+		if !slices.Contains(scopes, s) {
+			scopes = append(scopes, s)
+		}
+	}
+	return scopes
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestKnocker(t *testing.T) {
+	c := KnockConfig{Ports: []string{":7000", ":8000", ":9000"}, Timeout: 10 * time.Second, Unlock: time.Minute}
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	at := func(d time.Duration) time.Time { return start.Add(d) }
+	ip := netip.MustParseAddr("198.51.100.9")
+	other := netip.MustParseAddr("203.0.113.7")
+	k := NewKnocker()
+
+	for _, step := range []struct {
+		addr   netip.Addr
+		port   string
+		at     time.Duration
+		result string
+	}{
+		// Another address's knocks do not interfere.
+		{ip, ":7000", 0, knockProgress},
+		{other, ":7000", time.Second, knockProgress},
+		{ip, ":8000", 2 * time.Second, knockProgress},
+		{ip, ":9000", 3 * time.Second, knockUnlocked},
+		// Wrong order.
+		{other, ":9000", 4 * time.Second, knockFailed},
+		// Knocks outside a sequence fail.
+		{other, ":8000", 5 * time.Second, knockFailed},
+		// Restarting a sequence fails the one in progress.
+		{other, ":7000", 6 * time.Second, knockProgress},
+		{other, ":7000", 7 * time.Second, knockFailed},
+		{other, ":8000", 8 * time.Second, knockProgress},
+		// Too slow.
+		{other, ":9000", 18 * time.Second, knockFailed},
+	} {
+		if got := k.Knock(step.addr, step.port, c, at(step.at)); got != step.result {
+			t.Fatalf("knock from %s on %s at %v: got %s, want %s", step.addr, step.port, step.at, got, step.result)
+		}
+	}
+
+	if !k.Unlocked(ip, at(time.Minute)) || !k.Unlocked(netip.MustParseAddr("::ffff:198.51.100.9"), at(time.Minute)) {
+		t.Fatal("address not unlocked")
+	}
+	if k.Unlocked(ip, at(3*time.Second+time.Minute)) {
+		t.Fatal("unlock did not expire")
+	}
+	if k.Unlocked(other, at(20*time.Second)) {
+		t.Fatal("address unlocked by a failed sequence")
+	}
+
+	// Sweeping drops expired unlocks and stale sequences.
+	k.Knock(ip, ":7000", c, at(10*time.Minute))
+	k.Knock(ip, ":8000", c, at(10*time.Minute))
+	if len(k.unlocked) != 0 || len(k.states) != 1 {
+		t.Fatalf("got %d unlocks and %d sequences after sweep", len(k.unlocked), len(k.states))
+	}
+}
+
+// freeAddr returns a loopback address that was free a moment ago.
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+func TestProxy_Knock(t *testing.T) {
+	ports := []string{freeAddr(t), freeAddr(t)}
+	p := startTestProxy(t, startEcho(t).Addr().String(), make(fakeSource), time.Now, func(c *Config) {
+		c.Knock.Ports = ports
+		c.Knock.FailureWeight = c.Ban.Threshold
+	})
+	defer p.Shutdown(context.Background())
+
+	echoed := func() bool {
+		conn := dialSSH(t, p)
+		defer conn.Close()
+		_, err := io.ReadFull(conn, make([]byte, 4))
+		return err == nil
+	}
+	knock := func(port string) {
+		conn, err := net.Dial("tcp", port)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+	}
+
+	if echoed() {
+		t.Fatal("connection forwarded without a knock")
+	}
+	// Each port has its own accept loop, so each knock must land before
+	// the next.
+	knock(ports[0])
+	wantMetrics(t, p.metrics, `sshproxy_knocks_total{result="progress"} 1`)
+	knock(ports[1])
+	wantMetrics(t, p.metrics, `sshproxy_knocks_total{result="unlocked"} 1`)
+	if !echoed() {
+		t.Fatal("connection rejected after the knock sequence")
+	}
+
+	// A failed sequence counts toward a ban.
+	knock(ports[1])
+	wantMetrics(t, p.metrics,
+		`sshproxy_knocks_total{result="failed"} 1`,
+		`sshproxy_bans_total{source="log"} 1`,
+	)
+	if echoed() {
+		t.Fatal("connection forwarded after a ban")
+	}
+	wantMetrics(t, p.metrics,
+		`sshproxy_connections_rejected_total{reason="knock"} 1`,
+		`sshproxy_connections_rejected_total{reason="banned"} 1`,
+	)
+}
+
+func TestProxy_KnockBehindProxy(t *testing.T) {
+	ports := []string{freeAddr(t), freeAddr(t)}
+	p := startTestProxy(t, startEcho(t).Addr().String(), make(fakeSource), time.Now, func(c *Config) {
+		c.Knock.Ports = ports
+		c.ProxyProtocol.Trusted = []string{"127.0.0.1"}
+	})
+	defer p.Shutdown(context.Background())
+
+	// Knocks relayed by a trusted proxy are the client's, not the proxy's.
+	client := netip.MustParseAddr("198.51.100.9")
+	for i, port := range ports {
+		conn, err := net.Dial("tcp", port)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, portNum, _ := net.SplitHostPort(port)
+		fmt.Fprintf(conn, "PROXY TCP4 %s 127.0.0.1 40000 %s\r\n", client, portNum)
+		conn.Close()
+		if i == 0 {
+			wantMetrics(t, p.metrics, `sshproxy_knocks_total{result="progress"} 1`)
+		}
+	}
+	wantMetrics(t, p.metrics, `sshproxy_knocks_total{result="unlocked"} 1`)
+	if !p.knocker.Unlocked(client, time.Now()) || p.knocker.Unlocked(netip.MustParseAddr("127.0.0.1"), time.Now()) {
+		t.Fatal("knocks not credited to the client in the PROXY protocol header")
+	}
+
+	// A knock without a header is dropped rather than charged to the proxy.
+	conn, err := net.Dial("tcp", ports[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	time.Sleep(50 * time.Millisecond)
+	wantMetrics(t, p.metrics, `sshproxy_knocks_total{result="failed"} 0`)
+}
+
+func TestProxy_KnockRouteBans(t *testing.T) {
+	ports := []string{freeAddr(t), freeAddr(t)}
+	p := startTestProxy(t, startEcho(t).Addr().String(), make(fakeSource), time.Now, func(c *Config) {
+		c.Routes = []RouteConfig{{Name: "two", Listen: "127.0.0.1:0", Target: startNamed(t, "two"), Bans: "route"}}
+		c.Knock.Ports = ports
+		c.Knock.Routes = []string{"two"}
+		c.Knock.FailureWeight = c.Ban.Threshold
+	})
+	defer p.Shutdown(context.Background())
+	knock := func(port string) {
+		conn, err := net.Dial("tcp", port)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+	}
+
+	// A failed sequence counts toward a ban on the gated route only.
+	knock(ports[1])
+	wantMetrics(t, p.metrics,
+		`sshproxy_knocks_total{result="failed"} 1`,
+		`sshproxy_bans_total{source="log"} 1`,
+	)
+	client := netip.MustParseAddr("127.0.0.1")
+	if !p.scopes["two"].banList.IsBanned(client) || p.banList.IsBanned(client) {
+		t.Fatal("failed knock not counted in the gated route's ban list")
+	}
+
+	// Knocks are then ignored, as they could not unlock any gated route.
+	knock(ports[0])
+	time.Sleep(50 * time.Millisecond)
+	wantMetrics(t, p.metrics, `sshproxy_knocks_total{result="progress"} 0`)
+}
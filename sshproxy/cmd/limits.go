@@ -0,0 +1,148 @@
+package main
+
+import (
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// Reasons a connection is turned away by the Limiter. They are used as
+// the reason label of sshproxy_connections_rejected_total.
+const (
+	limitRateIP      = "rate_ip"
+	limitRatePrefix  = "rate_prefix"
+	limitSessionsIP  = "max_sessions_per_ip"
+	limitSessionsAll = "max_sessions"
+)
+
+// limitMessages holds the log message for each reason.
+var limitMessages = map[string]string{
+	limitRateIP:      "Rejected connection over the per-IP rate limit",
+	limitRatePrefix:  "Rejected connection over the per-prefix rate limit",
+	limitSessionsIP:  "Rejected connection over the per-IP session limit",
+	limitSessionsAll: "Rejected connection over the session limit",
+}
+
+// limitSweepInterval is how often full buckets are dropped.
+const limitSweepInterval = time.Minute
+
+// bucket is a token bucket that starts full.
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func (b *bucket) refill(rate, burst float64, now time.Time) {
+	b.tokens = min(burst, b.tokens+max(now.Sub(b.last), 0).Seconds()*rate)
+	b.last = now
+}
+
+// Limiter enforces the connection rate limits and session caps. The limits
+// are passed on every call, so they can change on reload while the buckets
+// and counts carry over.
+type Limiter struct {
+	sync.Mutex
+	ips      map[netip.Addr]*bucket
+	prefixes map[netip.Prefix]*bucket
+	sessions map[netip.Addr]int
+	total    int
+	swept    time.Time
+}
+
+func NewLimiter() *Limiter {
+	return &Limiter{
+		ips:      make(map[netip.Addr]*bucket),
+		prefixes: make(map[netip.Prefix]*bucket),
+		sessions: make(map[netip.Addr]int),
+	}
+}
+
+// Acquire admits a new connection from addr at now, or returns the reason
+// it is rejected. An admitted connection holds a session until release is
+// called. An exempt address is only subject to the global session cap.
+func (l *Limiter) Acquire(addr netip.Addr, c LimitsConfig, exempt bool, now time.Time) (release func(), reason string) {
+	addr = normalizeAddr(addr)
+	l.Lock()
+	defer l.Unlock()
+	l.sweep(c, now)
+	if c.MaxSessions > 0 && l.total >= c.MaxSessions {
+		return nil, limitSessionsAll
+	}
+	if !exempt {
+		if c.MaxSessionsPerIP > 0 && l.sessions[addr] >= c.MaxSessionsPerIP {
+			return nil, limitSessionsIP
+		}
+		if c.Rate > 0 && !take(l.ips, addr, c.Rate, c.Burst, now) {
+			return nil, limitRateIP
+		}
+		if c.PrefixRate > 0 && !take(l.prefixes, c.prefix(addr), c.PrefixRate, c.PrefixBurst, now) {
+			return nil, limitRatePrefix
+		}
+	}
+	l.total++
+	l.sessions[addr]++
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.Lock()
+			defer l.Unlock()
+			l.total--
+			if l.sessions[addr]--; l.sessions[addr] <= 0 {
+				delete(l.sessions, addr)
+			}
+		})
+	}, ""
+}
+
+// Sessions returns the number of sessions held by addr and in total.
+func (l *Limiter) Sessions(addr netip.Addr) (int, int) {
+	l.Lock()
+	defer l.Unlock()
+	return l.sessions[normalizeAddr(addr)], l.total
+}
+
+// take removes a token from the bucket for key, creating a full one if
+// needed.
+func take[K comparable](buckets map[K]*bucket, key K, rate float64, burst int, now time.Time) bool {
+	b, ok := buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(burst), last: now}
+		buckets[key] = b
+	}
+	b.refill(rate, float64(burst), now)
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// sweep drops buckets that have refilled, since a new bucket starts full
+// anyway, and those of disabled limits. It runs at most once every
+// limitSweepInterval.
+func (l *Limiter) sweep(c LimitsConfig, now time.Time) {
+	if now.Sub(l.swept) < limitSweepInterval {
+		return
+	}
+	l.swept = now
+	for addr, b := range l.ips {
+		if b.refill(c.Rate, float64(c.Burst), now); c.Rate == 0 || b.tokens >= float64(c.Burst) {
+			delete(l.ips, addr)
+		}
+	}
+	for p, b := range l.prefixes {
+		if b.refill(c.PrefixRate, float64(c.PrefixBurst), now); c.PrefixRate == 0 || b.tokens >= float64(c.PrefixBurst) {
+			delete(l.prefixes, p)
+		}
+	}
+}
+
+// prefix returns the prefix of addr that shares a rate limit.
+func (c LimitsConfig) prefix(addr netip.Addr) netip.Prefix {
+	bits := c.IPv6Prefix
+	if addr.Is4() {
+		bits = c.IPv4Prefix
+	}
+	p, _ := addr.Prefix(bits)
+	return p
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestLimiter_Rate(t *testing.T) {
+	l := NewLimiter()
+	c := LimitsConfig{Rate: 1, Burst: 2, PrefixRate: 1, PrefixBurst: 3, IPv4Prefix: 24, IPv6Prefix: 64}
+	now := time.Date(2025, time.March, 10, 12, 0, 0, 0, time.UTC)
+	a := netip.MustParseAddr("203.0.113.7")
+	b := netip.MustParseAddr("203.0.113.8")
+	other := netip.MustParseAddr("198.51.100.1")
+
+	acquire := func(addr netip.Addr, exempt bool, want string) {
+		t.Helper()
+		release, reason := l.Acquire(addr, c, exempt, now)
+		if reason != want {
+			t.Fatalf("Acquire(%v) at %v = %q, want %q", addr, now, reason, want)
+		}
+		if release != nil {
+			release()
+		}
+	}
+	acquire(a, false, "")
+	acquire(a, false, "")
+	acquire(a, false, limitRateIP)
+	// The third connection from the /24 uses up its burst.
+	acquire(b, false, "")
+	acquire(b, false, limitRatePrefix)
+	acquire(other, false, "")
+	// The allowlist is not limited.
+	acquire(a, true, "")
+
+	// Tokens come back at the configured rate.
+	now = now.Add(time.Second)
+	acquire(a, false, "")
+	acquire(a, false, limitRateIP)
+
+	// Idle buckets are dropped once they are full again.
+	now = now.Add(time.Hour)
+	acquire(other, false, "")
+	if len(l.ips) != 1 || len(l.prefixes) != 1 {
+		t.Fatalf("buckets not swept: %d ips, %d prefixes", len(l.ips), len(l.prefixes))
+	}
+}
+
+func TestLimiter_Sessions(t *testing.T) {
+	l := NewLimiter()
+	c := LimitsConfig{MaxSessionsPerIP: 2, MaxSessions: 3}
+	now := time.Now()
+	a := netip.MustParseAddr("203.0.113.7")
+	b := netip.MustParseAddr("::ffff:198.51.100.1")
+
+	r1, _ := l.Acquire(a, c, false, now)
+	r2, _ := l.Acquire(a, c, false, now)
+	if _, reason := l.Acquire(a, c, false, now); reason != limitSessionsIP {
+		t.Fatalf("third session from %v: %q", a, reason)
+	}
+	r3, _ := l.Acquire(b, c, false, now)
+	if _, reason := l.Acquire(netip.MustParseAddr("198.51.100.2"), c, true, now); reason != limitSessionsAll {
+		t.Fatalf("session over the global cap: %q", reason)
+	}
+	r1()
+	r1() // releasing twice has no effect
+	if ip, total := l.Sessions(a); ip != 1 || total != 2 {
+		t.Fatalf("Sessions = %d, %d after release", ip, total)
+	}
+	r2()
+	r3()
+	if ip, total := l.Sessions(b); ip != 0 || total != 0 || len(l.sessions) != 0 {
+		t.Fatalf("sessions left after release: %d, %d, %v", ip, total, l.sessions)
+	}
+}
+
+func TestServeConn_Limits(t *testing.T) {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	// The target holds sessions open until the test closes them.
+	sessions := make(chan net.Conn, 1)
+	go func() {
+		for {
+			conn, err := target.Accept()
+			if err != nil {
+				return
+			}
+			sessions <- conn
+		}
+	}()
+
+	cfg := &Config{Target: target.Addr().String()}
+	cfg.Limits = LimitsConfig{MaxSessionsPerIP: 1}
+	p := newTestProxy(t, *cfg)
+	metrics, limiter := p.metrics, p.limiter
+	connect := func() net.Conn {
+		client, server := net.Pipe()
+		go p.serveConn(peerConn{server, tcpAddr("203.0.113.7:40000")}, cfg, nil)
+		return client
+	}
+
+	first := connect()
+	wantMetrics(t, metrics, `sshproxy_sessions_active 1`)
+	second := connect()
+	second.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := second.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("second session not rejected: %v", err)
+	}
+	wantMetrics(t, metrics, `sshproxy_connections_rejected_total{reason="max_sessions_per_ip"} 1`)
+
+	// The session is given back when the first connection ends.
+	defer first.Close()
+	(<-sessions).Close()
+	addr := netip.MustParseAddr("203.0.113.7")
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if n, _ := limiter.Sessions(addr); n == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("session not released")
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Metrics holds the Prometheus metrics of the proxy. They are always
+// collected and served on /metrics when metrics.listen is set.
+type Metrics struct {
+	registry *prometheus.Registry
+
+	accepted           prometheus.Counter
+	rejected           *prometheus.CounterVec
+	dialFailed         prometheus.Counter
+	upstreamAuthFailed prometheus.Counter
+	sessions           prometheus.Gauge
+	bytes              *prometheus.CounterVec
+
+	bans   *prometheus.CounterVec
+	unbans *prometheus.CounterVec
+
+	logLag         *prometheus.GaugeVec
+	logReadErrors  *prometheus.CounterVec
+	logParseErrors *prometheus.CounterVec
+	logUnmapped    *prometheus.CounterVec
+	logFuture      *prometheus.CounterVec
+
+	auditErrors   prometheus.Counter
+	actions       *prometheus.CounterVec
+	exportErrors  prometheus.Counter
+	knocks        *prometheus.CounterVec
+	tarpitted     prometheus.Counter
+	tarpitFull    prometheus.Counter
+	tarpitActive  prometheus.Gauge
+	tarpitSeconds prometheus.Counter
+}
+
+// NewMetrics registers the metrics, with sshproxy_banned counting the bans
+// in banLists.
+func NewMetrics(banLists ...*BanList) *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		accepted: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "sshproxy_connections_accepted_total",
+			Help: "Client connections accepted and forwarded to the target.",
+		}),
+		rejected: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "sshproxy_connections_rejected_total",
+			Help: "Client connections closed before forwarding, by reason.",
+		}, []string{"reason"}),
+		dialFailed: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "sshproxy_upstream_dial_failures_total",
+			Help: "Connections to the target that could not be established.",
+		}),
+		upstreamAuthFailed: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "sshproxy_upstream_auth_failures_total",
+			Help: "Logins to the target that failed in terminate mode.",
+		}),
+		sessions: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "sshproxy_sessions_active",
+			Help: "Proxied sessions currently open.",
+		}),
+		bytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "sshproxy_bytes_total",
+			Help: "Bytes forwarded, by direction.",
+		}, []string{"direction"}),
+		bans: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "sshproxy_bans_total",
+			Help: "Bans made by this process, by source.",
+		}, []string{"source"}),
+		unbans: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "sshproxy_unbans_total",
+			Help: "Bans lifted by this process, by reason.",
+		}, []string{"reason"}),
+		logLag: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "sshproxy_log_lag_seconds",
+			Help: "Time between the newest entry read from a log source and when it was read.",
+		}, []string{"path"}),
+		logReadErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "sshproxy_log_read_errors_total",
+			Help: "Errors opening or reading a log source.",
+		}, []string{"path"}),
+		logParseErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "sshproxy_log_parse_errors_total",
+			Help: "Failure entries whose address could not be parsed.",
+		}, []string{"path"}),
+		logUnmapped: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "sshproxy_log_unmapped_total",
+			Help: "Failure entries for the proxy's own address that matched no upstream connection.",
+		}, []string{"path"}),
+		logFuture: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "sshproxy_log_future_total",
+			Help: "Failure entries dated more than a minute after they were read.",
+		}, []string{"path"}),
+		auditErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "sshproxy_audit_write_errors_total",
+			Help: "Session records that could not be written to the audit log.",
+		}),
+		actions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "sshproxy_actions_total",
+			Help: "Events handled by the configured actions, by action and result.",
+		}, []string{"action", "result"}),
+		exportErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "sshproxy_export_errors_total",
+			Help: "Failed updates of the ban list export files.",
+		}),
+		knocks: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "sshproxy_knocks_total",
+			Help: "Connections to the knock ports, by result.",
+		}, []string{"result"}),
+		tarpitted: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "sshproxy_tarpit_connections_total",
+			Help: "Banned connections held in the tarpit.",
+		}),
+		tarpitFull: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "sshproxy_tarpit_full_total",
+			Help: "Banned connections closed because the tarpit was full.",
+		}),
+		tarpitActive: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "sshproxy_tarpit_active",
+			Help: "Connections currently held in the tarpit.",
+		}),
+		tarpitSeconds: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "sshproxy_tarpit_seconds_total",
+			Help: "Time banned clients spent reading the tarpit banner.",
+		}),
+	}
+	// Pre-create the common series so they are exported as 0.
+	m.rejected.WithLabelValues("banned")
+	m.rejected.WithLabelValues("proxy_protocol")
+	m.rejected.WithLabelValues("untrusted_proxy_header")
+	m.rejected.WithLabelValues("not_ssh")
+	m.rejected.WithLabelValues("handshake_timeout")
+	m.rejected.WithLabelValues("closed")
+	m.rejected.WithLabelValues("auth_failed")
+	m.rejected.WithLabelValues("geoip")
+	m.rejected.WithLabelValues("knock")
+	for reason := range limitMessages {
+		m.rejected.WithLabelValues(reason)
+	}
+	m.bytes.WithLabelValues("upstream")
+	m.bytes.WithLabelValues("downstream")
+	m.bans.WithLabelValues("log")
+	m.bans.WithLabelValues("admin")
+	m.unbans.WithLabelValues("expired")
+	m.unbans.WithLabelValues("admin")
+	for result := range knockMessages {
+		m.knocks.WithLabelValues(result)
+	}
+
+	m.registry.MustRegister(
+		m.accepted, m.rejected, m.dialFailed, m.upstreamAuthFailed, m.sessions, m.bytes,
+		m.bans, m.unbans,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "sshproxy_banned",
+			Help: "Addresses and prefixes currently banned, excluding the denylist, in all ban lists.",
+		}, func() float64 {
+			n := 0
+			for _, b := range banLists {
+				n += b.Len()
+			}
+			return float64(n)
+		}),
+		m.logLag, m.logReadErrors, m.logParseErrors, m.logUnmapped, m.logFuture,
+		m.auditErrors, m.actions, m.exportErrors, m.knocks,
+		m.tarpitted, m.tarpitFull, m.tarpitActive, m.tarpitSeconds,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return m
+}
+
+// Handler serves the metrics in the Prometheus text format.
+func (m *Metrics) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{}))
+	return mux
+}
+
+// observeLag records how far behind the log at path the parser is, given
+// the time of the newest entry read.
+func (m *Metrics) observeLag(path string, newest, now time.Time) {
+	m.logLag.WithLabelValues(path).Set(max(now.Sub(newest), 0).Seconds())
+}
+
+// countingWriter adds the bytes written through it to a counter as they
+// are copied, so long sessions show up before they end, and to total if it
+// is set.
+type countingWriter struct {
+	w     io.Writer
+	c     prometheus.Counter
+	total *atomic.Int64
+}
+
+func (cw countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.c.Add(float64(n))
+	if cw.total != nil {
+		cw.total.Add(int64(n))
+	}
+	return n, err
+}
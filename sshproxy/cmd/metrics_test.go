@@ -0,0 +1,113 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+func scrape(t *testing.T, m *Metrics) string {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	m.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if rec.Code != 200 {
+		t.Fatalf("GET /metrics: status %d", rec.Code)
+	}
+	return rec.Body.String()
+}
+
+func wantMetrics(t *testing.T, m *Metrics, lines ...string) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		body := scrape(t, m)
+		missing := ""
+		for _, l := range lines {
+			if !strings.Contains(body, l+"\n") {
+				missing = l
+				break
+			}
+		}
+		if missing == "" {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("metric %q not found in:\n%s", missing, body)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestMetrics_Proxy(t *testing.T) {
+	p := newTestProxy(t, Config{})
+	m := p.metrics
+
+	// The target answers "pong" to anything and closes.
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	go func() {
+		for {
+			conn, err := target.Accept()
+			if err != nil {
+				return
+			}
+			buf := make([]byte, 4)
+			io.ReadFull(conn, buf)
+			conn.Write([]byte("pong"))
+			conn.Close()
+		}
+	}()
+
+	client, proxy := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		p.handleTCPProxy(proxy, target.Addr().String(), 0)
+		close(done)
+	}()
+	client.Write([]byte("ping"))
+	if got, _ := io.ReadAll(client); string(got) != "pong" {
+		t.Fatalf("got %q from target", got)
+	}
+	client.Close()
+	<-done
+	wantMetrics(t, m,
+		`sshproxy_bytes_total{direction="upstream"} 4`,
+		`sshproxy_bytes_total{direction="downstream"} 4`,
+		`sshproxy_sessions_active 0`,
+	)
+
+	// Nothing listens on a closed listener's port.
+	closed, _ := net.Listen("tcp", "127.0.0.1:0")
+	closed.Close()
+	client, proxy = net.Pipe()
+	p.handleTCPProxy(proxy, closed.Addr().String(), 0)
+	client.Close()
+	wantMetrics(t, m, `sshproxy_upstream_dial_failures_total 1`)
+}
+
+func TestMetrics_Bans(t *testing.T) {
+	banList := NewBanList(EscalationPolicy{Steps: []time.Duration{time.Hour}})
+	routeBans := NewBanList(EscalationPolicy{Steps: []time.Duration{time.Hour}})
+	m := NewMetrics(banList, routeBans)
+	wantMetrics(t, m,
+		`sshproxy_banned 0`,
+		`sshproxy_bans_total{source="log"} 0`,
+		`sshproxy_connections_rejected_total{reason="banned"} 0`,
+	)
+	banList.BanPrefix(netip.MustParsePrefix("10.0.0.0/8"), time.Hour)
+	banList.BanPrefix(netip.MustParsePrefix("10.0.0.1/32"), time.Nanosecond)
+	time.Sleep(time.Millisecond)
+	wantMetrics(t, m, `sshproxy_banned 2`)
+	m.unbans.WithLabelValues("expired").Add(float64(len(banList.Cleanup())))
+	wantMetrics(t, m, `sshproxy_banned 1`, `sshproxy_unbans_total{reason="expired"} 1`)
+	// Bans in the ban lists of routes count too.
+	routeBans.BanPrefix(netip.MustParsePrefix("10.0.0.1/32"), time.Hour)
+	wantMetrics(t, m, `sshproxy_banned 2`)
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// Snapshot is the ban state that survives restarts: active bans, ban
+// histories for escalation, and failures that have not left the window.
+type Snapshot struct {
+	// SeenUntil is when the logs were last read completely.
+	SeenUntil time.Time      `json:"seen_until"`
+	Bans      []BanEntry     `json:"bans"`
+	Ranges    []RangeEntry   `json:"ranges,omitempty"`
+	History   []HistoryEntry `json:"history"`
+	Failures  []FailureEntry `json:"failures"`
+	// Routes holds the state of the routes with ban lists of their own,
+	// by route name.
+	Routes map[string]*Snapshot `json:"routes,omitempty"`
+}
+
+type BanEntry struct {
+	Addr      netip.Addr `json:"addr"`
+	Until     time.Time  `json:"until"`
+	Permanent bool       `json:"permanent,omitempty"`
+}
+
+type RangeEntry struct {
+	Prefix    netip.Prefix `json:"prefix"`
+	Until     time.Time    `json:"until"`
+	Permanent bool         `json:"permanent,omitempty"`
+}
+
+type HistoryEntry struct {
+	Addr      netip.Addr `json:"addr"`
+	Count     int        `json:"count"`
+	Until     time.Time  `json:"until"`
+	Permanent bool       `json:"permanent,omitempty"`
+	Score     float64    `json:"score,omitempty"`
+}
+
+type FailureEntry struct {
+	Addr   netip.Addr `json:"addr"`
+	Time   time.Time  `json:"time"`
+	Weight float64    `json:"weight"`
+}
+
+// Persister saves and restores snapshots.
+type Persister interface {
+	// Load returns the last saved snapshot, or nil if there is none.
+	Load() (*Snapshot, error)
+	Save(*Snapshot) error
+}
+
+// newPersister returns the backend selected in cfg, or nil if persistence
+// is disabled.
+func newPersister(cfg PersistenceConfig) (Persister, error) {
+	switch cfg.Type {
+	case "":
+		return nil, nil
+	case "file":
+		return &filePersister{path: cfg.Path}, nil
+	default:
+		return nil, fmt.Errorf("unknown persistence type %q", cfg.Type)
+	}
+}
+
+// filePersister stores snapshots as a JSON file. Saves write a temporary
+// file next to it and rename it into place, so a crash never leaves a
+// partial snapshot behind.
+type filePersister struct {
+	path string
+	last []byte
+}
+
+func (p *filePersister) Load() (*Snapshot, error) {
+	data, err := os.ReadFile(p.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var s Snapshot
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, fmt.Errorf("%s: %w", p.path, err)
+	}
+	p.last = data
+	return &s, nil
+}
+
+func (p *filePersister) Save(s *Snapshot) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	// Nothing changed since the last save.
+	if bytes.Equal(data, p.last) {
+		return nil
+	}
+	if err := writeFileAtomic(p.path, data, 0o600); err != nil {
+		return err
+	}
+	p.last = data
+	return nil
+}
+
+// writeFileAtomic writes data to a temporary file in the same directory as
+// path, which is then renamed over path, so that readers never see a
+// partial file.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// snapshot adds the bans, ranges and histories in b to s. Entries are sorted so
+// that unchanged state encodes identically.
+func (b *BanList) snapshot(s *Snapshot) {
+	b.RLock()
+	defer b.RUnlock()
+	for addr, until := range b.bans {
+		s.Bans = append(s.Bans, BanEntry{Addr: addr, Until: until, Permanent: until.IsZero()})
+	}
+	for p, until := range b.ranges {
+		s.Ranges = append(s.Ranges, RangeEntry{Prefix: p, Until: until, Permanent: until.IsZero()})
+	}
+	for addr, h := range b.history {
+		s.History = append(s.History, HistoryEntry{Addr: addr, Count: h.count, Until: h.until, Permanent: h.until.IsZero(), Score: h.score})
+	}
+	sort.Slice(s.Bans, func(i, j int) bool { return s.Bans[i].Addr.Less(s.Bans[j].Addr) })
+	sort.Slice(s.Ranges, func(i, j int) bool { return s.Ranges[i].Prefix.String() < s.Ranges[j].Prefix.String() })
+	sort.Slice(s.History, func(i, j int) bool { return s.History[i].Addr.Less(s.History[j].Addr) })
+}
+
+// restore adds the unexpired bans, ranges and histories in s to b.
+func (b *BanList) restore(s *Snapshot, now time.Time) {
+	b.Lock()
+	defer b.Unlock()
+	for _, e := range s.Bans {
+		if !e.Permanent && !now.Before(e.Until) {
+			continue
+		}
+		var until time.Time
+		if !e.Permanent {
+			until = e.Until
+		}
+		b.bans[normalizeAddr(e.Addr)] = until
+	}
+	for _, e := range s.Ranges {
+		if !e.Permanent && !now.Before(e.Until) {
+			continue
+		}
+		var until time.Time
+		if !e.Permanent {
+			until = e.Until
+		}
+		b.ranges[normalizePrefix(e.Prefix)] = until
+	}
+	for _, e := range s.History {
+		h := &banHistory{count: e.Count, score: e.Score}
+		if !e.Permanent {
+			h.until = e.Until
+		}
+		if b.forgiven(h, now) {
+			continue
+		}
+		b.history[normalizeAddr(e.Addr)] = h
+	}
+}
+
+// snapshot adds the failures in d to s.
+func (d *Detector) snapshot(s *Snapshot) {
+	d.Lock()
+	defer d.Unlock()
+	s.SeenUntil = d.seen
+	for addr, fails := range d.fails {
+		for _, f := range fails {
+			s.Failures = append(s.Failures, FailureEntry{Addr: addr, Time: f.at, Weight: f.weight})
+		}
+	}
+	sort.SliceStable(s.Failures, func(i, j int) bool {
+		a, b := s.Failures[i], s.Failures[j]
+		if a.Addr != b.Addr {
+			return a.Addr.Less(b.Addr)
+		}
+		return a.Time.Before(b.Time)
+	})
+}
+
+// restore records the failures in s that are still within the window and
+// skips log entries that were already read before the snapshot was taken.
+func (d *Detector) restore(s *Snapshot, now time.Time) {
+	for _, f := range s.Failures {
+		d.Record(normalizeAddr(f.Addr), f.Time, f.Weight, now)
+	}
+	d.Lock()
+	d.seen = s.SeenUntil
+	d.replayedUntil = s.SeenUntil
+	d.Unlock()
+}
+
+// takeSnapshot captures the state of banList and detector.
+func takeSnapshot(banList *BanList, detector *Detector) *Snapshot {
+	s := &Snapshot{}
+	banList.snapshot(s)
+	detector.snapshot(s)
+	return s
+}
+
+// restoreSnapshot loads the last snapshot from p into banList and
+// detector, dropping what expired before now.
+func restoreSnapshot(p Persister, banList *BanList, detector *Detector, now time.Time) (*Snapshot, error) {
+	s, err := p.Load()
+	if err != nil || s == nil {
+		return s, err
+	}
+	banList.restore(s, now)
+	detector.restore(s, now)
+	return s, nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFilePersister_RoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	p, err := newPersister(PersistenceConfig{Type: "file", Path: filepath.Join(dir, "bans.json")})
+	if err != nil {
+		t.Fatalf("newPersister: %v", err)
+	}
+	if s, err := p.Load(); s != nil || err != nil {
+		t.Fatalf("Load of missing file = %v, %v", s, err)
+	}
+
+	now := time.Now()
+	policy := EscalationPolicy{Steps: []time.Duration{time.Hour, permanentBan}, ForgiveAfter: 24 * time.Hour}
+	banList := NewBanList(policy)
+	detector := NewDetector(10 * time.Minute)
+	temp := netip.MustParseAddr("10.0.0.1")
+	perm := netip.MustParseAddr("2001:db8::1")
+	expired := netip.MustParseAddr("10.0.0.3")
+	banList.Escalate(temp, 5)
+	banList.Escalate(perm, 5)
+	banList.Escalate(perm, 5)
+	banList.Ban(expired, time.Hour)
+	banList.bans[expired] = now.Add(-time.Minute)
+	banList.BanPrefix(netip.MustParsePrefix("203.0.113.0/24"), permanentBan)
+	detector.Record(netip.MustParseAddr("10.0.0.4"), now.Add(-time.Minute), 1, now)
+	detector.Record(netip.MustParseAddr("10.0.0.4"), now.Add(-20*time.Minute), 1, now)
+	detector.MarkSeen(now)
+
+	if err := p.Save(takeSnapshot(banList, detector)); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 {
+		t.Fatalf("expected only the snapshot file, got %v", entries)
+	}
+
+	restoredBans := NewBanList(policy)
+	restoredDetector := NewDetector(10 * time.Minute)
+	s, err := restoreSnapshot(&filePersister{path: filepath.Join(dir, "bans.json")}, restoredBans, restoredDetector, now)
+	if err != nil || s == nil {
+		t.Fatalf("restoreSnapshot = %v, %v", s, err)
+	}
+	if !restoredBans.IsBanned(temp) || !restoredBans.IsBanned(perm) {
+		t.Fatal("active bans not restored")
+	}
+	if !restoredBans.bans[perm].IsZero() {
+		t.Fatal("permanent ban restored with an expiry")
+	}
+	if restoredBans.IsBanned(expired) {
+		t.Fatal("expired ban restored")
+	}
+	if !restoredBans.IsBanned(netip.MustParseAddr("203.0.113.7")) {
+		t.Fatal("range ban not restored")
+	}
+	if h := restoredBans.history[temp]; h == nil || h.count != 1 || h.score != 5 {
+		t.Fatalf("history not restored: %+v", h)
+	}
+	if d, count := restoredBans.Escalate(temp, 5); d != permanentBan || count != 2 {
+		t.Fatalf("escalation after restore got %v (count %d)", d, count)
+	}
+	if score := restoredDetector.Scores(now)[netip.MustParseAddr("10.0.0.4")]; score != 1 {
+		t.Fatalf("restored failure score %v, want 1", score)
+	}
+
+	// Reading the log again after the restart must not count the same
+	// failure twice, while newer entries still count.
+	restoredDetector.Record(netip.MustParseAddr("10.0.0.4"), now.Add(-time.Minute), 1, now)
+	restoredDetector.Record(netip.MustParseAddr("10.0.0.4"), now.Add(time.Second), 1, now)
+	if score := restoredDetector.Scores(now)[netip.MustParseAddr("10.0.0.4")]; score != 2 {
+		t.Fatalf("score after replay %v, want 2", score)
+	}
+}
+
+func TestFilePersister_SkipsUnchanged(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bans.json")
+	p := &filePersister{path: path}
+	s := &Snapshot{Bans: []BanEntry{{Addr: netip.MustParseAddr("10.0.0.1"), Until: time.Now().Add(time.Hour)}}}
+	if err := p.Save(s); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	old := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(path, old, old); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Save(s); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.ModTime().Equal(old) {
+		t.Fatal("unchanged snapshot was rewritten")
+	}
+}
+
+func TestNewPersister_Unknown(t *testing.T) {
+	if p, err := newPersister(PersistenceConfig{}); p != nil || err != nil {
+		t.Fatalf("disabled persistence = %v, %v", p, err)
+	}
+	if _, err := newPersister(PersistenceConfig{Type: "s3"}); err == nil {
+		t.Fatal("expected error for unknown type")
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// portMapSlack absorbs the difference between the proxy's clock and the
+// whole-second timestamps of classic syslog lines.
+const portMapSlack = 2 * time.Second
+
+// portSession is one upstream connection made from a local address.
+type portSession struct {
+	client     netip.Addr
+	start, end time.Time // end is zero while the session is open
+}
+
+// PortMap remembers which client each upstream connection was made for,
+// keyed by the connection's local address and port. When the target
+// cannot be told the client address, its log names the proxy's address
+// and port instead, and PortMap turns that back into the client.
+type PortMap struct {
+	sync.Mutex
+	sessions map[netip.AddrPort][]portSession
+	// locals holds every local address upstream connections were made
+	// from.
+	locals map[netip.Addr]struct{}
+}
+
+func NewPortMap() *PortMap {
+	return &PortMap{
+		sessions: make(map[netip.AddrPort][]portSession),
+		locals:   make(map[netip.Addr]struct{}),
+	}
+}
+
+func normalizeAddrPort(ap netip.AddrPort) netip.AddrPort {
+	return netip.AddrPortFrom(normalizeAddr(ap.Addr()), ap.Port())
+}
+
+// Open records that an upstream connection from local was made for client
+// at t. The returned function marks it closed.
+func (m *PortMap) Open(local netip.AddrPort, client netip.Addr, t time.Time) (closeFn func(time.Time)) {
+	local = normalizeAddrPort(local)
+	m.Lock()
+	defer m.Unlock()
+	m.locals[local.Addr()] = struct{}{}
+	m.sessions[local] = append(m.sessions[local], portSession{client: normalizeAddr(client), start: t})
+	return func(end time.Time) {
+		m.Lock()
+		defer m.Unlock()
+		list := m.sessions[local]
+		for i := len(list) - 1; i >= 0; i-- {
+			if list[i].start.Equal(t) && list[i].end.IsZero() {
+				list[i].end = end
+				return
+			}
+		}
+	}
+}
+
+// IsLocal reports whether upstream connections were made from addr.
+func (m *PortMap) IsLocal(addr netip.Addr) bool {
+	m.Lock()
+	defer m.Unlock()
+	_, ok := m.locals[normalizeAddr(addr)]
+	return ok
+}
+
+// Lookup returns the client of the upstream connection from local that
+// was open at t. A zero t matches the latest connection. Since local ports
+// are reused, the time picks the right one of several connections.
+func (m *PortMap) Lookup(local netip.AddrPort, t time.Time) (netip.Addr, bool) {
+	m.Lock()
+	defer m.Unlock()
+	list := m.sessions[normalizeAddrPort(local)]
+	for i := len(list) - 1; i >= 0; i-- {
+		s := list[i]
+		if t.IsZero() {
+			return s.client, true
+		}
+		if t.Before(s.start.Add(-portMapSlack)) {
+			continue
+		}
+		if s.end.IsZero() || !t.After(s.end.Add(portMapSlack)) {
+			return s.client, true
+		}
+	}
+	return netip.Addr{}, false
+}
+
+// Cleanup forgets connections that closed more than retention ago.
+func (m *PortMap) Cleanup(now time.Time, retention time.Duration) {
+	m.Lock()
+	defer m.Unlock()
+	for local, list := range m.sessions {
+		kept := list[:0]
+		for _, s := range list {
+			if s.end.IsZero() || now.Sub(s.end) <= retention {
+				kept = append(kept, s)
+			}
+		}
+		if len(kept) == 0 {
+			delete(m.sessions, local)
+		} else {
+			m.sessions[local] = kept
+		}
+	}
+}
+
+// logPort returns the port sshd logged after addr, as in
+// "from 127.0.0.1 port 40512".
+func logPort(line, addr string) (uint16, bool) {
+	_, rest, ok := strings.Cut(line, addr+" port ")
+	if !ok {
+		return 0, false
+	}
+	end := strings.IndexFunc(rest, func(r rune) bool { return r < '0' || r > '9' })
+	if end >= 0 {
+		rest = rest[:end]
+	}
+	port, err := strconv.ParseUint(rest, 10, 16)
+	if err != nil {
+		return 0, false
+	}
+	return uint16(port), true
+}
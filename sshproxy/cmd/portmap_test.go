@@ -0,0 +1,118 @@
+package main
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestPortMap_Lookup(t *testing.T) {
+	m := NewPortMap()
+	local := netip.MustParseAddrPort("127.0.0.1:40512")
+	first := netip.MustParseAddr("203.0.113.7")
+	second := netip.MustParseAddr("198.51.100.9")
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	closeFirst := m.Open(local, first, start)
+	closeFirst(start.Add(time.Minute))
+	// The port is reused for another client later on.
+	m.Open(local, second, start.Add(10*time.Minute))
+
+	tests := []struct {
+		t    time.Time
+		want netip.Addr
+		ok   bool
+	}{
+		{start.Add(30 * time.Second), first, true},
+		// Whole-second timestamps may fall just outside the session.
+		{start.Add(-time.Second), first, true},
+		{start.Add(time.Minute + time.Second), first, true},
+		{start.Add(5 * time.Minute), netip.Addr{}, false},
+		{start.Add(20 * time.Minute), second, true},
+		{time.Time{}, second, true},
+	}
+	for _, tt := range tests {
+		got, ok := m.Lookup(local, tt.t)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("Lookup at %v = %v, %v, want %v, %v", tt.t, got, ok, tt.want, tt.ok)
+		}
+	}
+	if _, ok := m.Lookup(netip.MustParseAddrPort("127.0.0.1:40513"), start); ok {
+		t.Error("unknown port mapped to a client")
+	}
+	if !m.IsLocal(netip.MustParseAddr("::ffff:127.0.0.1")) || m.IsLocal(first) {
+		t.Error("IsLocal does not match the recorded local address")
+	}
+
+	// Closed sessions are forgotten after the retention, open ones kept.
+	m.Cleanup(start.Add(time.Hour), 30*time.Minute)
+	if _, ok := m.Lookup(local, start.Add(30*time.Second)); ok {
+		t.Error("expired session still mapped")
+	}
+	if got, ok := m.Lookup(local, start.Add(time.Hour)); !ok || got != second {
+		t.Errorf("open session lost in cleanup: %v, %v", got, ok)
+	}
+}
+
+func TestLogPort(t *testing.T) {
+	tests := []struct {
+		line, addr string
+		port       uint16
+		ok         bool
+	}{
+		{"Failed password for root from 127.0.0.1 port 40512 ssh2", "127.0.0.1", 40512, true},
+		{"Connection closed by 127.0.0.1 port 40512 [preauth]", "127.0.0.1", 40512, true},
+		{"Did not receive identification string from ::1 port 22", "::1", 22, true},
+		{"authentication failure; rhost=127.0.0.1  user=root", "127.0.0.1", 0, false},
+		{"Failed password for root from 127.0.0.1 port 99999 ssh2", "127.0.0.1", 0, false},
+	}
+	for _, tt := range tests {
+		port, ok := logPort(tt.line, tt.addr)
+		if port != tt.port || ok != tt.ok {
+			t.Errorf("logPort(%q) = %d, %v, want %d, %v", tt.line, port, ok, tt.port, tt.ok)
+		}
+	}
+}
+
+func TestHandleTCPProxy_PortMap(t *testing.T) {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	upstream := make(chan net.Conn, 1)
+	go func() {
+		conn, err := target.Accept()
+		if err != nil {
+			return
+		}
+		upstream <- conn
+	}()
+
+	client, proxy := net.Pipe()
+	defer client.Close()
+	p := newTestProxy(t, Config{})
+	ports := p.ports
+	peer := tcpAddr("203.0.113.7:51234")
+	go p.handleTCPProxy(peerConn{proxy, peer}, target.Addr().String(), 0)
+
+	var conn net.Conn
+	select {
+	case conn = <-upstream:
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection not forwarded")
+	}
+	defer conn.Close()
+	// The target sees the proxy's address and port, as sshd would log it.
+	seen := netip.MustParseAddrPort(conn.RemoteAddr().String())
+	// The proxy records the connection just after it is established.
+	for deadline := time.Now().Add(5 * time.Second); !ports.IsLocal(seen.Addr()); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("%v not recorded as local", seen.Addr())
+		}
+	}
+	if got, ok := ports.Lookup(seen, time.Now()); !ok || got != netip.MustParseAddr("203.0.113.7") {
+		t.Fatalf("Lookup(%v) = %v, %v", seen, got, ok)
+	}
+}
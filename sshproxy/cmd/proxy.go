@@ -0,0 +1,953 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"reflect"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Proxy is a running sshproxy: the listeners forwarding clients to their
+// targets, the log parser banning them, and the optional admin and metrics
+// servers. Set the exported fields before calling Start.
+type Proxy struct {
+	// Logger receives the proxy's logs. Nil means slog.Default().
+	Logger *slog.Logger
+	// Now returns the current time. Nil means time.Now.
+	Now func() time.Time
+	// OpenLogSource opens a configured log source. Nil opens the file,
+	// stream or journal it names.
+	OpenLogSource func(LogSourceConfig) (LogSource, error)
+
+	cfg atomic.Pointer[Config]
+	// banList, detector and failures make up the shared ban scope.
+	banList  *BanList
+	detector *Detector
+	failures *FailureQueue
+	// scopes holds the shared ban scope and those of routes with their own
+	// ban list, by name.
+	scopes  map[string]*banScope
+	limiter *Limiter
+	knocker *Knocker
+	tarpits *Tarpit
+	geo     *GeoIP
+	ports   *PortMap
+	tallies *Tallies
+	metrics *Metrics
+	// reload starts a pass of the log parser early. failed does the same
+	// for the failure queues, at most every failurePassGap.
+	reload chan struct{}
+	failed chan struct{}
+
+	persister Persister
+	store     BanStore
+	audit     *AuditLog
+	actions   *Actions
+	exporter  *Exporter
+	routes    []*route
+	knocks    []knockListener
+	servers   []*http.Server
+	// stop ends the background goroutines, which background tracks.
+	stop       context.CancelFunc
+	background sync.WaitGroup
+
+	// sessions tracks the connections being served, conns holds them so
+	// that Shutdown can close those left at its deadline.
+	sessions sync.WaitGroup
+	connsMu  sync.Mutex
+	conns    map[net.Conn]struct{}
+	// forced is set once Shutdown closes the remaining sessions.
+	forced atomic.Bool
+}
+
+// NewProxy returns a proxy for cfg, which must be valid. Nothing is
+// started until Start.
+func NewProxy(cfg Config) *Proxy {
+	policy, _ := cfg.Escalation()
+	p := &Proxy{
+		banList:  NewBanList(policy),
+		detector: NewDetector(cfg.Ban.Window),
+		limiter:  NewLimiter(),
+		knocker:  NewKnocker(),
+		tarpits:  NewTarpit(),
+		geo:      NewGeoIP(),
+		exporter: NewExporter(),
+		ports:    NewPortMap(),
+		tallies:  &Tallies{},
+		reload:   make(chan struct{}, 1),
+		failed:   make(chan struct{}, 1),
+		conns:    make(map[net.Conn]struct{}),
+	}
+	p.cfg.Store(&cfg)
+	p.failures = NewFailureQueue(p.failed)
+	p.scopes = map[string]*banScope{"": {banList: p.banList, detector: p.detector, failures: p.failures, tallies: p.tallies}}
+	for _, r := range cfg.AllRoutes() {
+		if r.Bans == "route" {
+			p.scopes[r.Name] = &banScope{
+				name:     r.Name,
+				banList:  NewBanList(policy),
+				detector: NewDetector(cfg.Ban.Window),
+				failures: NewFailureQueue(p.failed),
+				tallies:  &Tallies{},
+			}
+		}
+	}
+	banLists := make([]*BanList, 0, len(p.scopes))
+	for _, s := range p.scopes {
+		s.banList.SetPrefixes(cfg.Prefixes())
+		banLists = append(banLists, s.banList)
+	}
+	p.metrics = NewMetrics(banLists...)
+	return p
+}
+
+// Start restores saved bans, connects to the store, opens the listeners
+// and starts serving in the background. ctx bounds the startup only. On
+// error, everything opened so far is closed again.
+func (p *Proxy) Start(ctx context.Context) (err error) {
+	if p.Logger == nil {
+		p.Logger = slog.Default()
+	}
+	if p.Now == nil {
+		p.Now = time.Now
+	}
+	if p.OpenLogSource == nil {
+		p.OpenLogSource = LogSourceConfig.open
+	}
+	for _, s := range p.scopes {
+		s.banList.SetClock(p.Now)
+	}
+	cfg := p.cfg.Load()
+	defer func() {
+		if err != nil {
+			p.closeListeners()
+			if p.store != nil {
+				p.store.Close()
+			}
+			if p.audit != nil {
+				p.audit.Close()
+			}
+			if p.actions != nil {
+				p.actions.Close(ctx)
+			}
+		}
+	}()
+
+	if p.persister, err = newPersister(cfg.Persistence); err != nil {
+		return fmt.Errorf("persistence: %w", err)
+	}
+	if p.persister != nil {
+		s, err := restoreSnapshot(p.persister, p.banList, p.detector, p.Now())
+		if err != nil {
+			return fmt.Errorf("restoring ban state: %w", err)
+		}
+		if s != nil {
+			p.restoreRoutes(s, p.Now())
+			p.Logger.Info("Restored ban state", "bans", len(s.Bans), "failures", len(s.Failures), "routes", len(s.Routes))
+		}
+	}
+	loaded, err := p.geo.Load(cfg.GeoIP.Databases)
+	if err != nil {
+		return fmt.Errorf("geoip: %w", err)
+	}
+	p.logGeoIP(loaded)
+	if cfg.Audit.Path != "" {
+		if p.audit, err = OpenAuditLog(cfg.Audit.Path, int64(cfg.Audit.MaxSizeMB)<<20, cfg.Audit.MaxBackups); err != nil {
+			return fmt.Errorf("audit: %w", err)
+		}
+	}
+	if p.actions, err = NewActions(cfg.Actions, p.Logger, p.metrics); err != nil {
+		return fmt.Errorf("actions: %w", err)
+	}
+	if p.store, err = newBanStore(cfg.Store, p.Now); err != nil {
+		return fmt.Errorf("store: %w", err)
+	}
+	if p.store != nil {
+		p.banList.SetStore(p.store)
+		syncCtx, cancel := context.WithTimeout(ctx, cfg.Store.SyncInterval)
+		if err := p.banList.Sync(syncCtx); err != nil {
+			p.Logger.Error("Failed to sync bans with store", "error", err)
+		}
+		cancel()
+	}
+
+	if cfg.Metrics.Listen != "" {
+		ln, err := net.Listen("tcp", cfg.Metrics.Listen)
+		if err != nil {
+			return fmt.Errorf("metrics: %w", err)
+		}
+		p.serve(ln, p.metrics.Handler())
+		p.Logger.Info("Metrics listening", "metrics_addr", cfg.Metrics.Listen)
+	}
+	if cfg.Admin.Listen != "" {
+		ln, err := listenAdmin(cfg.Admin.Listen)
+		if err != nil {
+			return fmt.Errorf("admin: %w", err)
+		}
+		routes := make(map[string]*banScope)
+		for name, s := range p.scopes {
+			if name != "" {
+				routes[name] = s
+			}
+		}
+		p.serve(ln, newAdminHandler(&p.cfg, p.banList, routes, p.tallies, p.metrics, p.actions, p.Logger))
+		p.Logger.Info("Admin API listening", "admin_addr", cfg.Admin.Listen)
+	}
+	for _, rc := range cfg.AllRoutes() {
+		ln, err := net.Listen("tcp", rc.Listen)
+		if err != nil {
+			return fmt.Errorf("route %s: %w", rc.Name, err)
+		}
+		r := &route{name: rc.Name, listener: ln}
+		if rc.Bans == "route" {
+			r.scope = p.scopes[rc.Name]
+		}
+		p.routes = append(p.routes, r)
+		p.Logger.Info("TCP SSH Proxy listening", "route", rc.Name, "listen_addr", ln.Addr(), "target_addr", rc.Target)
+	}
+	if p.knocks, err = listenKnock(cfg.Knock); err != nil {
+		return fmt.Errorf("knock: %w", err)
+	}
+	if len(p.knocks) > 0 {
+		p.Logger.Info("Port knocking enabled", "ports", cfg.Knock.Ports)
+	}
+
+	p.export()
+	bg, stop := context.WithCancel(context.Background())
+	p.stop = stop
+	p.goBackground(func() { p.every(bg, cfg.Export.Interval, p.export) })
+	p.goBackground(func() { p.parseLogs(bg) })
+	if p.persister != nil {
+		p.goBackground(func() { p.every(bg, cfg.Persistence.Interval, p.save) })
+	}
+	p.goBackground(func() { p.every(bg, cfg.GeoIP.CheckInterval, p.loadGeoIP) })
+	if p.store != nil {
+		p.goBackground(func() {
+			p.every(bg, cfg.Store.SyncInterval, func() {
+				syncCtx, cancel := context.WithTimeout(bg, cfg.Store.SyncInterval)
+				defer cancel()
+				if err := p.banList.Sync(syncCtx); err != nil && bg.Err() == nil {
+					p.Logger.Error("Failed to sync bans with store", "error", err)
+				}
+			})
+		})
+	}
+	for _, r := range p.routes {
+		p.goBackground(func() { p.accept(r) })
+	}
+	for _, l := range p.knocks {
+		p.goBackground(func() { p.acceptKnocks(l) })
+	}
+	return nil
+}
+
+// Addr returns the address the first route listens on, once started.
+func (p *Proxy) Addr() net.Addr {
+	return p.routes[0].listener.Addr()
+}
+
+// Addrs returns the address of each route, by name, once started.
+func (p *Proxy) Addrs() map[string]net.Addr {
+	addrs := make(map[string]net.Addr, len(p.routes))
+	for _, r := range p.routes {
+		addrs[r.name] = r.listener.Addr()
+	}
+	return addrs
+}
+
+// Shutdown stops a started proxy. It stops accepting connections, stops
+// the log parser and waits for the sessions in flight to end. Sessions
+// still open when ctx is done are closed, and ctx's error is returned. The
+// ban state is saved last. Shutdown does nothing if Start was not called
+// or failed.
+func (p *Proxy) Shutdown(ctx context.Context) error {
+	if p.stop == nil {
+		return nil
+	}
+	for _, r := range p.routes {
+		r.listener.Close()
+	}
+	for _, l := range p.knocks {
+		l.Close()
+	}
+	p.tarpits.Close()
+	for _, srv := range p.servers {
+		srv.Shutdown(ctx)
+	}
+	p.stop()
+	p.background.Wait()
+	// No more bans are made or lifted, so the actions can finish.
+	p.actions.Close(ctx)
+
+	drained := make(chan struct{})
+	go func() {
+		p.sessions.Wait()
+		close(drained)
+	}()
+	var err error
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		err = ctx.Err()
+		p.forced.Store(true)
+		p.connsMu.Lock()
+		p.Logger.Warn("Closing sessions still open at the shutdown deadline", "sessions", len(p.conns))
+		for conn := range p.conns {
+			conn.Close()
+		}
+		p.connsMu.Unlock()
+		<-drained
+	}
+	p.save()
+	if p.store != nil {
+		p.store.Close()
+	}
+	if p.audit != nil {
+		p.audit.Close()
+	}
+	return err
+}
+
+// Reload replaces the configuration with next without closing the
+// listener or clearing bans. Settings that need a restart keep their
+// current value.
+func (p *Proxy) Reload(next Config) error {
+	old := p.cfg.Load()
+	if next.Listen != old.Listen {
+		p.Logger.Warn("Changing the listen address requires a restart", "listen_addr", old.Listen)
+		next.Listen = old.Listen
+	}
+	if !sameRoutes(old.AllRoutes(), next.AllRoutes()) {
+		p.Logger.Warn("Adding or removing routes, or changing their listen address or bans, requires a restart")
+		next.Routes = old.Routes
+	}
+	if !slices.Equal(next.Knock.Ports, old.Knock.Ports) {
+		p.Logger.Warn("Changing the knock ports requires a restart", "ports", old.Knock.Ports)
+		next.Knock.Ports = old.Knock.Ports
+	}
+	if next.Admin.Listen != old.Admin.Listen {
+		p.Logger.Warn("Changing the admin listen address requires a restart", "admin_addr", old.Admin.Listen)
+		next.Admin.Listen = old.Admin.Listen
+	}
+	// Restoring settings can make next invalid, e.g. the token
+	// requirement depends on the admin address.
+	if err := next.Validate(); err != nil {
+		return err
+	}
+	if next.Metrics.Listen != old.Metrics.Listen {
+		p.Logger.Warn("Changing the metrics listen address requires a restart", "metrics_addr", old.Metrics.Listen)
+		next.Metrics.Listen = old.Metrics.Listen
+	}
+	if !reflect.DeepEqual(next.Actions, old.Actions) {
+		p.Logger.Warn("Changing actions requires a restart")
+		next.Actions = old.Actions
+	}
+	if next.Audit != old.Audit {
+		p.Logger.Warn("Changing the audit log requires a restart", "path", old.Audit.Path)
+		next.Audit = old.Audit
+	}
+	policy, _ := next.Escalation()
+	for _, s := range p.scopes {
+		s.banList.SetPolicy(policy)
+		s.banList.SetPrefixes(next.Prefixes())
+	}
+	p.cfg.Store(&next)
+	p.loadGeoIP()
+	select {
+	case p.reload <- struct{}{}:
+	default:
+	}
+	p.Logger.Info("Configuration reloaded", "target_addr", next.Target)
+	return nil
+}
+
+// Config returns the configuration in effect.
+func (p *Proxy) Config() Config {
+	return *p.cfg.Load()
+}
+
+// accept serves the connections to r until its listener is closed.
+func (p *Proxy) accept(r *route) {
+	for {
+		conn, err := r.listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			p.Logger.Error("Failed to accept connection", "error", err)
+			continue
+		}
+		p.connsMu.Lock()
+		p.conns[conn] = struct{}{}
+		p.connsMu.Unlock()
+		p.sessions.Add(1)
+		go func() {
+			defer func() {
+				p.connsMu.Lock()
+				delete(p.conns, conn)
+				p.connsMu.Unlock()
+				p.sessions.Done()
+			}()
+			c := *p.cfg.Load()
+			rc, _ := c.Route(r.name)
+			c.Target = rc.Target
+			p.serveConn(conn, &c, r)
+		}()
+	}
+}
+
+func (p *Proxy) serve(ln net.Listener, h http.Handler) {
+	srv := &http.Server{Handler: h, ReadHeaderTimeout: 10 * time.Second}
+	p.servers = append(p.servers, srv)
+	go srv.Serve(ln)
+}
+
+func (p *Proxy) closeListeners() {
+	for _, r := range p.routes {
+		r.listener.Close()
+	}
+	for _, l := range p.knocks {
+		l.Close()
+	}
+	for _, srv := range p.servers {
+		srv.Close()
+	}
+}
+
+func (p *Proxy) goBackground(fn func()) {
+	p.background.Add(1)
+	go func() {
+		defer p.background.Done()
+		fn()
+	}()
+}
+
+// every calls fn every interval until ctx is done.
+func (p *Proxy) every(ctx context.Context, interval time.Duration, fn func()) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			fn()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// loadGeoIP rereads the configured GeoIP databases that changed.
+func (p *Proxy) loadGeoIP() {
+	loaded, err := p.geo.Load(p.cfg.Load().GeoIP.Databases)
+	if err != nil {
+		p.Logger.Error("Failed to load GeoIP database", "error", err)
+	}
+	p.logGeoIP(loaded)
+}
+
+func (p *Proxy) logGeoIP(paths []string) {
+	for _, path := range paths {
+		p.Logger.Info("Loaded GeoIP database", "path", path)
+	}
+}
+
+// export writes the shared ban list and the denylist to the configured
+// files. Route ban lists are left out, as the kernel cannot tell routes
+// apart.
+func (p *Proxy) export() {
+	c := p.cfg.Load()
+	if !c.Export.enabled() {
+		return
+	}
+	allow, prefixes := c.Prefixes()
+	for _, ban := range p.banList.List() {
+		prefixes = append(prefixes, ban.Prefix)
+	}
+	if err := p.exporter.Export(c.Export, prefixes, allow); err != nil {
+		p.Logger.Error("Failed to export bans", "error", err)
+		p.metrics.exportErrors.Inc()
+	}
+}
+
+func (p *Proxy) save() {
+	if p.persister == nil {
+		return
+	}
+	if err := p.persister.Save(p.snapshot()); err != nil {
+		p.Logger.Error("Failed to save ban state", "error", err)
+	}
+}
+
+// serveConn checks a new client connection against the ban list and that
+// it speaks SSH, and forwards it to the target in c, terminating SSH if
+// c.Terminate is enabled. Connections over the limits in c or from
+// places its GeoIP policy denies are rejected, and admitted ones hold a
+// session in the limiter until they close. Behind a trusted proxy, the
+// client is the one named in the PROXY protocol header. Clients that
+// fail the SSH check or authentication are counted as failures if their
+// weight is set. r is the route the connection came in on, with nil
+// meaning the default route. Every connection from a known client is
+// written to the audit log once it is closed.
+func (p *Proxy) serveConn(conn net.Conn, c *Config, r *route) {
+	logger, metrics := p.Logger, p.metrics
+	name, failures := "default", p.failures
+	var scope *banScope
+	if r != nil {
+		name, scope = r.name, r.scope
+	}
+	if scope != nil {
+		failures = scope.failures
+	}
+	clientConn, err := acceptProxyProtocol(conn, c.TrustedProxies())
+	if errors.Is(err, errProxyLocal) {
+		conn.Close()
+		return
+	}
+	if err != nil {
+		logger.Warn("Rejected connection from trusted proxy", "proxy", conn.RemoteAddr(), "error", err)
+		metrics.rejected.WithLabelValues("proxy_protocol").Inc()
+		conn.Close()
+		return
+	}
+	remote, err := netip.ParseAddrPort(clientConn.RemoteAddr().String())
+	if err != nil {
+		logger.Error("Failed to parse remote address", "error", err)
+		clientConn.Close()
+		return
+	}
+	remoteAddr := normalizeAddr(remote.Addr())
+	rec := AuditRecord{Route: name, ClientIP: remoteAddr, ClientPort: remote.Port(), Upstream: c.Target, Start: p.Now()}
+	var res sessionResult
+	defer func() { p.writeAudit(rec, res) }()
+	if p.banned(remoteAddr, scope) {
+		logger.Warn("Rejected banned IP", "ip", remoteAddr)
+		metrics.rejected.WithLabelValues("banned").Inc()
+		// The tarpit writes to conn, whose socket buffers it can shrink.
+		// Anything the client sent after a PROXY header is ignored anyway.
+		p.tarpit(conn, remoteAddr, c.Tarpit)
+		clientConn.Close()
+		res = sessionResult{ended: endRejected, reason: "banned"}
+		return
+	}
+	// Like the limits, the knock gate and the GeoIP policy do not apply
+	// to the allowlist.
+	allowed := p.banList.Allowed(remoteAddr)
+	if c.Knock.gates(name) && !allowed && !p.knocker.Unlocked(remoteAddr, p.Now()) {
+		logger.Info("Rejected connection without port knock", "ip", remoteAddr)
+		metrics.rejected.WithLabelValues("knock").Inc()
+		clientConn.Close()
+		res = sessionResult{ended: endRejected, reason: "knock"}
+		return
+	}
+	if !allowed {
+		info, found := p.geo.Lookup(remoteAddr)
+		if rule := c.GeoIP.reject(info, found); rule != "" {
+			logger.Info("Rejected connection by GeoIP policy", "ip", remoteAddr, "rule", rule, "country", info.Country, "asn", info.ASN, "org", info.Org)
+			metrics.rejected.WithLabelValues("geoip").Inc()
+			clientConn.Close()
+			res = sessionResult{ended: endRejected, reason: "geoip"}
+			return
+		}
+	}
+	// The allowlist is exempt from the per-client limits.
+	release, reason := p.limiter.Acquire(remoteAddr, c.Limits, allowed, p.Now())
+	if reason != "" {
+		logger.Info(limitMessages[reason], "ip", remoteAddr)
+		metrics.rejected.WithLabelValues(reason).Inc()
+		clientConn.Close()
+		res = sessionResult{ended: endRejected, reason: reason}
+		return
+	}
+	defer release()
+	if c.Handshake.Timeout > 0 {
+		conn, ident, err := readIdent(clientConn, c.Handshake.Timeout)
+		if err != nil {
+			res = sessionResult{ended: endRejected, reason: p.rejectHandshake(remoteAddr, err, c.Handshake.ProbeWeight, failures)}
+			if res.reason == "" {
+				res = sessionResult{ended: endClientError, err: err}
+			}
+			clientConn.Close()
+			return
+		}
+		rec.Software = identSoftware(ident)
+		logger.Info("Accepted SSH client", "ip", remoteAddr, "client", rec.Software)
+		clientConn = conn
+	}
+	metrics.accepted.Inc()
+	version, _ := proxyProtocolVersion(c.ProxyProtocol.Upstream)
+	if c.Terminate.Enabled {
+		res = p.terminateSSH(clientConn, c, remoteAddr, version, failures)
+		return
+	}
+	res = p.handleTCPProxy(clientConn, c.Target, version)
+}
+
+// writeAudit completes rec with res and writes it to the audit log, if
+// enabled.
+func (p *Proxy) writeAudit(rec AuditRecord, res sessionResult) {
+	if p.audit == nil {
+		return
+	}
+	rec.End = p.Now()
+	rec.Duration = rec.End.Sub(rec.Start).Seconds()
+	rec.Ended, rec.Reason = res.ended, res.reason
+	rec.BytesUpstream, rec.BytesDownstream = res.upstream, res.downstream
+	rec.User, rec.Fingerprint = res.user, res.fingerprint
+	if res.err != nil {
+		rec.Error = res.err.Error()
+	}
+	if err := p.audit.Write(rec); err != nil {
+		p.Logger.Error("Failed to write audit log", "error", err)
+		p.metrics.auditErrors.Inc()
+	}
+}
+
+// rejectHandshake logs why a client failed the SSH check and counts it.
+// Clients that sent something else or nothing in time are probes, and are
+// added to failures. It returns the reason the client was rejected for,
+// or "" if the connection failed.
+func (p *Proxy) rejectHandshake(ip netip.Addr, err error, probeWeight float64, failures *FailureQueue) string {
+	logger, metrics := p.Logger, p.metrics
+	var netErr net.Error
+	var reason string
+	switch {
+	case errors.Is(err, errUntrustedProxyHeader):
+		logger.Warn("Rejected PROXY protocol header from untrusted source", "ip", ip)
+		metrics.rejected.WithLabelValues("untrusted_proxy_header").Inc()
+		return "untrusted_proxy_header"
+	case errors.Is(err, errNoIdent):
+		logger.Debug("Client closed before identification", "ip", ip)
+		metrics.rejected.WithLabelValues("closed").Inc()
+		return "closed"
+	case errors.Is(err, errNotSSH):
+		reason = "not_ssh"
+		logger.Info("Rejected non-SSH client", "ip", ip)
+	case errors.As(err, &netErr) && netErr.Timeout():
+		reason = "handshake_timeout"
+		logger.Info("Rejected client without identification", "ip", ip)
+	default:
+		logger.Debug("Failed to read client identification", "ip", ip, "error", err)
+		return ""
+	}
+	metrics.rejected.WithLabelValues(reason).Inc()
+	if probeWeight > 0 && !failures.Add(FailureEntry{Addr: ip, Time: p.Now(), Weight: probeWeight}) {
+		logger.Debug("Failure queue full, not counting probe", "ip", ip)
+	}
+	return reason
+}
+
+// failurePassGap is the shortest time between the starts of two passes
+// of the log parser when the second is started by a queued failure.
+const failurePassGap = time.Second
+
+// sourceKey identifies an open log source by the ban scope it feeds and
+// its settings.
+type sourceKey struct {
+	scope string
+	LogSourceConfig
+}
+
+// parseLogs feeds failures from the configured log sources and the proxy
+// itself into the ban lists, and publishes the scores of each pass to the
+// tallies and its progress to the metrics. Failures logged for the local
+// end of an upstream connection are attributed to its client through the
+// port map. It picks up the current configuration at the start of every
+// pass, and starts a pass early when reload fires, or when failures are
+// queued, at most every failurePassGap. Sources whose settings did not
+// change keep their read position across reloads. It returns once ctx is
+// done.
+func (p *Proxy) parseLogs(ctx context.Context) {
+	logger, metrics := p.Logger, p.metrics
+	sources := make(map[sourceKey]LogSource)
+	defer func() {
+		for _, src := range sources {
+			src.Close()
+		}
+	}()
+	for {
+		c := p.cfg.Load()
+		scopeSources := c.ScopeLogSources()
+
+		// A source that fails to open is retried like one that fails to
+		// read.
+		opened := true
+		wanted := make(map[sourceKey]bool)
+		for scope, configs := range scopeSources {
+			for _, sc := range configs {
+				key := sourceKey{scope, sc}
+				wanted[key] = true
+				if _, ok := sources[key]; ok {
+					continue
+				}
+				src, err := p.OpenLogSource(sc)
+				if err != nil {
+					logger.Error("Failed to open log source", "path", sc.Path, "error", err)
+					metrics.logReadErrors.WithLabelValues(sc.Path).Inc()
+					opened = false
+					continue
+				}
+				sources[key] = src
+			}
+		}
+		for key, src := range sources {
+			if !wanted[key] {
+				src.Close()
+				delete(sources, key)
+			}
+		}
+
+		started := time.Now()
+		now := p.Now()
+		wait := c.Ban.ScanInterval
+		if !opened {
+			wait = c.Ban.RetryDelay
+		}
+		for name, s := range p.scopes {
+			if !p.scan(ctx, c, s, scopeSources[name], sources, now) {
+				wait = c.Ban.RetryDelay
+			}
+		}
+		// Entries older than the window no longer count, so neither do the
+		// connections they could refer to.
+		p.ports.Cleanup(now, c.Ban.Window)
+
+		select {
+		case <-time.After(wait):
+		case <-p.reload:
+		case <-p.failed:
+			// Probes or failed logins may arrive in a flood, which must not
+			// keep the parser busy polling sources and the store.
+			if d := min(wait, failurePassGap) - time.Since(started); d > 0 {
+				select {
+				case <-time.After(d):
+				case <-p.reload:
+				case <-ctx.Done():
+					return
+				}
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// scan runs a pass of the log parser for the ban scope s, reading the
+// configs among sources. It reports whether they were read without
+// errors.
+func (p *Proxy) scan(ctx context.Context, c *Config, s *banScope, configs []LogSourceConfig, sources map[sourceKey]LogSource, now time.Time) bool {
+	logger, metrics, ports := p.Logger, p.metrics, p.ports
+	banList, detector := s.banList, s.detector
+	// Only the shared ban list is kept in the store.
+	var store BanStore
+	if s.name == "" {
+		store = p.store
+	} else {
+		logger = logger.With("route", s.name)
+	}
+	rules, _ := c.Rules()
+	// Failures are kept across passes since each pass only sees new lines.
+	detector.SetWindow(c.Ban.Window)
+
+	complete, ok := true, true
+	read := make(map[LogSourceConfig]bool, len(configs))
+	var batch []FailureEntry
+	for _, sc := range configs {
+		src, open := sources[sourceKey{s.name, sc}]
+		if !open {
+			complete = false
+			continue
+		}
+		if read[sc] {
+			continue
+		}
+		read[sc] = true
+		var newest time.Time
+		future := 0
+		err := src.Poll(func(e LogEntry) {
+			if e.Time.After(newest) {
+				newest = e.Time
+			}
+			rule, match, ok := rules.Match(e.Message)
+			if !ok {
+				return
+			}
+			ip, err := parseAddr(match)
+			if err != nil {
+				logger.Debug("Ignoring failure with invalid address", "rule", rule.Name, "address", match)
+				metrics.logParseErrors.WithLabelValues(sc.Path).Inc()
+				return
+			}
+			if ports.IsLocal(ip) {
+				// The target saw the proxy rather than the client.
+				port, _ := logPort(e.Message, match)
+				client, ok := ports.Lookup(netip.AddrPortFrom(ip, port), e.Time)
+				if !ok {
+					logger.Debug("Ignoring failure from proxy without a known client", "rule", rule.Name, "address", match, "port", port)
+					metrics.logUnmapped.WithLabelValues(sc.Path).Inc()
+					return
+				}
+				ip = client
+			}
+			t := e.Time
+			if t.IsZero() {
+				logger.Debug("No timestamp in log entry, using read time", "message", e.Message)
+				t = now
+			}
+			if t.Sub(now) > maxClockSkew {
+				future++
+				return
+			}
+			logger.Debug("Matched failure", "rule", rule.Name, "ip", ip, "weight", rule.Weight, "time", t)
+			detector.Record(ip, t, rule.Weight, now)
+			batch = append(batch, FailureEntry{Addr: ip, Time: t, Weight: rule.Weight})
+		})
+		if !newest.IsZero() {
+			metrics.observeLag(sc.Path, newest, p.Now())
+		}
+		if future > 0 {
+			logger.Warn("Ignoring failures logged in the future, check the time zone of the log source", "path", sc.Path, "count", future)
+			metrics.logFuture.WithLabelValues(sc.Path).Add(float64(future))
+		}
+		if err != nil {
+			logger.Error("Failed to read log", "path", sc.Path, "error", err)
+			metrics.logReadErrors.WithLabelValues(sc.Path).Inc()
+			complete, ok = false, false
+		}
+	}
+	s.failures.Drain(func(f FailureEntry) {
+		logger.Debug("Counting failure seen by proxy", "ip", f.Addr, "weight", f.Weight, "time", f.Time)
+		detector.Record(f.Addr, f.Time, f.Weight, now)
+		batch = append(batch, f)
+	})
+	if complete {
+		detector.MarkSeen(now)
+	}
+	scores := detector.Scores(now)
+	passCtx, cancel := context.WithTimeout(ctx, c.Ban.ScanInterval)
+	defer cancel()
+	if store != nil {
+		var err error
+		if scores, err = sharedScores(passCtx, store, batch, scores, c.Ban.Window, now); err != nil {
+			logger.Error("Failed to share failures with store", "error", err)
+		}
+	}
+	banned := false
+	for ip, score := range scores {
+		logger.Debug("IP failure score", "ip", ip, "score", score)
+		if score >= c.Ban.Threshold {
+			duration, count := banList.Escalate(ip, score)
+			detector.Reset(ip)
+			delete(scores, ip)
+			if store != nil {
+				if err := store.ResetFailures(passCtx, ip); err != nil {
+					logger.Error("Failed to reset shared failures", "ip", ip, "error", err)
+				}
+			}
+			banned = banned || count > 0
+			if count > 0 {
+				metrics.bans.WithLabelValues("log").Inc()
+				info := BanInfo{Prefix: netip.PrefixFrom(ip, ip.BitLen()), Count: count, Score: score}
+				if duration != permanentBan {
+					info.Until = now.Add(duration)
+				}
+				p.actions.Notify(banEvent(eventBan, info, s.name, now))
+			}
+			if count == 0 {
+				logger.Info("Not banning allowlisted IP", "ip", ip, "score", score)
+			} else if duration == permanentBan {
+				logger.Warn("Banned IP permanently", "ip", ip, "score", score, "bans", count)
+			} else {
+				logger.Info("Banned IP", "ip", ip, "duration", duration, "score", score, "bans", count)
+			}
+		}
+	}
+	if banned {
+		if err := banList.Sync(passCtx); err != nil {
+			logger.Error("Failed to sync bans with store", "error", err)
+		}
+	}
+	s.tallies.Set(now, scores)
+	expired := banList.Cleanup()
+	metrics.unbans.WithLabelValues("expired").Add(float64(len(expired)))
+	for _, prefix := range expired {
+		p.actions.Notify(unbanEvent(eventUnban, prefix, s.name, now))
+	}
+	return ok
+}
+
+// handleTCPProxy forwards clientConn to targetAddr. If proxyVersion is not
+// 0, the target is first sent a PROXY protocol header of that version
+// carrying the client's address. The upstream connection's local address
+// is recorded in the port map for the duration of the session.
+func (p *Proxy) handleTCPProxy(clientConn net.Conn, targetAddr string, proxyVersion byte) sessionResult {
+	logger, metrics := p.Logger, p.metrics
+	defer clientConn.Close()
+
+	targetConn, err := net.Dial("tcp", targetAddr)
+	if err != nil {
+		logger.Error("Failed to connect to target", "target", targetAddr, "error", err)
+		metrics.dialFailed.Inc()
+		return sessionResult{ended: endDialFailed, err: err}
+	}
+	defer targetConn.Close()
+	local, err := netip.ParseAddrPort(targetConn.LocalAddr().String())
+	if client, cerr := netip.ParseAddrPort(clientConn.RemoteAddr().String()); err == nil && cerr == nil {
+		closed := p.ports.Open(local, client.Addr(), p.Now())
+		defer func() { closed(p.Now()) }()
+	}
+	if proxyVersion != 0 {
+		header, err := proxyHeader(proxyVersion, clientConn.RemoteAddr(), clientConn.LocalAddr())
+		if err == nil {
+			_, err = header.WriteTo(targetConn)
+		}
+		if err != nil {
+			logger.Error("Failed to send PROXY protocol header", "target", targetAddr, "error", err)
+			return sessionResult{ended: endUpstreamError, err: err}
+		}
+	}
+	metrics.sessions.Inc()
+	defer metrics.sessions.Dec()
+
+	// Bidirectional copy
+	var end endOnce
+	var reason string
+	upstream := make(chan int64, 1)
+	go func() {
+		src := &errReader{r: clientConn}
+		n, err := io.Copy(countingWriter{targetConn, metrics.bytes.WithLabelValues("upstream"), nil}, src)
+		defer func() { upstream <- n }()
+		if errors.Is(err, errUntrustedProxyHeader) {
+			logger.Warn("Rejected PROXY protocol header from untrusted source", "ip", clientConn.RemoteAddr())
+			metrics.rejected.WithLabelValues("untrusted_proxy_header").Inc()
+			reason = "untrusted_proxy_header"
+			end.set(endRejected, nil)
+			targetConn.Close()
+			return
+		}
+		end.set(p.endOf(true, err, src.err))
+		// Pass the client's EOF on, so the target ends the session and
+		// the copy below returns.
+		if tc, ok := targetConn.(*net.TCPConn); ok {
+			tc.CloseWrite()
+		}
+	}()
+	src := &errReader{r: targetConn}
+	downstream, err := io.Copy(countingWriter{clientConn, metrics.bytes.WithLabelValues("downstream"), nil}, src)
+	end.set(p.endOf(false, err, src.err))
+	clientConn.Close()
+	res := sessionResult{upstream: <-upstream, downstream: downstream}
+	res.ended, res.err = end.ended, end.err
+	if res.ended == endRejected {
+		res.reason = reason
+	}
+	return res
+}
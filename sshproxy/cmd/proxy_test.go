@@ -0,0 +1,376 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestProxy returns a proxy for cfg that is not started, for tests that
+// call its connection handlers directly.
+func newTestProxy(t *testing.T, cfg Config) *Proxy {
+	t.Helper()
+	p := NewProxy(cfg)
+	p.Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	p.Now = time.Now
+	return p
+}
+
+// fakeSource is a LogSource that yields the entries sent to it.
+type fakeSource chan LogEntry
+
+func (s fakeSource) Poll(fn func(LogEntry)) error {
+	for {
+		select {
+		case e := <-s:
+			fn(e)
+		default:
+			return nil
+		}
+	}
+}
+
+func (s fakeSource) Close() error { return nil }
+
+// countingSource is a fakeSource that counts the passes polling it.
+type countingSource struct {
+	fakeSource
+	polls *atomic.Int32
+}
+
+func (s countingSource) Poll(fn func(LogEntry)) error {
+	s.polls.Add(1)
+	return s.fakeSource.Poll(fn)
+}
+
+// startEcho runs a target that echoes everything back.
+func startEcho(t *testing.T) net.Listener {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	return ln
+}
+
+// startTestProxy starts a proxy in front of target that reads its log,
+// the source "fake", from src. The configure functions adjust the
+// configuration before the start. Log sources with other paths yield
+// nothing.
+func startTestProxy(t *testing.T, target string, src fakeSource, now func() time.Time, configure ...func(*Config)) *Proxy {
+	t.Helper()
+	cfg, err := loadConfig("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Listen, cfg.Target = "127.0.0.1:0", target
+	cfg.LogSources = []LogSourceConfig{{Path: "fake"}}
+	for _, fn := range configure {
+		fn(&cfg)
+	}
+	p := newTestProxy(t, cfg)
+	p.Now = now
+	p.OpenLogSource = func(sc LogSourceConfig) (LogSource, error) {
+		if sc.Path != "fake" {
+			return make(fakeSource), nil
+		}
+		return src, nil
+	}
+	if err := p.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// dialSSH connects to p and sends an SSH identification string.
+func dialSSH(t *testing.T, p *Proxy) net.Conn {
+	t.Helper()
+	conn, err := net.Dial("tcp", p.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.WriteString(conn, "SSH-2.0-Test\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+func TestProxy_Ban(t *testing.T) {
+	// The ban is decided and checked at the proxy's time, not the real one.
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	src := make(fakeSource, 10)
+	for i := range 5 {
+		src <- LogEntry{Time: now, Message: fmt.Sprintf("Failed password for root from 127.0.0.1 port %d ssh2", 40000+i)}
+	}
+	p := startTestProxy(t, startEcho(t).Addr().String(), src, func() time.Time { return now })
+	defer p.Shutdown(context.Background())
+
+	for deadline := time.Now().Add(5 * time.Second); !p.banList.IsBanned(netip.MustParseAddr("127.0.0.1")); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("127.0.0.1 not banned")
+		}
+	}
+	conn, err := net.Dial("tcp", p.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("banned client not rejected: %v", err)
+	}
+}
+
+func TestProxy_FutureFailures(t *testing.T) {
+	// Failures logged hours ahead, as under a wrong time zone, are not
+	// counted but show up in the metrics.
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	src := make(fakeSource, 10)
+	for i := range 5 {
+		src <- LogEntry{Time: now.Add(2 * time.Hour), Message: fmt.Sprintf("Failed password for root from 127.0.0.1 port %d ssh2", 40000+i)}
+	}
+	p := startTestProxy(t, startEcho(t).Addr().String(), src, func() time.Time { return now })
+	defer p.Shutdown(context.Background())
+
+	wantMetrics(t, p.metrics, `sshproxy_log_future_total{path="fake"} 5`)
+	if p.banList.IsBanned(netip.MustParseAddr("127.0.0.1")) {
+		t.Fatal("banned for failures logged in the future")
+	}
+}
+
+func TestProxy_FailureFlood(t *testing.T) {
+	cfg, err := loadConfig("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Listen, cfg.Target = "127.0.0.1:0", startEcho(t).Addr().String()
+	cfg.LogSources = []LogSourceConfig{{Path: "fake"}}
+	var polls atomic.Int32
+	p := newTestProxy(t, cfg)
+	p.OpenLogSource = func(LogSourceConfig) (LogSource, error) { return countingSource{make(fakeSource), &polls}, nil }
+	if err := p.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Shutdown(context.Background())
+
+	// A flood of failures starts few passes, and the failures still ban.
+	addr := netip.MustParseAddr("198.51.100.9")
+	for end := time.Now().Add(failurePassGap / 2); time.Now().Before(end); time.Sleep(time.Millisecond) {
+		p.failures.Add(FailureEntry{Addr: addr, Time: time.Now(), Weight: 1})
+	}
+	if n := polls.Load(); n > 2 {
+		t.Fatalf("%d passes during the flood", n)
+	}
+	for deadline := time.Now().Add(5 * time.Second); !p.banList.IsBanned(addr); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("flooding client not banned")
+		}
+	}
+}
+
+func TestProxy_OpenRetry(t *testing.T) {
+	cfg, err := loadConfig("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Listen, cfg.Target = "127.0.0.1:0", startEcho(t).Addr().String()
+	cfg.LogSources = []LogSourceConfig{{Path: "fake"}}
+	cfg.Ban.ScanInterval, cfg.Ban.RetryDelay = time.Hour, 10*time.Millisecond
+	var opens atomic.Int32
+	p := newTestProxy(t, cfg)
+	p.OpenLogSource = func(LogSourceConfig) (LogSource, error) {
+		if opens.Add(1) == 1 {
+			return nil, errors.New("not yet")
+		}
+		return make(fakeSource), nil
+	}
+	if err := p.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Shutdown(context.Background())
+
+	// A source that fails to open is retried after the retry delay rather
+	// than the scan interval.
+	for deadline := time.Now().Add(5 * time.Second); opens.Load() < 2; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("log source not reopened")
+		}
+	}
+}
+
+func TestProxy_Reload(t *testing.T) {
+	cfg, err := loadConfig("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Listen, cfg.Target = "127.0.0.1:0", startNamed(t, "old")
+	cfg.LogSources = []LogSourceConfig{{Path: "first"}}
+	sources := map[string]fakeSource{"first": make(fakeSource), "second": make(fakeSource, 10)}
+	p := newTestProxy(t, cfg)
+	p.OpenLogSource = func(sc LogSourceConfig) (LogSource, error) { return sources[sc.Path], nil }
+	if err := p.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Shutdown(context.Background())
+	target := func() string {
+		conn := dialSSH(t, p)
+		defer conn.Close()
+		line, err := bufio.NewReader(conn).ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.TrimSpace(line)
+	}
+	if got := target(); got != "old" {
+		t.Fatalf("forwarded to %q before the reload", got)
+	}
+
+	addr := netip.MustParseAddr("198.51.100.9")
+	// The reload starts a pass that reads the added source.
+	for i := range 5 {
+		sources["second"] <- LogEntry{Time: time.Now(), Message: fmt.Sprintf("Failed password for root from %s port %d ssh2", addr, 40000+i)}
+	}
+
+	next := cfg
+	next.Target = startNamed(t, "new")
+	next.LogSources = []LogSourceConfig{{Path: "first"}, {Path: "second"}}
+	// Settings that need a restart.
+	next.Listen = freeAddr(t)
+	next.Routes = []RouteConfig{{Listen: freeAddr(t), Target: next.Target}}
+	next.Knock.Ports = []string{freeAddr(t)}
+	next.Admin.Listen = freeAddr(t)
+	next.Metrics.Listen = freeAddr(t)
+	next.Audit.Path = filepath.Join(t.TempDir(), "audit.log")
+	if err := p.Reload(next); err != nil {
+		t.Fatal(err)
+	}
+
+	got := p.Config()
+	if got.Listen != cfg.Listen || len(got.Routes) != 0 || len(got.Knock.Ports) != 0 ||
+		got.Admin.Listen != cfg.Admin.Listen || got.Metrics.Listen != cfg.Metrics.Listen || got.Audit != cfg.Audit {
+		t.Fatalf("settings that need a restart changed: %+v", got)
+	}
+	if c, err := net.Dial("tcp", next.Listen); err == nil {
+		c.Close()
+		t.Fatal("reload opened the new listen address")
+	}
+	if got := target(); got != "new" {
+		t.Fatalf("forwarded to %q after the reload", got)
+	}
+	for deadline := time.Now().Add(5 * time.Second); !p.banList.IsBanned(addr); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("failures in the added log source not read")
+		}
+	}
+}
+
+func TestProxy_Shutdown(t *testing.T) {
+	target := startEcho(t).Addr().String()
+	echo := func(t *testing.T, conn net.Conn) {
+		t.Helper()
+		got := make([]byte, len("SSH-2.0-Test\r\n"))
+		if _, err := io.ReadFull(conn, got); err != nil {
+			t.Fatalf("session not forwarded: %v", err)
+		}
+	}
+
+	t.Run("drain", func(t *testing.T) {
+		p := startTestProxy(t, target, make(fakeSource), time.Now)
+		conn := dialSSH(t, p)
+		echo(t, conn)
+		done := make(chan error, 1)
+		go func() { done <- p.Shutdown(context.Background()) }()
+		select {
+		case err := <-done:
+			t.Fatalf("Shutdown returned %v with a session open", err)
+		case <-time.After(100 * time.Millisecond):
+		}
+		// New connections are refused while the session drains.
+		if c, err := net.Dial("tcp", p.Addr().String()); err == nil {
+			c.Close()
+			t.Fatal("connection accepted during shutdown")
+		}
+		conn.Close()
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatalf("Shutdown: %v", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Shutdown did not return after the session ended")
+		}
+	})
+
+	t.Run("deadline", func(t *testing.T) {
+		p := startTestProxy(t, target, make(fakeSource), time.Now)
+		conn := dialSSH(t, p)
+		defer conn.Close()
+		echo(t, conn)
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		if err := p.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("Shutdown = %v, want %v", err, context.DeadlineExceeded)
+		}
+		if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+			t.Fatalf("session not closed at the deadline: %v", err)
+		}
+	})
+
+	hook := func(c *Config) { c.Actions = []ActionConfig{{Name: "hook", Command: []string{"true"}}} }
+	t.Run("twice", func(t *testing.T) {
+		p := startTestProxy(t, target, make(fakeSource), time.Now, hook)
+		for range 2 {
+			if err := p.Shutdown(context.Background()); err != nil {
+				t.Fatalf("Shutdown: %v", err)
+			}
+		}
+	})
+
+	t.Run("not started", func(t *testing.T) {
+		busy, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer busy.Close()
+		cfg, err := loadConfig("", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg.Listen, cfg.Target = busy.Addr().String(), target
+		hook(&cfg)
+		p := newTestProxy(t, cfg)
+		if err := p.Shutdown(context.Background()); err != nil {
+			t.Fatalf("Shutdown before Start: %v", err)
+		}
+		if err := p.Start(context.Background()); err == nil {
+			t.Fatal("started on a busy address")
+		}
+		if err := p.Shutdown(context.Background()); err != nil {
+			t.Fatalf("Shutdown after a failed Start: %v", err)
+		}
+	})
+}
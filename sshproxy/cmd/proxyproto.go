@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/pires/go-proxyproto"
+)
+
+// proxyHeaderTimeout bounds how long a trusted proxy may take to send its
+// PROXY protocol header.
+const proxyHeaderTimeout = 5 * time.Second
+
+var (
+	// errProxyLocal is returned for a PROXY protocol LOCAL command, which a
+	// load balancer sends for its own health checks.
+	errProxyLocal = errors.New("PROXY protocol health check")
+	// errUntrustedProxyHeader is returned when a client outside the
+	// trusted prefixes sends a PROXY protocol header.
+	errUntrustedProxyHeader = errors.New("PROXY protocol header from untrusted source")
+)
+
+// acceptProxyProtocol applies the inbound PROXY protocol to a new
+// connection. Connections from a trusted prefix must start with a header,
+// and the returned connection reports the address it carries as
+// RemoteAddr. Connections from elsewhere are returned wrapped so that
+// reading a header from them fails with errUntrustedProxyHeader. With no
+// trusted prefixes, conn is returned unchanged.
+func acceptProxyProtocol(conn net.Conn, trusted []netip.Prefix) (net.Conn, error) {
+	if len(trusted) == 0 {
+		return conn, nil
+	}
+	peer, err := netip.ParseAddrPort(conn.RemoteAddr().String())
+	if err != nil {
+		return nil, err
+	}
+	r := bufio.NewReader(conn)
+	if !containsAddr(trusted, normalizeAddr(peer.Addr())) {
+		return &untrustedConn{Conn: conn, r: r}, nil
+	}
+	// A trusted proxy sends the header as soon as it connects, so waiting
+	// for it cannot hold up a client waiting for the server's banner.
+	conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	header, err := proxyproto.Read(r)
+	conn.SetReadDeadline(time.Time{})
+	if errors.Is(err, proxyproto.ErrNoProxyProtocol) {
+		return nil, errors.New("no PROXY protocol header from trusted proxy")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if header.Command.IsLocal() {
+		return nil, errProxyLocal
+	}
+	src, dst, ok := header.TCPAddrs()
+	if !ok {
+		return nil, fmt.Errorf("unsupported PROXY protocol transport %v", header.TransportProtocol)
+	}
+	return &proxiedConn{Conn: conn, r: r, remote: src, local: dst}, nil
+}
+
+// proxiedConn is a connection relayed by a trusted proxy. Its addresses
+// are the ones from the PROXY protocol header.
+type proxiedConn struct {
+	net.Conn
+	r             *bufio.Reader
+	remote, local net.Addr
+}
+
+func (c *proxiedConn) Read(p []byte) (int, error) { return c.r.Read(p) }
+func (c *proxiedConn) RemoteAddr() net.Addr       { return c.remote }
+func (c *proxiedConn) LocalAddr() net.Addr        { return c.local }
+
+// untrustedConn checks that a client outside the trusted prefixes does not
+// send a PROXY protocol header. The check happens on the first Read rather
+// than on accept, since an SSH client may wait for the server's banner
+// before sending anything.
+type untrustedConn struct {
+	net.Conn
+	r    *bufio.Reader
+	once sync.Once
+	err  error
+}
+
+func (c *untrustedConn) Read(p []byte) (int, error) {
+	c.once.Do(func() {
+		_, err := proxyproto.Read(c.r)
+		var netErr net.Error
+		switch {
+		case errors.Is(err, proxyproto.ErrNoProxyProtocol):
+		case errors.As(err, &netErr), errors.Is(err, net.ErrClosed):
+			c.err = err
+		default:
+			// Anything starting like a header counts, even if malformed.
+			c.err = errUntrustedProxyHeader
+		}
+	})
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(p)
+}
+
+// proxyProtocolVersion maps the proxy_protocol.upstream setting to a PROXY
+// protocol version, or 0 if no header is sent.
+func proxyProtocolVersion(s string) (byte, error) {
+	switch s {
+	case "":
+		return 0, nil
+	case "v1":
+		return 1, nil
+	case "v2":
+		return 2, nil
+	default:
+		return 0, fmt.Errorf("unknown PROXY protocol version %q", s)
+	}
+}
+
+// proxyHeader returns a PROXY protocol header announcing a TCP connection
+// from client to the proxy's address local. Both addresses are normalized
+// to the same family, since a dual-stack listener may report either.
+func proxyHeader(version byte, client, local net.Addr) (*proxyproto.Header, error) {
+	src, err := netip.ParseAddrPort(client.String())
+	if err != nil {
+		return nil, err
+	}
+	dst, err := netip.ParseAddrPort(local.String())
+	if err != nil {
+		return nil, err
+	}
+	src = netip.AddrPortFrom(normalizeAddr(src.Addr()), src.Port())
+	dst = netip.AddrPortFrom(normalizeAddr(dst.Addr()), dst.Port())
+	transport := proxyproto.TCPv4
+	if src.Addr().Is6() {
+		transport = proxyproto.TCPv6
+	}
+	if dst.Addr().Is4() != src.Addr().Is4() {
+		// Only the client address matters to the upstream.
+		unspecified := netip.IPv4Unspecified()
+		if src.Addr().Is6() {
+			unspecified = netip.IPv6Unspecified()
+		}
+		dst = netip.AddrPortFrom(unspecified, dst.Port())
+	}
+	return &proxyproto.Header{
+		Version:           version,
+		Command:           proxyproto.PROXY,
+		TransportProtocol: transport,
+		SourceAddr:        net.TCPAddrFromAddrPort(src),
+		DestinationAddr:   net.TCPAddrFromAddrPort(dst),
+	}, nil
+}
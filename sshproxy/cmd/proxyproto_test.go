@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pires/go-proxyproto"
+)
+
+func tcpAddr(s string) net.Addr {
+	return net.TCPAddrFromAddrPort(netip.MustParseAddrPort(s))
+}
+
+func TestProxyHeader_V1(t *testing.T) {
+	tests := []struct {
+		client, local, want string
+	}{
+		{"203.0.113.7:51234", "10.0.0.1:2244", "PROXY TCP4 203.0.113.7 10.0.0.1 51234 2244\r\n"},
+		{"[::ffff:203.0.113.7]:51234", "[::ffff:10.0.0.1]:2244", "PROXY TCP4 203.0.113.7 10.0.0.1 51234 2244\r\n"},
+		{"[2001:db8::7]:51234", "[2001:db8::1]:2244", "PROXY TCP6 2001:db8::7 2001:db8::1 51234 2244\r\n"},
+		{"203.0.113.7:51234", "[::]:2244", "PROXY TCP4 203.0.113.7 0.0.0.0 51234 2244\r\n"},
+		{"[2001:db8::7]:51234", "10.0.0.1:2244", "PROXY TCP6 2001:db8::7 :: 51234 2244\r\n"},
+	}
+	for _, tt := range tests {
+		h, err := proxyHeader(1, tcpAddr(tt.client), tcpAddr(tt.local))
+		if err != nil {
+			t.Fatalf("proxyHeader(%s, %s): %v", tt.client, tt.local, err)
+		}
+		got, err := h.Format()
+		if err != nil {
+			t.Fatalf("Format: %v", err)
+		}
+		if string(got) != tt.want {
+			t.Errorf("proxyHeader(%s, %s) = %q, want %q", tt.client, tt.local, got, tt.want)
+		}
+	}
+}
+
+func TestHandleTCPProxy_ProxyHeader(t *testing.T) {
+	for _, version := range []byte{1, 2} {
+		target, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		received := make(chan *proxyproto.Header, 1)
+		go func() {
+			conn, err := target.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			r := bufio.NewReader(conn)
+			h, err := proxyproto.Read(r)
+			if err != nil {
+				t.Errorf("v%d: reading header: %v", version, err)
+			}
+			received <- h
+			// The client's data follows the header unchanged.
+			line, _ := r.ReadString('\n')
+			conn.Write([]byte(line))
+		}()
+
+		front, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		client, err := net.Dial("tcp", front.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		proxied, err := front.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		go newTestProxy(t, Config{}).handleTCPProxy(proxied, target.Addr().String(), version)
+
+		client.Write([]byte("SSH-2.0-test\r\n"))
+		client.SetReadDeadline(time.Now().Add(5 * time.Second))
+		echo, err := bufio.NewReader(client).ReadString('\n')
+		if err != nil || echo != "SSH-2.0-test\r\n" {
+			t.Fatalf("v%d: got %q, %v after header", version, echo, err)
+		}
+		h := <-received
+		src, dst, ok := h.TCPAddrs()
+		if !ok || h.Version != version || src.String() != client.LocalAddr().String() || dst.String() != front.Addr().String() {
+			t.Fatalf("v%d: unexpected header %+v", version, h)
+		}
+		client.Close()
+		front.Close()
+		target.Close()
+	}
+}
+
+// peerConn overrides the peer address of a pipe.
+type peerConn struct {
+	net.Conn
+	peer net.Addr
+}
+
+func (c peerConn) RemoteAddr() net.Addr { return c.peer }
+
+func TestAcceptProxyProtocol(t *testing.T) {
+	trusted := []netip.Prefix{netip.MustParsePrefix("10.0.0.0/24")}
+	v2 := func(cmd proxyproto.ProtocolVersionAndCommand) string {
+		h := &proxyproto.Header{Version: 2, Command: cmd, TransportProtocol: proxyproto.TCPv6,
+			SourceAddr: tcpAddr("[2001:db8::7]:40000"), DestinationAddr: tcpAddr("[2001:db8::1]:22")}
+		if cmd == proxyproto.LOCAL {
+			h.TransportProtocol = proxyproto.UNSPEC
+		}
+		b, err := h.Format()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+	tests := []struct {
+		name    string
+		peer    string
+		trusted []netip.Prefix
+		send    string
+		remote  string // expected RemoteAddr, or the error
+		readErr error
+	}{
+		{"disabled", "203.0.113.7:1", nil, "SSH-2.0-x\r\n", "203.0.113.7:1", nil},
+		{"trusted v1", "10.0.0.5:1", trusted, "PROXY TCP4 203.0.113.7 10.0.0.1 51234 2244\r\nSSH-2.0-x\r\n", "203.0.113.7:51234", nil},
+		{"trusted v2", "10.0.0.5:1", trusted, v2(proxyproto.PROXY) + "SSH-2.0-x\r\n", "[2001:db8::7]:40000", nil},
+		{"trusted health check", "10.0.0.5:1", trusted, v2(proxyproto.LOCAL), "PROXY protocol health check", nil},
+		{"trusted without header", "10.0.0.5:1", trusted, "SSH-2.0-x\r\n", "no PROXY protocol header", nil},
+		{"trusted malformed", "10.0.0.5:1", trusted, "PROXY TCP4 nonsense\r\n", "proxyproto", nil},
+		{"untrusted", "203.0.113.7:1", trusted, "SSH-2.0-x\r\n", "203.0.113.7:1", nil},
+		{"untrusted header", "203.0.113.7:1", trusted, "PROXY TCP4 1.2.3.4 5.6.7.8 1 2\r\nSSH-2.0-x\r\n", "203.0.113.7:1", errUntrustedProxyHeader},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			go client.Write([]byte(tt.send))
+			conn, err := acceptProxyProtocol(peerConn{server, tcpAddr(tt.peer)}, tt.trusted)
+			if err != nil {
+				if tt.remote == "" || !strings.Contains(err.Error(), tt.remote) {
+					t.Fatalf("unexpected error %v", err)
+				}
+				return
+			}
+			if tt.remote == "" || conn.RemoteAddr().String() != tt.remote {
+				t.Fatalf("RemoteAddr = %v, want %q", conn.RemoteAddr(), tt.remote)
+			}
+			line, err := bufio.NewReader(conn).ReadString('\n')
+			if tt.readErr != nil {
+				if !errors.Is(err, tt.readErr) {
+					t.Fatalf("read error %v, want %v", err, tt.readErr)
+				}
+				return
+			}
+			if line != "SSH-2.0-x\r\n" || err != nil {
+				t.Fatalf("read %q, %v after header", line, err)
+			}
+		})
+	}
+}
+
+func TestServeConn_TrustedProxy(t *testing.T) {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	received := make(chan *proxyproto.Header, 1)
+	go func() {
+		for {
+			conn, err := target.Accept()
+			if err != nil {
+				return
+			}
+			h, _ := proxyproto.Read(bufio.NewReader(conn))
+			received <- h
+			conn.Close()
+		}
+	}()
+
+	cfg := &Config{Target: target.Addr().String()}
+	cfg.ProxyProtocol = ProxyProtocolConfig{Upstream: "v2", Trusted: []string{"127.0.0.1"}}
+	p := newTestProxy(t, *cfg)
+	p.banList.Ban(netip.MustParseAddr("198.51.100.9"), time.Hour)
+	metrics := p.metrics
+
+	front, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer front.Close()
+	connect := func(header string) net.Conn {
+		client, err := net.Dial("tcp", front.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn, err := front.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		client.Write([]byte(header))
+		go p.serveConn(conn, cfg, nil)
+		return client
+	}
+
+	// The ban applies to the client behind the load balancer.
+	client := connect("PROXY TCP4 198.51.100.9 10.0.0.1 40000 22\r\n")
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("banned client behind proxy not rejected: %v", err)
+	}
+	client.Close()
+
+	// Other clients are forwarded with their own address.
+	client = connect("PROXY TCP4 198.51.100.10 10.0.0.1 40000 22\r\n")
+	defer client.Close()
+	select {
+	case h := <-received:
+		if src, _, ok := h.TCPAddrs(); !ok || src.String() != "198.51.100.10:40000" {
+			t.Fatalf("upstream header %+v does not carry the real client", h)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection not forwarded")
+	}
+	wantMetrics(t, metrics, `sshproxy_connections_rejected_total{reason="banned"} 1`, `sshproxy_connections_accepted_total 1`)
+}
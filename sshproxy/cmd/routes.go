@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net"
+	"net/netip"
+	"time"
+)
+
+// route is a listener of the proxy. Its target is looked up in the
+// current configuration for every connection, so that it can change on
+// reload.
+type route struct {
+	name     string
+	listener net.Listener
+	// scope is the route's own ban list, or nil if it uses the shared one.
+	scope *banScope
+}
+
+// banScope is a ban list with the failure scores and proxy-side failures
+// feeding it. The shared scope is named "", the others after the route
+// owning them.
+type banScope struct {
+	name     string
+	banList  *BanList
+	detector *Detector
+	failures *FailureQueue
+	tallies  *Tallies
+}
+
+// banned reports whether addr is banned in the shared ban list or in the
+// route's own one.
+func (p *Proxy) banned(addr netip.Addr, scope *banScope) bool {
+	return p.banList.IsBanned(addr) || scope != nil && scope.banList.IsBanned(addr)
+}
+
+// sameRoutes reports whether a and b have the same listeners and ban
+// lists, which cannot change without a restart.
+func sameRoutes(a, b []RouteConfig) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Name != b[i].Name || a[i].Listen != b[i].Listen || (a[i].Bans == "route") != (b[i].Bans == "route") {
+			return false
+		}
+	}
+	return true
+}
+
+// snapshot returns the ban state of the shared scope, with that of each
+// route scope in Routes.
+func (p *Proxy) snapshot() *Snapshot {
+	s := takeSnapshot(p.banList, p.detector)
+	for name, scope := range p.scopes {
+		if name == "" {
+			continue
+		}
+		if s.Routes == nil {
+			s.Routes = make(map[string]*Snapshot)
+		}
+		s.Routes[name] = takeSnapshot(scope.banList, scope.detector)
+	}
+	return s
+}
+
+// restoreRoutes restores the route scopes saved in s. The state of routes
+// that no longer have a ban list of their own is dropped.
+func (p *Proxy) restoreRoutes(s *Snapshot, now time.Time) {
+	for name, rs := range s.Routes {
+		scope, ok := p.scopes[name]
+		if !ok || name == "" {
+			p.Logger.Warn("Dropping saved ban state of a route without its own ban list", "route", name)
+			continue
+		}
+		scope.banList.restore(rs, now)
+		scope.detector.restore(rs, now)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// startNamed runs a target that greets every connection with its name.
+func startNamed(t *testing.T, name string) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			io.WriteString(conn, name+"\n")
+			go func() {
+				io.Copy(io.Discard, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestProxy_Routes(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	// The route's own log is the fake source, the shared log is empty.
+	own := make(fakeSource, 10)
+	p := startTestProxy(t, "", own, func() time.Time { return now }, func(c *Config) {
+		c.Listen = ""
+		c.LogSources = []LogSourceConfig{{Path: "shared.log"}}
+		c.Routes = []RouteConfig{
+			{Name: "one", Listen: "127.0.0.1:0", Target: startNamed(t, "one")},
+			{Name: "two", Listen: "127.0.0.1:0", Target: startNamed(t, "two"), Bans: "route", LogSources: []LogSourceConfig{{Path: "fake"}}},
+		}
+	})
+	defer p.Shutdown(context.Background())
+	addrs := p.Addrs()
+	greeting := func(route string) (string, error) {
+		conn, err := net.Dial("tcp", addrs[route].String())
+		if err != nil {
+			return "", err
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		io.WriteString(conn, "SSH-2.0-Test\r\n")
+		return bufio.NewReader(conn).ReadString('\n')
+	}
+
+	// Each route forwards to its own target.
+	for _, route := range []string{"one", "two"} {
+		if got, err := greeting(route); err != nil || got != route+"\n" {
+			t.Fatalf("route %s reached %q, %v", route, got, err)
+		}
+	}
+
+	// Failures in the route's own log only ban on that route.
+	client := netip.MustParseAddr("198.51.100.9")
+	for i := range 5 {
+		own <- LogEntry{Time: now, Message: fmt.Sprintf("Failed password for root from %s port %d ssh2", client, 40000+i)}
+	}
+	select {
+	case p.reload <- struct{}{}:
+	default:
+	}
+	for deadline := time.Now().Add(5 * time.Second); !p.scopes["two"].banList.IsBanned(client); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("client not banned on route two")
+		}
+	}
+	if p.banList.IsBanned(client) {
+		t.Fatal("route ban leaked into the shared ban list")
+	}
+
+	// Shared bans apply to every route.
+	local := netip.MustParseAddr("127.0.0.1")
+	p.banList.Ban(local, time.Hour)
+	for _, route := range []string{"one", "two"} {
+		if got, err := greeting(route); err == nil || got != "" {
+			t.Fatalf("banned client reached %q on route %s: %v", got, route, err)
+		}
+	}
+}
+
+func TestProxy_RoutesPersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bans.json")
+	routes := []RouteConfig{{Name: "two", Listen: "127.0.0.1:0", Target: startNamed(t, "two"), Bans: "route"}}
+	start := func() *Proxy {
+		return startTestProxy(t, startEcho(t).Addr().String(), make(fakeSource), time.Now, func(c *Config) {
+			c.Routes = routes
+			c.Persistence = PersistenceConfig{Type: "file", Path: path, Interval: time.Hour}
+		})
+	}
+	client := netip.MustParseAddr("198.51.100.9")
+	p := start()
+	p.scopes["two"].banList.Ban(client, time.Hour)
+	if err := p.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// A restart keeps the route's bans, in the route's ban list.
+	p = start()
+	defer p.Shutdown(context.Background())
+	if !p.scopes["two"].banList.IsBanned(client) || p.banList.IsBanned(client) {
+		t.Fatal("route ban not restored to the route's ban list")
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ipPattern captures the client address in sshd messages, IPv4 or IPv6.
+// Candidates are validated with parseAddr.
+const ipPattern = `([0-9A-Fa-f.:]+)`
+
+// Rule recognizes one kind of sshd failure message. Weight is how much a
+// single match counts toward the ban threshold; a weight of 0 disables the
+// rule.
+type Rule struct {
+	Name    string
+	Pattern *regexp.Regexp
+	Weight  float64
+}
+
+// RuleSet is an ordered list of rules. A line is attributed to the first
+// rule that matches it.
+type RuleSet []Rule
+
+// DefaultRules returns the built-in sshd rules. Messages that sshd also
+// logs for ordinary mistakes, or that usually accompany another failure
+// line for the same attempt, weigh less than a failed password.
+func DefaultRules() RuleSet {
+	return RuleSet{
+		{"failed_password", regexp.MustCompile(`(?i)Failed (?:password|keyboard-interactive/pam|none) for .* from ` + ipPattern + ` port`), 1},
+		{"invalid_user", regexp.MustCompile(`(?i)Invalid user .* from ` + ipPattern + `(?: port|$)`), 1},
+		{"max_auth_attempts", regexp.MustCompile(`(?i)maximum authentication attempts exceeded for .* from ` + ipPattern + ` port`), 1},
+		{"preauth_closed", regexp.MustCompile(`(?i)Connection (?:closed|reset) by (?:(?:authenticating|invalid) user .* )?` + ipPattern + ` port \d+ \[preauth\]`), 0.5},
+		{"disconnected_invalid_user", regexp.MustCompile(`(?i)Disconnected from (?:invalid|authenticating) user .* ` + ipPattern + ` port \d+ \[preauth\]`), 0.5},
+		{"pam_auth_failure", regexp.MustCompile(`(?i)pam_unix\(sshd:auth\): authentication failure;.* rhost=` + ipPattern), 0.5},
+		{"no_identification", regexp.MustCompile(`(?i)Did not receive identification string from ` + ipPattern), 0.5},
+	}
+}
+
+// Match returns the first enabled rule matching line and the client
+// address it captured.
+func (rs RuleSet) Match(line string) (*Rule, string, bool) {
+	for i := range rs {
+		r := &rs[i]
+		if r.Weight <= 0 {
+			continue
+		}
+		if m := r.Pattern.FindStringSubmatch(line); len(m) == 2 {
+			return r, m[1], true
+		}
+	}
+	return nil, "", false
+}
+
+// WithWeights returns a copy of rs with the weights of the named rules
+// replaced.
+func (rs RuleSet) WithWeights(weights map[string]float64) (RuleSet, error) {
+	out := make(RuleSet, len(rs))
+	copy(out, rs)
+	for name, w := range weights {
+		found := false
+		for i := range out {
+			if out[i].Name == name {
+				out[i].Weight = w
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown rule %q", name)
+		}
+	}
+	return out, nil
+}
+
+// parseRuleWeights parses a list like "invalid_user=2,preauth_closed=0".
+func parseRuleWeights(s string) (map[string]float64, error) {
+	weights := make(map[string]float64)
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(item, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid rule weight %q", item)
+		}
+		w, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil || w < 0 {
+			return nil, fmt.Errorf("invalid weight for rule %q: %q", name, value)
+		}
+		weights[strings.TrimSpace(name)] = w
+	}
+	return weights, nil
+}
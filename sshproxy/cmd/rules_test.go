@@ -0,0 +1,73 @@
+package main
+
+import "testing"
+
+func TestDefaultRules_Match(t *testing.T) {
+	rules := DefaultRules()
+	tests := []struct {
+		line string
+		rule string
+		ip   string
+	}{
+		{"sshd[1]: Failed password for root from 10.0.0.1 port 22 ssh2", "failed_password", "10.0.0.1"},
+		{"sshd[1]: Failed password for invalid user admin from 10.0.0.2 port 22 ssh2", "failed_password", "10.0.0.2"},
+		{"sshd[1]: Invalid user admin from 10.0.0.3 port 4242", "invalid_user", "10.0.0.3"},
+		{"sshd[1]: error: maximum authentication attempts exceeded for root from 10.0.0.4 port 22 ssh2 [preauth]", "max_auth_attempts", "10.0.0.4"},
+		{"sshd[1]: Connection closed by authenticating user root 10.0.0.5 port 22 [preauth]", "preauth_closed", "10.0.0.5"},
+		{"sshd[1]: Connection closed by 10.0.0.6 port 22 [preauth]", "preauth_closed", "10.0.0.6"},
+		{"sshd[1]: Disconnected from invalid user test 10.0.0.7 port 22 [preauth]", "disconnected_invalid_user", "10.0.0.7"},
+		{"sshd[1]: pam_unix(sshd:auth): authentication failure; logname= uid=0 euid=0 tty=ssh ruser= rhost=10.0.0.8  user=root", "pam_auth_failure", "10.0.0.8"},
+		{"sshd[1]: Did not receive identification string from 10.0.0.9 port 22", "no_identification", "10.0.0.9"},
+		{"sshd[1]: Failed password for root from 2001:db8::abcd port 22 ssh2", "failed_password", "2001:db8::abcd"},
+		{"sshd[1]: Connection closed by invalid user admin fe80::1 port 22 [preauth]", "preauth_closed", "fe80::1"},
+	}
+	for _, tt := range tests {
+		rule, ip, ok := rules.Match(tt.line)
+		if !ok {
+			t.Errorf("no rule matched %q", tt.line)
+			continue
+		}
+		if rule.Name != tt.rule || ip != tt.ip {
+			t.Errorf("Match(%q) = %s %s, want %s %s", tt.line, rule.Name, ip, tt.rule, tt.ip)
+		}
+	}
+
+	for _, line := range []string{
+		"sshd[1]: Accepted publickey for test from 10.0.0.1 port 22 ssh2",
+		"sshd[1]: Disconnected from user test 10.0.0.1 port 22",
+	} {
+		if rule, _, ok := rules.Match(line); ok {
+			t.Errorf("Match(%q) unexpectedly matched %s", line, rule.Name)
+		}
+	}
+}
+
+func TestRuleSet_WithWeights(t *testing.T) {
+	weights, err := parseRuleWeights("invalid_user=2, failed_password=0")
+	if err != nil {
+		t.Fatalf("parseRuleWeights: %v", err)
+	}
+	rules, err := DefaultRules().WithWeights(weights)
+	if err != nil {
+		t.Fatalf("WithWeights: %v", err)
+	}
+	rule, _, ok := rules.Match("sshd[1]: Invalid user admin from 10.0.0.3 port 4242")
+	if !ok || rule.Weight != 2 {
+		t.Fatalf("expected invalid_user with weight 2, got %+v", rule)
+	}
+	if _, _, ok := rules.Match("sshd[1]: Failed password for root from 10.0.0.1 port 22 ssh2"); ok {
+		t.Fatal("disabled rule still matched")
+	}
+	if DefaultRules()[0].Weight != 1 {
+		t.Fatal("WithWeights modified the default rules")
+	}
+
+	if _, err := DefaultRules().WithWeights(map[string]float64{"nope": 1}); err == nil {
+		t.Fatal("expected error for unknown rule")
+	}
+	for _, bad := range []string{"invalid_user", "invalid_user=x", "invalid_user=-1"} {
+		if _, err := parseRuleWeights(bad); err == nil {
+			t.Errorf("parseRuleWeights(%q) should fail", bad)
+		}
+	}
+}
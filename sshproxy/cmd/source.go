@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LogEntry is a single log message and the time it was logged. Time is
+// zero when the source did not carry a timestamp.
+type LogEntry struct {
+	Time    time.Time
+	Message string
+}
+
+// LogSource yields log entries incrementally.
+type LogSource interface {
+	// Poll passes every entry that became available since the previous
+	// call to fn.
+	Poll(fn func(LogEntry)) error
+	Close() error
+}
+
+// lineReader is implemented by Tailer and streamLines. Lines are passed on
+// without their '\n' but otherwise unchanged, since binary journal fields
+// may end in '\r'.
+type lineReader interface {
+	ReadLines(fn func(line string)) error
+	Close() error
+}
+
+// newLogSource opens path ("-" for stdin) in the given format: "text" for
+// syslog-style lines or "journal" for journalctl JSON or export output.
+func newLogSource(path, format string, loc *time.Location) (LogSource, error) {
+	var lines lineReader
+	if path == "-" {
+		lines = newStreamLines(os.Stdin)
+	} else {
+		lines = NewTailer(path)
+	}
+	switch format {
+	case "", "text":
+		return &textSource{lines: lines, loc: loc}, nil
+	case "journal":
+		return &journalSource{lines: lines}, nil
+	default:
+		lines.Close()
+		return nil, fmt.Errorf("unknown log format %q", format)
+	}
+}
+
+// textSource reads plain text lines whose timestamp is at the start.
+type textSource struct {
+	lines lineReader
+	loc   *time.Location
+}
+
+func (s *textSource) Poll(fn func(LogEntry)) error {
+	now := time.Now()
+	return s.lines.ReadLines(func(line string) {
+		line = strings.TrimSuffix(line, "\r")
+		t, _ := parseLogTime(line, now, s.loc)
+		fn(LogEntry{Time: t, Message: line})
+	})
+}
+
+func (s *textSource) Close() error {
+	return s.lines.Close()
+}
+
+// streamLines collects lines from a reader that blocks, such as a pipe from
+// `journalctl -f`, so that they can be polled like a file.
+type streamLines struct {
+	mu       sync.Mutex
+	r        io.Reader
+	lines    []string
+	err      error
+	reported bool
+}
+
+func newStreamLines(r io.Reader) *streamLines {
+	s := &streamLines{r: r}
+	go s.run()
+	return s
+}
+
+func (s *streamLines) run() {
+	br := bufio.NewReader(s.r)
+	for {
+		line, err := br.ReadString('\n')
+		if err == nil || (err == io.EOF && line != "") {
+			s.mu.Lock()
+			s.lines = append(s.lines, strings.TrimSuffix(line, "\n"))
+			s.mu.Unlock()
+		}
+		if err != nil {
+			if err == io.EOF {
+				err = fmt.Errorf("log stream closed")
+			}
+			s.mu.Lock()
+			s.err = err
+			s.mu.Unlock()
+			return
+		}
+	}
+}
+
+// ReadLines passes the lines received since the previous call to fn. Once
+// the stream ends, the error is returned a single time.
+func (s *streamLines) ReadLines(fn func(line string)) error {
+	s.mu.Lock()
+	lines := s.lines
+	s.lines = nil
+	err := s.err
+	report := err != nil && !s.reported
+	if report {
+		s.reported = true
+	}
+	s.mu.Unlock()
+	for _, line := range lines {
+		fn(line)
+	}
+	if report {
+		return err
+	}
+	return nil
+}
+
+func (s *streamLines) Close() error {
+	if c, ok := s.r.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
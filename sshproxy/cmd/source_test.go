@@ -0,0 +1,51 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTextSource(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "auth.log")
+	appendFile(t, path, "2025-03-10T11:58:00Z host sshd[1]: Failed password\nno timestamp here\r\n")
+	src, err := newLogSource(path, "text", time.UTC)
+	if err != nil {
+		t.Fatalf("newLogSource: %v", err)
+	}
+	defer src.Close()
+	entries := pollAll(t, src)
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 entries, got %+v", entries)
+	}
+	if !entries[0].Time.Equal(time.Date(2025, time.March, 10, 11, 58, 0, 0, time.UTC)) {
+		t.Fatalf("unexpected time %v", entries[0].Time)
+	}
+	if !entries[1].Time.IsZero() || entries[1].Message != "no timestamp here" {
+		t.Fatalf("unexpected entry %+v", entries[1])
+	}
+
+	if _, err := newLogSource(path, "xml", time.UTC); err == nil {
+		t.Fatal("expected error for unknown format")
+	}
+}
+
+func TestStreamLines_EOF(t *testing.T) {
+	s := newStreamLines(strings.NewReader("one\ntwo"))
+	var lines []string
+	var errs int
+	deadline := time.Now().Add(2 * time.Second)
+	for errs == 0 && time.Now().Before(deadline) {
+		if err := s.ReadLines(func(line string) { lines = append(lines, line) }); err != nil {
+			errs++
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if errs != 1 || strings.Join(lines, ",") != "one,two" {
+		t.Fatalf("lines %q, errors %d", lines, errs)
+	}
+	if err := s.ReadLines(func(string) {}); err != nil {
+		t.Fatalf("stream error reported twice: %v", err)
+	}
+}
@@ -1,161 +1,96 @@
 package main
 
 import (
-	"bufio"
-	"io"
+	"context"
+	"flag"
+	"fmt"
 	"log/slog"
-	"net"
 	"os"
-	"regexp"
-	"sync"
-	"time"
+	"os/signal"
+	"strings"
+	"syscall"
 )
 
-// BanList stores banned IPs and their expiry
-type BanList struct {
-	sync.RWMutex
-	bans map[string]time.Time
-}
-
-func (b *BanList) IsBanned(ip string) bool {
-	b.RLock()
-	defer b.RUnlock()
-	until, ok := b.bans[ip]
-	return ok && time.Now().Before(until)
-}
+// stringList collects the values of a repeatable flag.
+type stringList []string
 
-func (b *BanList) Ban(ip string, duration time.Duration) {
-	b.Lock()
-	b.bans[ip] = time.Now().Add(duration)
-	b.Unlock()
-}
+func (l *stringList) String() string     { return strings.Join(*l, ",") }
+func (l *stringList) Set(v string) error { *l = append(*l, v); return nil }
 
-func (b *BanList) Cleanup() {
-	b.Lock()
-	now := time.Now()
-	for ip, until := range b.bans {
-		if now.After(until) {
-			delete(b.bans, ip)
+// reloadOn reloads p with the configuration returned by load on each
+// signal from hup and sets level to its log level. Invalid
+// configurations are logged and leave p as it is.
+func reloadOn(hup <-chan os.Signal, p *Proxy, load func() (Config, error), level *slog.LevelVar) {
+	for range hup {
+		next, err := load()
+		if err == nil {
+			err = p.Reload(next)
 		}
+		if err != nil {
+			p.Logger.Error("Ignoring invalid configuration", "error", err)
+			continue
+		}
+		lvl, _ := parseLogLevel(next.LogLevel)
+		level.Set(lvl)
 	}
-	b.Unlock()
 }
 
 func main() {
-	var logger *slog.Logger
-	{
-		var level slog.Level
-		switch os.Getenv("SSHPROXY_LOG_LEVEL") {
-		case "debug":
-			level = slog.LevelDebug
-		case "info":
-			level = slog.LevelInfo
-		case "warn":
-			level = slog.LevelWarn
-		case "error":
-			level = slog.LevelError
-		default:
-			level = slog.LevelInfo
-		}
-		logger = slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level}))
-	}
-	if len(os.Args) != 3 {
-		logger.Error("Usage error", "listen_addr", os.Args[1], "target_addr", os.Args[2])
-		os.Exit(1)
-	}
-	listenAddr := os.Args[1]
-	targetAddr := os.Args[2]
+	var level slog.LevelVar
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: &level}))
 
-	logFile := os.Getenv("SSHPROXY_AUTH_LOG")
-	if logFile == "" {
-		logFile = "/var/log/auth.log"
+	fs := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s [-config file] [-set key=value]... [listen_addr target_addr]\n", os.Args[0])
+		fs.PrintDefaults()
 	}
-	banThreshold := 5
-	banWindow := 10 * time.Minute
-	banDuration := 10 * time.Minute
-
-	banList := &BanList{bans: make(map[string]time.Time)}
-
-	// Start log parser goroutine
-	go func() {
-		failedRegex := regexp.MustCompile(`(?i)Failed password for .* from ([0-9.:]+) port`)
-		for {
-			ipFails := make(map[string][]time.Time)
-			f, err := os.Open(logFile)
-			if err != nil {
-				logger.Error("Failed to open log file", "error", err)
-				time.Sleep(30 * time.Second)
-				continue
-			}
-			scanner := bufio.NewScanner(f)
-			now := time.Now()
-			for scanner.Scan() {
-				line := scanner.Text()
-				matches := failedRegex.FindStringSubmatch(line)
-				if len(matches) == 2 {
-					ip := matches[1]
-					ipFails[ip] = append(ipFails[ip], now)
-				}
-			}
-			f.Close()
-			for ip, times := range ipFails {
-				// Only count failures in the last banWindow
-				recent := 0
-				for _, t := range times {
-					if now.Sub(t) <= banWindow {
-						recent++
-					}
-				}
-				logger.Debug("IP failure count", "ip", ip, "count", recent)
-				if recent >= banThreshold {
-					banList.Ban(ip, banDuration)
-					logger.Info("Banned IP", "ip", ip, "duration", banDuration, "failures", recent)
-				}
-			}
-			banList.Cleanup()
-			time.Sleep(60 * time.Second)
+	configPath := fs.String("config", os.Getenv("SSHPROXY_CONFIG"), "path to the YAML config `file`")
+	var overrides stringList
+	fs.Var(&overrides, "set", "override a config key, e.g. -set ban.threshold=10 (repeatable)")
+	fs.Parse(os.Args[1:])
+	args := fs.Args()
+	if len(args) != 0 && len(args) != 2 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	load := func() (Config, error) {
+		cfg, err := loadConfig(*configPath, overrides)
+		if err != nil {
+			return cfg, err
 		}
-	}()
+		if len(args) == 2 {
+			cfg.Listen, cfg.Target = args[0], args[1]
+		}
+		return cfg, cfg.Validate()
+	}
 
-	ln, err := net.Listen("tcp", listenAddr)
+	cfg, err := load()
 	if err != nil {
-		logger.Error("Failed to listen on", "listen_addr", listenAddr, "error", err)
+		logger.Error("Invalid configuration", "error", err)
 		os.Exit(1)
 	}
-	logger.Info("TCP SSH Proxy listening", "listen_addr", listenAddr, "target_addr", targetAddr)
+	lvl, _ := parseLogLevel(cfg.LogLevel)
+	level.Set(lvl)
 
-	for {
-		clientConn, err := ln.Accept()
-		if err != nil {
-			logger.Error("Failed to accept connection", "error", err)
-			continue
-		}
-		remoteAddr, _, err := net.SplitHostPort(clientConn.RemoteAddr().String())
-		if err != nil {
-			logger.Error("Failed to parse remote address", "error", err)
-			clientConn.Close()
-			continue
-		}
-		if banList.IsBanned(remoteAddr) {
-			logger.Warn("Rejected banned IP", "ip", remoteAddr)
-			clientConn.Close()
-			continue
-		}
-		go handleTCPProxy(clientConn, targetAddr, logger)
+	proxy := NewProxy(cfg)
+	proxy.Logger = logger
+	if err := proxy.Start(context.Background()); err != nil {
+		logger.Error("Failed to start", "error", err)
+		os.Exit(1)
 	}
-}
 
-func handleTCPProxy(clientConn net.Conn, targetAddr string, logger *slog.Logger) {
-	defer clientConn.Close()
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go reloadOn(hup, proxy, load, &level)
 
-	targetConn, err := net.Dial("tcp", targetAddr)
-	if err != nil {
-		logger.Error("Failed to connect to target", "target", targetAddr, "error", err)
-		return
+	term := make(chan os.Signal, 1)
+	signal.Notify(term, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-term
+	timeout := proxy.Config().ShutdownTimeout
+	logger.Info("Shutting down", "signal", sig, "timeout", timeout)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := proxy.Shutdown(ctx); err != nil {
+		logger.Warn("Sessions did not end before the shutdown timeout", "error", err)
 	}
-	defer targetConn.Close()
-
-	// Bidirectional copy
-	go io.Copy(targetConn, clientConn)
-	io.Copy(clientConn, targetConn)
 }
@@ -1,28 +1,44 @@
 package main
 
 import (
+	"context"
+	"io"
+	"log/slog"
+	"net"
 	"os"
+	"syscall"
 	"testing"
 	"time"
 
 	"golang.org/x/crypto/ssh"
 )
 
-// Helper to start the proxy for tests
-func startProxy(t *testing.T, listenAddr, targetAddr, logPath string) {
-	os.Setenv("SSHPROXY_AUTH_LOG", logPath)
-	go func() {
-		t.Log("start sshproxy")
-		os.Args = []string{"sshproxy", listenAddr, targetAddr}
-		main()
-	}()
-	time.Sleep(1 * time.Second)
+// Helper to start the proxy for tests. It returns the address the proxy
+// listens on.
+func startProxy(t *testing.T, targetAddr, logPath string) string {
+	t.Helper()
+	t.Setenv("SSHPROXY_AUTH_LOG", logPath)
+	cfg, err := loadConfig("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Listen, cfg.Target = "127.0.0.1:0", targetAddr
+	p := NewProxy(cfg)
+	if err := p.Start(context.Background()); err != nil {
+		t.Fatalf("Failed to start proxy: %v", err)
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		p.Shutdown(ctx)
+	})
+	return p.Addr().String()
 }
 
 func TestSSHProxy_Forwarding(t *testing.T) {
 	// Start proxy (no banning)
 	banLog := "../test/auth_not_banned.log"
-	startProxy(t, ":2245", "localhost:2222", banLog)
+	proxyAddr := startProxy(t, "localhost:2222", banLog)
 
 	// Load private key from test/clientkey
 	clientKey := "../test/clientkey"
@@ -43,7 +59,7 @@ func TestSSHProxy_Forwarding(t *testing.T) {
 	}
 
 	// Connect to SSH server via proxy
-	client, err := ssh.Dial("tcp", "localhost:2245", config)
+	client, err := ssh.Dial("tcp", proxyAddr, config)
 	if err != nil {
 		t.Fatalf("Failed to connect to SSH server via proxy: %v", err)
 	}
@@ -69,7 +85,7 @@ func TestSSHProxy_Forwarding(t *testing.T) {
 func TestSSHProxy_Banning(t *testing.T) {
 	// Use a log file with repeated failures from 127.0.0.1
 	banLog := "../test/auth.log"
-	startProxy(t, ":2246", "localhost:2222", banLog)
+	proxyAddr := startProxy(t, "localhost:2222", banLog)
 
 	// Wait for ban goroutine to process log
 	time.Sleep(2 * time.Second)
@@ -92,10 +108,94 @@ func TestSSHProxy_Banning(t *testing.T) {
 		Timeout:         5 * time.Second,
 	}
 
-	_, err = ssh.Dial("tcp", "localhost:2246", config)
+	_, err = ssh.Dial("tcp", proxyAddr, config)
 	if err == nil {
 		t.Fatalf("Expected connection to be rejected for banned IP, but SSH client connected successfully")
 	} else {
 		t.Logf("Connection rejected as expected for banned IP: %v", err)
 	}
 }
+
+func TestHandleTCPProxy_HalfClose(t *testing.T) {
+	// The target only replies once it reads EOF, so the client's
+	// half-close must reach it while the reply still flows back.
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	go func() {
+		conn, err := target.Accept()
+		if err != nil {
+			return
+		}
+		got, _ := io.ReadAll(conn)
+		conn.Write(got)
+		conn.Close()
+	}()
+	front, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer front.Close()
+	p := newTestProxy(t, Config{})
+	go func() {
+		conn, err := front.Accept()
+		if err != nil {
+			return
+		}
+		p.handleTCPProxy(conn, target.Addr().String(), 0)
+	}()
+
+	conn, err := net.Dial("tcp", front.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.WriteString(conn, "SSH-2.0-Test\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.(*net.TCPConn).CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(conn)
+	if err != nil || string(got) != "SSH-2.0-Test\r\n" {
+		t.Fatalf("got %q, %v after the half-close", got, err)
+	}
+}
+
+func TestReloadOn(t *testing.T) {
+	p := startTestProxy(t, startNamed(t, "old"), make(fakeSource), time.Now)
+	defer p.Shutdown(context.Background())
+	var level slog.LevelVar
+
+	// The first configuration is invalid, the second is not.
+	invalid, valid := p.Config(), p.Config()
+	invalid.Target, invalid.LogLevel = "", "debug"
+	valid.Target, valid.LogLevel = startNamed(t, "new"), "debug"
+	loads := []Config{invalid, valid}
+	load := func() (Config, error) {
+		next := loads[0]
+		loads = loads[1:]
+		return next, next.Validate()
+	}
+
+	hup := make(chan os.Signal)
+	done := make(chan struct{})
+	go func() {
+		reloadOn(hup, p, load, &level)
+		close(done)
+	}()
+	hup <- syscall.SIGHUP
+	hup <- syscall.SIGHUP
+	// The first reload is done once the second signal is received.
+	close(hup)
+	<-done
+	if got := p.Config().Target; got != valid.Target {
+		t.Fatalf("target %q after SIGHUP, want %q", got, valid.Target)
+	}
+	if level.Level() != slog.LevelDebug {
+		t.Fatalf("log level %v after SIGHUP", level.Level())
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"time"
+)
+
+// BanStore shares bans and failure counters between sshproxy replicas.
+// BanList keeps a local copy of the bans for the accept loop and syncs it
+// with the store in the background; the store is never queried per
+// connection.
+type BanStore interface {
+	// SetBan records a ban of p that expires at until, or never if until
+	// is zero. Single addresses are passed as single-address prefixes.
+	SetBan(ctx context.Context, p netip.Prefix, until time.Time) error
+	DeleteBan(ctx context.Context, p netip.Prefix) error
+	// Bans returns every active ban.
+	Bans(ctx context.Context) (map[netip.Prefix]time.Time, error)
+
+	// AddFailure records a failure of addr at t. Failures are kept for
+	// window.
+	AddFailure(ctx context.Context, addr netip.Addr, t time.Time, weight float64, window time.Duration) error
+	// Score returns the total weight of addr's failures after since.
+	Score(ctx context.Context, addr netip.Addr, since time.Time) (float64, error)
+	ResetFailures(ctx context.Context, addr netip.Addr) error
+
+	Close() error
+}
+
+// newBanStore returns the backend selected in cfg, or nil if ban state is
+// local to this process. now is the clock the expiry of bans and failures
+// is measured against.
+func newBanStore(cfg StoreConfig, now func() time.Time) (BanStore, error) {
+	switch cfg.Type {
+	case "":
+		return nil, nil
+	case "redis":
+		return newRedisStore(cfg, now), nil
+	default:
+		return nil, fmt.Errorf("unknown store type %q", cfg.Type)
+	}
+}
+
+// Sync writes local ban changes to the store and then replaces the local
+// bans with the store's, picking up bans and unbans made by other
+// replicas. Changes that could not be written are retried on the next
+// call. Sync does nothing without a store.
+func (b *BanList) Sync(ctx context.Context) error {
+	b.Lock()
+	store := b.store
+	pending := b.pending
+	b.pending = make(map[netip.Prefix]struct{})
+	writes := make(map[netip.Prefix]*time.Time, len(pending))
+	for p := range pending {
+		if until, ok := b.lookup(p); ok {
+			writes[p] = &until
+		} else {
+			writes[p] = nil
+		}
+	}
+	b.Unlock()
+	if store == nil {
+		return nil
+	}
+
+	var err error
+	failed := make(map[netip.Prefix]struct{})
+	for p, until := range writes {
+		if err != nil {
+			failed[p] = struct{}{}
+			continue
+		}
+		if until != nil {
+			err = store.SetBan(ctx, p, *until)
+		} else {
+			err = store.DeleteBan(ctx, p)
+		}
+		if err != nil {
+			failed[p] = struct{}{}
+		}
+	}
+	var remote map[netip.Prefix]time.Time
+	if err == nil {
+		remote, err = store.Bans(ctx)
+	}
+
+	b.Lock()
+	defer b.Unlock()
+	for p := range failed {
+		b.pending[p] = struct{}{}
+	}
+	if err != nil {
+		return err
+	}
+	bans := make(map[netip.Addr]time.Time, len(remote))
+	ranges := make(map[netip.Prefix]time.Time)
+	set := func(p netip.Prefix, until time.Time, ok bool) {
+		switch {
+		case p.IsSingleIP() && ok:
+			bans[p.Addr()] = until
+		case p.IsSingleIP():
+			delete(bans, p.Addr())
+		case ok:
+			ranges[p] = until
+		default:
+			delete(ranges, p)
+		}
+	}
+	for p, until := range remote {
+		set(normalizePrefix(p), until, true)
+	}
+	// Keep local changes made while the store was being read.
+	for p := range b.pending {
+		until, ok := b.lookup(p)
+		set(p, until, ok)
+	}
+	// The store drops bans as they expire, but Cleanup must still see
+	// them to report them as expired.
+	now := b.now()
+	for addr, until := range b.bans {
+		if _, ok := bans[addr]; !ok && !active(until, now) {
+			bans[addr] = until
+		}
+	}
+	for p, until := range b.ranges {
+		if _, ok := ranges[p]; !ok && !active(until, now) {
+			ranges[p] = until
+		}
+	}
+	b.bans = bans
+	b.ranges = ranges
+	return nil
+}
+
+// lookup returns the expiry of the ban of p. b must be locked.
+func (b *BanList) lookup(p netip.Prefix) (time.Time, bool) {
+	if p.IsSingleIP() {
+		until, ok := b.bans[p.Addr()]
+		return until, ok
+	}
+	until, ok := b.ranges[p]
+	return until, ok
+}
+
+// SetStore makes b share its bans through store. Existing bans are
+// written on the next Sync.
+func (b *BanList) SetStore(store BanStore) {
+	b.Lock()
+	defer b.Unlock()
+	b.store = store
+	for addr := range b.bans {
+		b.pending[hostPrefix(addr)] = struct{}{}
+	}
+	for p := range b.ranges {
+		b.pending[p] = struct{}{}
+	}
+}
+
+// sharedScores records the failures read in this pass in store and
+// returns, for every address in local, its score across all replicas.
+func sharedScores(ctx context.Context, store BanStore, batch []FailureEntry, local map[netip.Addr]float64, window time.Duration, now time.Time) (map[netip.Addr]float64, error) {
+	for _, f := range batch {
+		if err := store.AddFailure(ctx, f.Addr, f.Time, f.Weight, window); err != nil {
+			return local, err
+		}
+	}
+	scores := make(map[netip.Addr]float64, len(local))
+	for addr, score := range local {
+		shared, err := store.Score(ctx, addr, now.Add(-window))
+		if err != nil {
+			return local, err
+		}
+		// The store may have evicted failures the detector still holds.
+		scores[addr] = max(score, shared)
+	}
+	return scores, nil
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// redisStore keeps bans and failures in Redis, or anything speaking its
+// protocol. Each ban is a key "<prefix>ban:<addr>", or
+// "<prefix>ban:<addr>/<bits>" for a range, holding the expiry in
+// Unix milliseconds (0 for permanent) with a matching TTL. Each address's
+// failures are a sorted set "<prefix>fail:<addr>" scored by time, expiring
+// one window after the latest failure.
+type redisStore struct {
+	client *redis.Client
+	prefix string
+	// id and seq make failure members unique across replicas.
+	id  string
+	seq atomic.Uint64
+	now func() time.Time
+}
+
+func newRedisStore(cfg StoreConfig, now func() time.Time) *redisStore {
+	var id [4]byte
+	rand.Read(id[:])
+	return &redisStore{
+		client: redis.NewClient(&redis.Options{
+			Addr:     cfg.Address,
+			Username: cfg.Username,
+			Password: cfg.Password,
+			DB:       cfg.DB,
+		}),
+		prefix: cfg.Prefix,
+		id:     hex.EncodeToString(id[:]),
+		now:    now,
+	}
+}
+
+func (s *redisStore) banKey(p netip.Prefix) string {
+	if p.IsSingleIP() {
+		return s.prefix + "ban:" + p.Addr().String()
+	}
+	return s.prefix + "ban:" + p.String()
+}
+
+func (s *redisStore) failKey(addr netip.Addr) string {
+	return s.prefix + "fail:" + addr.String()
+}
+
+func (s *redisStore) SetBan(ctx context.Context, p netip.Prefix, until time.Time) error {
+	if until.IsZero() {
+		return s.client.Set(ctx, s.banKey(p), 0, 0).Err()
+	}
+	ttl := until.Sub(s.now())
+	if ttl <= 0 {
+		return s.DeleteBan(ctx, p)
+	}
+	return s.client.Set(ctx, s.banKey(p), until.UnixMilli(), ttl).Err()
+}
+
+func (s *redisStore) DeleteBan(ctx context.Context, p netip.Prefix) error {
+	return s.client.Del(ctx, s.banKey(p)).Err()
+}
+
+func (s *redisStore) Bans(ctx context.Context) (map[netip.Prefix]time.Time, error) {
+	var keys []string
+	iter := s.client.Scan(ctx, 0, s.prefix+"ban:*", 1000).Iterator()
+	for iter.Next(ctx) {
+		keys = append(keys, iter.Val())
+	}
+	if err := iter.Err(); err != nil {
+		return nil, err
+	}
+	bans := make(map[netip.Prefix]time.Time, len(keys))
+	for len(keys) > 0 {
+		batch := keys[:min(len(keys), 1000)]
+		keys = keys[len(batch):]
+		values, err := s.client.MGet(ctx, batch...).Result()
+		if err != nil {
+			return nil, err
+		}
+		for i, v := range values {
+			str, ok := v.(string)
+			if !ok {
+				// Expired between SCAN and MGET.
+				continue
+			}
+			p, err := parsePrefixes([]string{strings.TrimPrefix(batch[i], s.prefix+"ban:")})
+			if err != nil {
+				continue
+			}
+			ms, err := strconv.ParseInt(str, 10, 64)
+			if err != nil {
+				continue
+			}
+			var until time.Time
+			if ms != 0 {
+				until = time.UnixMilli(ms)
+			}
+			bans[p[0]] = until
+		}
+	}
+	return bans, nil
+}
+
+func (s *redisStore) AddFailure(ctx context.Context, addr netip.Addr, t time.Time, weight float64, window time.Duration) error {
+	key := s.failKey(addr)
+	member := fmt.Sprintf("%s:%d:%g", s.id, s.seq.Add(1), weight)
+	pipe := s.client.TxPipeline()
+	pipe.ZAdd(ctx, key, redis.Z{Score: float64(t.UnixMilli()), Member: member})
+	pipe.ZRemRangeByScore(ctx, key, "-inf", "("+strconv.FormatInt(s.now().Add(-window).UnixMilli(), 10))
+	pipe.PExpire(ctx, key, window)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+func (s *redisStore) Score(ctx context.Context, addr netip.Addr, since time.Time) (float64, error) {
+	members, err := s.client.ZRangeByScore(ctx, s.failKey(addr), &redis.ZRangeBy{
+		Min: "(" + strconv.FormatInt(since.UnixMilli(), 10),
+		Max: "+inf",
+	}).Result()
+	if err != nil {
+		return 0, err
+	}
+	score := 0.0
+	for _, m := range members {
+		if i := strings.LastIndexByte(m, ':'); i >= 0 {
+			if w, err := strconv.ParseFloat(m[i+1:], 64); err == nil {
+				score += w
+			}
+		}
+	}
+	return score, nil
+}
+
+func (s *redisStore) ResetFailures(ctx context.Context, addr netip.Addr) error {
+	return s.client.Del(ctx, s.failKey(addr)).Err()
+}
+
+func (s *redisStore) Close() error {
+	return s.client.Close()
+}
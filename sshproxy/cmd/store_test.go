@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"net/netip"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func newTestStore(t *testing.T, now func() time.Time) (*miniredis.Miniredis, BanStore) {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	store, err := newBanStore(StoreConfig{Type: "redis", Address: mr.Addr(), Prefix: "test:"}, now)
+	if err != nil {
+		t.Fatalf("newBanStore: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return mr, store
+}
+
+func TestRedisStore_Bans(t *testing.T) {
+	mr, store := newTestStore(t, time.Now)
+	ctx := context.Background()
+	temp := netip.MustParsePrefix("10.0.0.1/32")
+	perm := netip.MustParsePrefix("2001:db8::1/128")
+	subnet := netip.MustParsePrefix("10.1.0.0/16")
+	until := time.Now().Add(time.Hour).Truncate(time.Millisecond)
+
+	if err := store.SetBan(ctx, temp, until); err != nil {
+		t.Fatalf("SetBan: %v", err)
+	}
+	if err := store.SetBan(ctx, perm, time.Time{}); err != nil {
+		t.Fatalf("SetBan: %v", err)
+	}
+	if err := store.SetBan(ctx, subnet, time.Time{}); err != nil {
+		t.Fatalf("SetBan: %v", err)
+	}
+	if ttl := mr.TTL("test:ban:10.0.0.1"); ttl <= 59*time.Minute || ttl > time.Hour {
+		t.Fatalf("ban TTL %v does not match expiry", ttl)
+	}
+	if ttl := mr.TTL("test:ban:2001:db8::1"); ttl != 0 {
+		t.Fatalf("permanent ban has TTL %v", ttl)
+	}
+	bans, err := store.Bans(ctx)
+	if err != nil {
+		t.Fatalf("Bans: %v", err)
+	}
+	if !mr.Exists("test:ban:10.1.0.0/16") {
+		t.Fatal("range ban not stored under its prefix")
+	}
+	if len(bans) != 3 || !bans[temp].Equal(until) || !bans[perm].IsZero() || !bans[subnet].IsZero() {
+		t.Fatalf("unexpected bans %v", bans)
+	}
+
+	mr.FastForward(2 * time.Hour)
+	if err := store.DeleteBan(ctx, perm); err != nil {
+		t.Fatalf("DeleteBan: %v", err)
+	}
+	if err := store.DeleteBan(ctx, subnet); err != nil {
+		t.Fatalf("DeleteBan: %v", err)
+	}
+	if bans, _ := store.Bans(ctx); len(bans) != 0 {
+		t.Fatalf("bans left after expiry and delete: %v", bans)
+	}
+}
+
+func TestRedisStore_Failures(t *testing.T) {
+	mr, store := newTestStore(t, time.Now)
+	ctx := context.Background()
+	addr := netip.MustParseAddr("10.0.0.1")
+	now := time.Now()
+	window := 10 * time.Minute
+
+	for _, f := range []struct {
+		at     time.Time
+		weight float64
+	}{
+		{now.Add(-time.Minute), 1},
+		{now.Add(-time.Minute), 1}, // same time from another replica
+		{now.Add(-2 * time.Minute), 0.5},
+		{now.Add(-20 * time.Minute), 1},
+	} {
+		if err := store.AddFailure(ctx, addr, f.at, f.weight, window); err != nil {
+			t.Fatalf("AddFailure: %v", err)
+		}
+	}
+	score, err := store.Score(ctx, addr, now.Add(-window))
+	if err != nil || score != 2.5 {
+		t.Fatalf("Score = %v, %v; want 2.5", score, err)
+	}
+	if ttl := mr.TTL("test:fail:10.0.0.1"); ttl != window {
+		t.Fatalf("failure TTL %v, want %v", ttl, window)
+	}
+	if err := store.ResetFailures(ctx, addr); err != nil {
+		t.Fatalf("ResetFailures: %v", err)
+	}
+	if score, _ := store.Score(ctx, addr, now.Add(-window)); score != 0 {
+		t.Fatalf("score after reset %v", score)
+	}
+}
+
+func TestBanList_SyncReplicas(t *testing.T) {
+	_, store := newTestStore(t, time.Now)
+	ctx := context.Background()
+	policy := EscalationPolicy{Steps: []time.Duration{time.Hour}}
+	a := NewBanList(policy)
+	b := NewBanList(policy)
+	a.SetStore(store)
+	b.SetStore(store)
+	addr := netip.MustParseAddr("::ffff:10.0.0.1")
+
+	a.Escalate(addr, 5)
+	a.BanPrefix(netip.MustParsePrefix("10.1.0.0/16"), time.Hour)
+	if b.IsBanned(addr) {
+		t.Fatal("ban visible before sync")
+	}
+	if err := a.Sync(ctx); err != nil {
+		t.Fatalf("Sync: %v", err)
+	}
+	if err := b.Sync(ctx); err != nil {
+		t.Fatalf("Sync: %v", err)
+	}
+	if !b.IsBanned(netip.MustParseAddr("10.0.0.1")) {
+		t.Fatal("ban not shared with other replica")
+	}
+	if !b.IsBanned(netip.MustParseAddr("10.1.2.3")) {
+		t.Fatal("range ban not shared with other replica")
+	}
+
+	// A ban removed from the store disappears from every replica.
+	if err := store.DeleteBan(ctx, netip.MustParsePrefix("10.0.0.1/32")); err != nil {
+		t.Fatalf("DeleteBan: %v", err)
+	}
+	if err := b.Sync(ctx); err != nil {
+		t.Fatalf("Sync: %v", err)
+	}
+	if b.IsBanned(addr) {
+		t.Fatal("deleted ban still active")
+	}
+}
+
+func TestBanList_SyncRetries(t *testing.T) {
+	mr, store := newTestStore(t, time.Now)
+	ctx := context.Background()
+	b := NewBanList(EscalationPolicy{Steps: []time.Duration{time.Hour}})
+	b.SetStore(store)
+	addr := netip.MustParseAddr("10.0.0.1")
+
+	mr.SetError("unavailable")
+	b.Escalate(addr, 5)
+	if err := b.Sync(ctx); err == nil {
+		t.Fatal("expected sync error")
+	}
+	if !b.IsBanned(addr) {
+		t.Fatal("local ban lost when store was unavailable")
+	}
+	mr.SetError("")
+	if err := b.Sync(ctx); err != nil {
+		t.Fatalf("Sync: %v", err)
+	}
+	if !mr.Exists("test:ban:10.0.0.1") {
+		t.Fatal("ban not written after store recovered")
+	}
+}
+
+func TestBanList_SyncExpired(t *testing.T) {
+	// The store and the ban list both run on the proxy's clock.
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+	mr, store := newTestStore(t, clock)
+	ctx := context.Background()
+	b := NewBanList(EscalationPolicy{Steps: []time.Duration{time.Hour}})
+	b.SetClock(clock)
+	b.SetStore(store)
+	addr := netip.MustParseAddr("10.0.0.1")
+	subnet := netip.MustParsePrefix("10.1.0.0/16")
+
+	b.Escalate(addr, 5)
+	b.BanPrefix(subnet, time.Hour)
+	if err := b.Sync(ctx); err != nil {
+		t.Fatalf("Sync: %v", err)
+	}
+	if ttl := mr.TTL("test:ban:10.0.0.1"); ttl != time.Hour {
+		t.Fatalf("ban TTL %v, want %v", ttl, time.Hour)
+	}
+
+	// Once expired, the bans are gone from the store before Cleanup runs,
+	// yet it still reports them.
+	now = now.Add(2 * time.Hour)
+	mr.FastForward(2 * time.Hour)
+	if err := b.Sync(ctx); err != nil {
+		t.Fatalf("Sync: %v", err)
+	}
+	if b.IsBanned(addr) {
+		t.Fatal("expired ban still active")
+	}
+	expired := b.Cleanup()
+	if len(expired) != 2 || !slices.Contains(expired, hostPrefix(addr)) || !slices.Contains(expired, subnet) {
+		t.Fatalf("Cleanup = %v, want the expired bans", expired)
+	}
+	if err := b.Sync(ctx); err != nil || len(b.Cleanup()) != 0 {
+		t.Fatalf("expired bans reported again: %v", err)
+	}
+}
+
+func TestSharedScores(t *testing.T) {
+	_, store := newTestStore(t, time.Now)
+	ctx := context.Background()
+	addr := netip.MustParseAddr("10.0.0.1")
+	now := time.Now()
+	window := 10 * time.Minute
+
+	// Another replica already saw three failures.
+	for i := 0; i < 3; i++ {
+		store.AddFailure(ctx, addr, now.Add(-time.Minute), 1, window)
+	}
+	batch := []FailureEntry{{Addr: addr, Time: now, Weight: 1}}
+	scores, err := sharedScores(ctx, store, batch, map[netip.Addr]float64{addr: 1}, window, now)
+	if err != nil {
+		t.Fatalf("sharedScores: %v", err)
+	}
+	if scores[addr] != 4 {
+		t.Fatalf("shared score %v, want 4", scores[addr])
+	}
+}
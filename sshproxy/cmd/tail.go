@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// maxLineLength bounds the unterminated line a Tailer buffers. It leaves
+// room for the largest binary journal field.
+const maxLineLength = 2 * maxJournalField
+
+// Tailer follows a log file the way `tail -F` does. It remembers the offset
+// of the last complete line it returned and notices logrotate rotations:
+// with `create` the path points at a new inode, so the old file is drained
+// before switching; with `copytruncate` the file shrinks below the offset,
+// so reading restarts from the beginning.
+type Tailer struct {
+	path    string
+	file    *os.File
+	info    os.FileInfo
+	offset  int64
+	partial []byte
+	// skipping is set while the rest of a line over maxLineLength is
+	// read and dropped.
+	skipping bool
+}
+
+// NewTailer returns a Tailer for path. The file is opened lazily by the
+// first call to ReadLines and read from the start.
+func NewTailer(path string) *Tailer {
+	return &Tailer{path: path}
+}
+
+// ReadLines passes every complete line appended since the previous call to
+// fn, following rotations as needed. Lines longer than maxLineLength are
+// dropped, which is reported in the error once the rest has been read.
+func (t *Tailer) ReadLines(fn func(line string)) error {
+	if t.file == nil {
+		if err := t.open(); err != nil {
+			return err
+		}
+	}
+
+	// copytruncate: the open file got shorter than what we already consumed.
+	if info, err := t.file.Stat(); err == nil && info.Size() < t.offset {
+		t.offset = 0
+		t.partial, t.skipping = nil, false
+	}
+	if err := t.drain(fn); err != nil {
+		return err
+	}
+
+	// create: the path now refers to a different file. Everything left in
+	// the old file was drained above, so flush any unterminated last line
+	// and switch over.
+	info, err := os.Stat(t.path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			// Rotated away and not recreated yet; keep the old file.
+			return nil
+		}
+		return err
+	}
+	if os.SameFile(info, t.info) {
+		return nil
+	}
+	if len(t.partial) > 0 {
+		fn(string(t.partial))
+		t.partial = nil
+	}
+	t.file.Close()
+	t.file = nil
+	if err := t.open(); err != nil {
+		return err
+	}
+	return t.drain(fn)
+}
+
+// Close releases the underlying file.
+func (t *Tailer) Close() error {
+	if t.file == nil {
+		return nil
+	}
+	err := t.file.Close()
+	t.file = nil
+	return err
+}
+
+func (t *Tailer) open() error {
+	f, err := os.Open(t.path)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	t.file = f
+	t.info = info
+	t.offset = 0
+	t.partial, t.skipping = nil, false
+	return nil
+}
+
+// drain reads from the current offset to EOF. An unterminated trailing line
+// is kept in t.partial until the rest of it arrives, unless it grows over
+// maxLineLength.
+func (t *Tailer) drain(fn func(line string)) error {
+	if _, err := t.file.Seek(t.offset, io.SeekStart); err != nil {
+		return err
+	}
+	r := bufio.NewReader(t.file)
+	dropped := 0
+	for {
+		chunk, err := r.ReadSlice('\n')
+		t.offset += int64(len(chunk))
+		if err == nil {
+			if t.skipping {
+				t.skipping = false
+				continue
+			}
+			line := chunk[:len(chunk)-1]
+			if len(t.partial) > 0 {
+				line = append(t.partial, line...)
+				t.partial = nil
+			}
+			fn(string(line))
+			continue
+		}
+		if !t.skipping {
+			t.partial = append(t.partial, chunk...)
+			if len(t.partial) > maxLineLength {
+				t.partial, t.skipping = nil, true
+				dropped++
+			}
+		}
+		if errors.Is(err, bufio.ErrBufferFull) {
+			continue
+		}
+		if errors.Is(err, io.EOF) {
+			if dropped > 0 {
+				return fmt.Errorf("dropped %d lines longer than %d bytes", dropped, maxLineLength)
+			}
+			return nil
+		}
+		return err
+	}
+}
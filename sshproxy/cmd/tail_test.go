@@ -0,0 +1,121 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func readAll(t *testing.T, tailer *Tailer) []string {
+	t.Helper()
+	var lines []string
+	if err := tailer.ReadLines(func(line string) { lines = append(lines, line) }); err != nil {
+		t.Fatalf("ReadLines: %v", err)
+	}
+	return lines
+}
+
+func appendFile(t *testing.T, path, data string) {
+	t.Helper()
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatalf("open %s: %v", path, err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(data); err != nil {
+		t.Fatalf("write %s: %v", path, err)
+	}
+}
+
+func TestTailer_Incremental(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "auth.log")
+	appendFile(t, path, "one\ntwo\nthr")
+	tailer := NewTailer(path)
+	defer tailer.Close()
+
+	if got := readAll(t, tailer); !reflect.DeepEqual(got, []string{"one", "two"}) {
+		t.Fatalf("first read: %q", got)
+	}
+	if got := readAll(t, tailer); len(got) != 0 {
+		t.Fatalf("expected no new lines, got %q", got)
+	}
+	appendFile(t, path, "ee\nfour\n")
+	if got := readAll(t, tailer); !reflect.DeepEqual(got, []string{"three", "four"}) {
+		t.Fatalf("second read: %q", got)
+	}
+}
+
+func TestTailer_LongLine(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "auth.log")
+	appendFile(t, path, "one\n"+strings.Repeat("x", maxLineLength+1))
+	tailer := NewTailer(path)
+	defer tailer.Close()
+
+	// The line over the limit is dropped once it is too long, not
+	// buffered until it ends, and the lines around it are kept.
+	var lines []string
+	if err := tailer.ReadLines(func(line string) { lines = append(lines, line) }); err == nil {
+		t.Fatal("long line dropped without an error")
+	}
+	if len(tailer.partial) != 0 {
+		t.Fatalf("%d bytes of the long line buffered", len(tailer.partial))
+	}
+	appendFile(t, path, "xxx\ntwo\r\n")
+	lines = append(lines, readAll(t, tailer)...)
+	if !reflect.DeepEqual(lines, []string{"one", "two\r"}) {
+		t.Fatalf("got %q", lines)
+	}
+}
+
+func TestTailer_CreateRotation(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "auth.log")
+	appendFile(t, path, "one\n")
+	tailer := NewTailer(path)
+	defer tailer.Close()
+	readAll(t, tailer)
+
+	// Lines written just before rotation must not be lost.
+	appendFile(t, path, "two\n")
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatal(err)
+	}
+	appendFile(t, path+".1", "three\n")
+	if got := readAll(t, tailer); !reflect.DeepEqual(got, []string{"two", "three"}) {
+		t.Fatalf("read after rename: %q", got)
+	}
+
+	appendFile(t, path, "four\n")
+	if got := readAll(t, tailer); !reflect.DeepEqual(got, []string{"four"}) {
+		t.Fatalf("read after create: %q", got)
+	}
+	appendFile(t, path, "five\n")
+	if got := readAll(t, tailer); !reflect.DeepEqual(got, []string{"five"}) {
+		t.Fatalf("read new file: %q", got)
+	}
+}
+
+func TestTailer_CopyTruncate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "auth.log")
+	appendFile(t, path, "one\ntwo\n")
+	tailer := NewTailer(path)
+	defer tailer.Close()
+	readAll(t, tailer)
+
+	if err := os.Truncate(path, 0); err != nil {
+		t.Fatal(err)
+	}
+	appendFile(t, path, "three\n")
+	if got := readAll(t, tailer); !reflect.DeepEqual(got, []string{"three"}) {
+		t.Fatalf("read after truncate: %q", got)
+	}
+}
+
+func TestTailer_MissingFile(t *testing.T) {
+	tailer := NewTailer(filepath.Join(t.TempDir(), "missing.log"))
+	if err := tailer.ReadLines(func(string) {}); err == nil {
+		t.Fatal("expected error for missing file")
+	}
+}
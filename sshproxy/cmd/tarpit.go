@@ -0,0 +1,129 @@
+package main
+
+import (
+	"errors"
+	"math/rand/v2"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// tarpitChars are the characters of banner lines. Without upper case
+// letters, no line can start with "SSH-" and end the banner.
+const tarpitChars = "abcdefghijklmnopqrstuvwxyz0123456789 "
+
+var errTarpitClosed = errors.New("tarpit closed")
+
+// Tarpit holds the connections of banned clients open and feeds them an
+// endless SSH banner, one random line at a time, as endlessh does.
+// Clients wait for the identification string that follows the banner
+// (RFC 4253, section 4.2), which never comes.
+type Tarpit struct {
+	mu     sync.Mutex
+	active int
+	closed bool
+	// done is closed by Close to release the connections held.
+	done chan struct{}
+}
+
+func NewTarpit() *Tarpit {
+	return &Tarpit{done: make(chan struct{})}
+}
+
+// acquire takes one of limit places, reporting false if all are taken or
+// the tarpit is closed.
+func (t *Tarpit) acquire(limit int) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed || t.active >= limit {
+		return false
+	}
+	t.active++
+	return true
+}
+
+func (t *Tarpit) release() {
+	t.mu.Lock()
+	t.active--
+	t.mu.Unlock()
+}
+
+// Close releases the connections held and turns new ones away.
+func (t *Tarpit) Close() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.closed {
+		t.closed = true
+		close(t.done)
+	}
+}
+
+// hold writes a banner line to conn every c.Interval until a write fails,
+// c.MaxDuration passes or the tarpit is closed. A client that does not
+// read a line within c.Interval is let go as well. wasted is called with
+// the time since the last line after each one.
+func (t *Tarpit) hold(conn net.Conn, c TarpitConfig, wasted func(time.Duration)) error {
+	var limit <-chan time.Time
+	if c.MaxDuration > 0 {
+		timer := time.NewTimer(c.MaxDuration)
+		defer timer.Stop()
+		limit = timer.C
+	}
+	ticker := time.NewTicker(c.Interval)
+	defer ticker.Stop()
+	line := make([]byte, c.LineLength)
+	last := time.Now()
+	for {
+		select {
+		case <-ticker.C:
+		case <-limit:
+			return nil
+		case <-t.done:
+			return errTarpitClosed
+		}
+		n := 3 + rand.IntN(c.LineLength-2)
+		for i := range n - 2 {
+			line[i] = tarpitChars[rand.IntN(len(tarpitChars))]
+		}
+		line[n-2], line[n-1] = '\r', '\n'
+		conn.SetWriteDeadline(time.Now().Add(c.Interval))
+		if _, err := conn.Write(line[:n]); err != nil {
+			return err
+		}
+		now := time.Now()
+		wasted(now.Sub(last))
+		last = now
+	}
+}
+
+// setSocketBuffers shrinks the kernel buffers of conn to size bytes, so
+// that a held connection costs little memory.
+func setSocketBuffers(conn net.Conn, size int) {
+	if tc, ok := conn.(*net.TCPConn); ok {
+		tc.SetReadBuffer(size)
+		tc.SetWriteBuffer(size)
+	}
+}
+
+// tarpit holds conn from the banned addr in the tarpit, if it is enabled
+// and has room, and reports whether it did.
+func (p *Proxy) tarpit(conn net.Conn, addr netip.Addr, c TarpitConfig) bool {
+	if !c.Enabled {
+		return false
+	}
+	if !p.tarpits.acquire(c.MaxConnections) {
+		p.Logger.Debug("Tarpit full, closing banned connection", "ip", addr)
+		p.metrics.tarpitFull.Inc()
+		return false
+	}
+	defer p.tarpits.release()
+	p.metrics.tarpitted.Inc()
+	p.metrics.tarpitActive.Inc()
+	defer p.metrics.tarpitActive.Dec()
+	setSocketBuffers(conn, c.BufferSize)
+	start := time.Now()
+	err := p.tarpits.hold(conn, c, func(d time.Duration) { p.metrics.tarpitSeconds.Add(d.Seconds()) })
+	p.Logger.Debug("Released tarpitted connection", "ip", addr, "held", time.Since(start).Round(time.Second), "error", err)
+	return true
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTarpit_Hold(t *testing.T) {
+	c := TarpitConfig{Interval: time.Millisecond, LineLength: 8, MaxDuration: time.Second}
+	tp := NewTarpit()
+	client, server := net.Pipe()
+	defer client.Close()
+	var wasted time.Duration
+	done := make(chan error, 1)
+	go func() { done <- tp.hold(server, c, func(d time.Duration) { wasted += d }) }()
+
+	r := bufio.NewReader(client)
+	for range 20 {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(line) < 3 || len(line) > 8 || !strings.HasSuffix(line, "\r\n") || strings.HasPrefix(line, "SSH-") {
+			t.Fatalf("bad banner line %q", line)
+		}
+	}
+	tp.Close()
+	// The line being written when Close was called is never read.
+	client.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	r.ReadString('\n')
+	if err := <-done; !errors.Is(err, errTarpitClosed) && !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("got %v after Close", err)
+	}
+	if wasted <= 0 {
+		t.Fatal("no time wasted")
+	}
+	if tp.acquire(1) {
+		t.Fatal("closed tarpit took a connection")
+	}
+}
+
+func TestTarpit_HoldEnds(t *testing.T) {
+	c := TarpitConfig{Interval: time.Millisecond, LineLength: 32}
+	tp := NewTarpit()
+	defer tp.Close()
+
+	// A client that goes away is let go, and so is one that stops reading.
+	for _, name := range []string{"closed", "stalled"} {
+		client, server := net.Pipe()
+		if name == "closed" {
+			client.Close()
+		} else {
+			defer client.Close()
+		}
+		if err := tp.hold(server, c, func(time.Duration) {}); err == nil {
+			t.Fatalf("%s client held without an error", name)
+		}
+	}
+
+	// MaxDuration ends the hold without an error.
+	c.Interval, c.MaxDuration = time.Hour, 10*time.Millisecond
+	_, server := net.Pipe()
+	if err := tp.hold(server, c, func(time.Duration) {}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTarpit_Acquire(t *testing.T) {
+	tp := NewTarpit()
+	if !tp.acquire(2) || !tp.acquire(2) || tp.acquire(2) {
+		t.Fatal("cap not enforced")
+	}
+	tp.release()
+	if !tp.acquire(2) {
+		t.Fatal("released place not reused")
+	}
+}
+
+func TestServeConn_Tarpit(t *testing.T) {
+	cfg, err := loadConfig("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Target = startEcho(t).Addr().String()
+	cfg.Tarpit.Enabled = true
+	cfg.Tarpit.MaxConnections = 1
+	cfg.Tarpit.Interval = time.Millisecond
+	p := newTestProxy(t, cfg)
+	p.banList.Ban(netip.MustParseAddr("203.0.113.7"), time.Hour)
+
+	client, server := net.Pipe()
+	defer client.Close()
+	held := make(chan struct{})
+	go func() {
+		p.serveConn(peerConn{server, tcpAddr("203.0.113.7:40000")}, &cfg, nil)
+		close(held)
+	}()
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(client)
+	for range 3 {
+		if _, err := r.ReadString('\n'); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Keep reading: net.Pipe has no buffer, so a client that stops reading
+	// times out the next write and is let go.
+	go func() {
+		for {
+			if _, err := r.ReadString('\n'); err != nil {
+				return
+			}
+		}
+	}()
+	wantMetrics(t, p.metrics,
+		`sshproxy_tarpit_connections_total 1`,
+		`sshproxy_tarpit_active 1`,
+		`sshproxy_connections_rejected_total{reason="banned"} 1`,
+	)
+
+	// Over the cap, banned connections are closed at once.
+	other, server2 := net.Pipe()
+	go p.serveConn(peerConn{server2, tcpAddr("203.0.113.7:40001")}, &cfg, nil)
+	other.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := other.Read(make([]byte, 1)); err == nil || strings.Contains(err.Error(), "timeout") {
+		t.Fatalf("connection over the cap not closed: %v", err)
+	}
+	wantMetrics(t, p.metrics, `sshproxy_tarpit_full_total 1`)
+
+	p.tarpits.Close()
+	select {
+	case <-held:
+	case <-time.After(5 * time.Second):
+		t.Fatal("tarpitted connection not released")
+	}
+	wantMetrics(t, p.metrics, `sshproxy_tarpit_active 0`)
+}
+
+func TestProxy_TarpitShutdown(t *testing.T) {
+	p := startTestProxy(t, startEcho(t).Addr().String(), make(fakeSource), time.Now, func(c *Config) {
+		c.Ban.Denylist = []string{"127.0.0.1"}
+		c.Tarpit.Enabled = true
+		c.Tarpit.Interval = time.Millisecond
+	})
+
+	conn := dialSSH(t, p)
+	defer conn.Close()
+	if _, err := bufio.NewReader(conn).ReadString('\n'); err != nil {
+		t.Fatal(err)
+	}
+	// Shutdown does not wait for the tarpit.
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := p.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// loginGraceTime bounds how long a client may take to authenticate, like
+// sshd's LoginGraceTime.
+const loginGraceTime = 2 * time.Minute
+
+// serverConfig builds the SSH server side of terminate mode. Key files are
+// read for every connection, so changes to them apply right away. attempts
+// counts the failed attempts with a key or password.
+func serverConfig(c TerminateConfig, attempts *int, logger *slog.Logger) (*ssh.ServerConfig, error) {
+	authorized, err := readAuthorizedKeys(c.AuthorizedKeys, logger)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &ssh.ServerConfig{
+		PublicKeyCallback: func(meta ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if !authorized[string(key.Marshal())] {
+				return nil, errors.New("key not authorized")
+			}
+			return &ssh.Permissions{Extensions: map[string]string{"fingerprint": ssh.FingerprintSHA256(key)}}, nil
+		},
+		AuthLogCallback: func(meta ssh.ConnMetadata, method string, err error) {
+			// Clients start with "none" to learn the supported methods.
+			if err != nil && method != "none" {
+				*attempts++
+				logger.Debug("SSH authentication attempt failed", "ip", meta.RemoteAddr(), "user", meta.User(), "method", method)
+			}
+		},
+	}
+	for _, path := range c.HostKeys {
+		signer, err := readSigner(path)
+		if err != nil {
+			return nil, err
+		}
+		cfg.AddHostKey(signer)
+	}
+	return cfg, nil
+}
+
+// readAuthorizedKeys returns the keys in an authorized_keys file, by their
+// wire encoding. Keys with options are skipped, since restrictions such as
+// command= are not enforced.
+func readAuthorizedKeys(path string, logger *slog.Logger) (map[string]bool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	keys := make(map[string]bool)
+	for len(bytes.TrimSpace(data)) > 0 {
+		key, comment, options, rest, err := ssh.ParseAuthorizedKey(data)
+		if err != nil {
+			// Only blank lines and comments are left.
+			break
+		}
+		data = rest
+		if len(options) > 0 {
+			logger.Warn("Ignoring authorized key with options", "path", path, "comment", comment)
+			continue
+		}
+		keys[string(key.Marshal())] = true
+	}
+	return keys, nil
+}
+
+func readSigner(path string) (ssh.Signer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.ParsePrivateKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return signer, nil
+}
+
+// terminateSSH authenticates the client itself and opens a connection to
+// the target as c.Terminate.UpstreamUser, forwarding channels and requests
+// in both directions. A connection that ends without authenticating adds
+// its failed attempts to failures.
+func (p *Proxy) terminateSSH(clientConn net.Conn, c *Config, client netip.Addr, proxyVersion byte, failures *FailureQueue) sessionResult {
+	logger, metrics := p.Logger, p.metrics
+	defer clientConn.Close()
+	attempts := 0
+	serverCfg, err := serverConfig(c.Terminate, &attempts, logger)
+	if err != nil {
+		logger.Error("Failed to load SSH keys", "error", err)
+		return sessionResult{ended: endClientError, err: err}
+	}
+	clientConn.SetDeadline(time.Now().Add(loginGraceTime))
+	server, serverChans, serverReqs, err := ssh.NewServerConn(clientConn, serverCfg)
+	if err != nil {
+		if attempts == 0 {
+			logger.Debug("SSH handshake failed", "ip", client, "error", err)
+			return sessionResult{ended: endClientError, err: err}
+		}
+		logger.Info("SSH authentication failed", "ip", client, "attempts", attempts)
+		metrics.rejected.WithLabelValues("auth_failed").Inc()
+		// Each attempt counts, or clients would get several tries for the
+		// price of one.
+		weight := c.Terminate.FailureWeight * float64(attempts)
+		if weight > 0 && !failures.Add(FailureEntry{Addr: client, Time: p.Now(), Weight: weight}) {
+			logger.Debug("Failure queue full, not counting authentication failure", "ip", client)
+		}
+		return sessionResult{ended: endRejected, reason: "auth_failed"}
+	}
+	defer server.Close()
+	clientConn.SetDeadline(time.Time{})
+	res := sessionResult{user: server.User(), fingerprint: server.Permissions.Extensions["fingerprint"]}
+	logger.Info("SSH client authenticated", "ip", client, "user", res.user, "fingerprint", res.fingerprint)
+
+	upstreamCfg, err := upstreamConfig(c.Terminate)
+	if err != nil {
+		logger.Error("Failed to load SSH keys", "error", err)
+		res.ended, res.err = endUpstreamError, err
+		return res
+	}
+	targetConn, err := net.Dial("tcp", c.Target)
+	if err != nil {
+		logger.Error("Failed to connect to target", "target", c.Target, "error", err)
+		metrics.dialFailed.Inc()
+		res.ended, res.err = endDialFailed, err
+		return res
+	}
+	defer targetConn.Close()
+	if local, err := netip.ParseAddrPort(targetConn.LocalAddr().String()); err == nil {
+		closed := p.ports.Open(local, client, p.Now())
+		defer func() { closed(p.Now()) }()
+	}
+	if proxyVersion != 0 {
+		header, err := proxyHeader(proxyVersion, clientConn.RemoteAddr(), clientConn.LocalAddr())
+		if err == nil {
+			_, err = header.WriteTo(targetConn)
+		}
+		if err != nil {
+			logger.Error("Failed to send PROXY protocol header", "target", c.Target, "error", err)
+			res.ended, res.err = endUpstreamError, err
+			return res
+		}
+	}
+	upstream, upstreamChans, upstreamReqs, err := ssh.NewClientConn(targetConn, c.Target, upstreamCfg)
+	if err != nil {
+		logger.Error("Failed to log in to target", "target", c.Target, "user", upstreamCfg.User, "error", err)
+		metrics.upstreamAuthFailed.Inc()
+		res.ended, res.err = endUpstreamAuth, err
+		return res
+	}
+	defer upstream.Close()
+	metrics.sessions.Inc()
+	defer metrics.sessions.Dec()
+
+	var upTotal, downTotal atomic.Int64
+	up := byteCount{metrics.bytes.WithLabelValues("upstream"), &upTotal}
+	down := byteCount{metrics.bytes.WithLabelValues("downstream"), &downTotal}
+	go forwardGlobalRequests(upstreamReqs, server)
+	go forwardGlobalRequests(serverReqs, upstream)
+	go forwardChannels(upstreamChans, server, down, up)
+	go forwardChannels(serverChans, upstream, up, down)
+	// Either side going away ends the session.
+	var end endOnce
+	go func() {
+		end.set(p.sshEnd(true, server.Wait()))
+		upstream.Close()
+	}()
+	end.set(p.sshEnd(false, upstream.Wait()))
+	res.ended, res.err = end.ended, end.err
+	res.upstream, res.downstream = upTotal.Load(), downTotal.Load()
+	return res
+}
+
+// sshEnd classifies the end of an SSH connection to the client or the
+// target, with err as returned by its Wait.
+func (p *Proxy) sshEnd(client bool, err error) (string, error) {
+	ended, err := p.endOf(client, err, nil)
+	if ended == endUpstreamError || ended == endClientError {
+		// Without a separate write error, the error is the waiting side's.
+		ended = endUpstreamError
+		if client {
+			ended = endClientError
+		}
+	}
+	return ended, err
+}
+
+// byteCount counts the bytes forwarded in one direction, in the metric
+// and in the session's total.
+type byteCount struct {
+	metric prometheus.Counter
+	total  *atomic.Int64
+}
+
+func (b byteCount) writer(w io.Writer) io.Writer {
+	return countingWriter{w, b.metric, b.total}
+}
+
+// upstreamConfig builds the SSH client side of terminate mode. The user
+// the client logged in as is not passed on: any authorized key could
+// pick it, and so act as any user the upstream key is trusted for.
+func upstreamConfig(c TerminateConfig) (*ssh.ClientConfig, error) {
+	signer, err := readSigner(c.UpstreamKey)
+	if err != nil {
+		return nil, err
+	}
+	hostKeys, err := knownhosts.New(c.KnownHosts)
+	if err != nil {
+		return nil, err
+	}
+	return &ssh.ClientConfig{
+		User:            c.UpstreamUser,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: hostKeys,
+		Timeout:         10 * time.Second,
+	}, nil
+}
+
+// forwardGlobalRequests passes connection-level requests, such as
+// tcpip-forward, on to the other side and relays the reply.
+func forwardGlobalRequests(reqs <-chan *ssh.Request, to ssh.Conn) {
+	for req := range reqs {
+		ok, payload, err := to.SendRequest(req.Type, req.WantReply, req.Payload)
+		if err != nil {
+			ok, payload = false, nil
+		}
+		if req.WantReply {
+			req.Reply(ok, payload)
+		}
+	}
+}
+
+// forwardChannels opens each new channel on the other side. sent counts
+// the bytes written to the other side, received those coming back.
+func forwardChannels(chans <-chan ssh.NewChannel, to ssh.Conn, sent, received byteCount) {
+	for nc := range chans {
+		go forwardChannel(nc, to, sent, received)
+	}
+}
+
+func forwardChannel(nc ssh.NewChannel, to ssh.Conn, sent, received byteCount) {
+	dst, dstReqs, err := to.OpenChannel(nc.ChannelType(), nc.ExtraData())
+	if err != nil {
+		var openErr *ssh.OpenChannelError
+		if errors.As(err, &openErr) {
+			nc.Reject(openErr.Reason, openErr.Message)
+		} else {
+			nc.Reject(ssh.ConnectionFailed, err.Error())
+		}
+		return
+	}
+	src, srcReqs, err := nc.Accept()
+	if err != nil {
+		dst.Close()
+		return
+	}
+
+	go func() {
+		io.Copy(sent.writer(dst), src)
+		dst.CloseWrite()
+	}()
+	go io.Copy(sent.writer(dst.Stderr()), src.Stderr())
+	// A reply to the opening side must not be overtaken by the close of
+	// src below.
+	var replying sync.Mutex
+	go func() {
+		// The opening side closing the channel closes it on the other.
+		forwardChannelRequests(srcReqs, dst, &replying)
+		dst.Close()
+	}()
+
+	// Requests such as exit-status come after the data, so src is closed
+	// only once everything from dst has been passed on.
+	var wg sync.WaitGroup
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		io.Copy(received.writer(src), dst)
+		src.CloseWrite()
+	}()
+	go func() {
+		defer wg.Done()
+		io.Copy(received.writer(src.Stderr()), dst.Stderr())
+	}()
+	go func() {
+		defer wg.Done()
+		forwardChannelRequests(dstReqs, src, new(sync.Mutex))
+	}()
+	wg.Wait()
+	replying.Lock()
+	src.Close()
+	replying.Unlock()
+}
+
+// forwardChannelRequests sends reqs on to and passes the replies back,
+// holding replying while a request is in flight.
+func forwardChannelRequests(reqs <-chan *ssh.Request, to ssh.Channel, replying *sync.Mutex) {
+	for req := range reqs {
+		replying.Lock()
+		ok, err := to.SendRequest(req.Type, req.WantReply, req.Payload)
+		if err != nil {
+			ok = false
+		}
+		if req.WantReply {
+			req.Reply(ok, nil)
+		}
+		replying.Unlock()
+	}
+}
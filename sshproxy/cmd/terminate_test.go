@@ -0,0 +1,198 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// writeKey generates a key, writes it to dir/name and returns its signer.
+func writeKey(t *testing.T, dir, name string) ssh.Signer {
+	t.Helper()
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := ssh.MarshalPrivateKey(priv, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, name), pem.EncodeToMemory(block), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+// startUpstreamSSH runs an SSH server that only lets upstreamKey in and
+// answers "exec" requests with the user and command.
+func startUpstreamSSH(t *testing.T, hostKey ssh.Signer, upstreamKey ssh.PublicKey) net.Listener {
+	t.Helper()
+	cfg := &ssh.ServerConfig{
+		PublicKeyCallback: func(meta ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if string(key.Marshal()) != string(upstreamKey.Marshal()) {
+				return nil, io.EOF
+			}
+			return nil, nil
+		},
+	}
+	cfg.AddHostKey(hostKey)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				server, chans, reqs, err := ssh.NewServerConn(conn, cfg)
+				if err != nil {
+					return
+				}
+				go ssh.DiscardRequests(reqs)
+				for nc := range chans {
+					ch, chReqs, err := nc.Accept()
+					if err != nil {
+						return
+					}
+					for req := range chReqs {
+						var exec struct{ Command string }
+						if req.Type != "exec" || ssh.Unmarshal(req.Payload, &exec) != nil {
+							req.Reply(false, nil)
+							continue
+						}
+						req.Reply(true, nil)
+						io.WriteString(ch, server.User()+": "+exec.Command+"\n")
+						ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{0}))
+						ch.Close()
+					}
+				}
+			}()
+		}
+	}()
+	return ln
+}
+
+func TestServeConn_Terminate(t *testing.T) {
+	dir := t.TempDir()
+	upstreamHost := writeKey(t, dir, "upstream_host")
+	upstreamKey := writeKey(t, dir, "upstream_key")
+	writeKey(t, dir, "host_key")
+	userKey := writeKey(t, dir, "user_key")
+	strangerKey := writeKey(t, dir, "stranger_key")
+	target := startUpstreamSSH(t, upstreamHost, upstreamKey.PublicKey())
+	defer target.Close()
+
+	authorized := string(ssh.MarshalAuthorizedKey(userKey.PublicKey())) +
+		"# comment\n" +
+		`command="true" ` + string(ssh.MarshalAuthorizedKey(strangerKey.PublicKey()))
+	if err := os.WriteFile(filepath.Join(dir, "authorized_keys"), []byte(authorized), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	line := knownhosts.Line([]string{knownhosts.Normalize(target.Addr().String())}, upstreamHost.PublicKey())
+	if err := os.WriteFile(filepath.Join(dir, "known_hosts"), []byte(line+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &Config{Target: target.Addr().String()}
+	cfg.Handshake.Timeout = time.Second
+	cfg.Terminate = TerminateConfig{
+		Enabled:        true,
+		HostKeys:       []string{filepath.Join(dir, "host_key")},
+		AuthorizedKeys: filepath.Join(dir, "authorized_keys"),
+		UpstreamKey:    filepath.Join(dir, "upstream_key"),
+		UpstreamUser:   "deploy",
+		KnownHosts:     filepath.Join(dir, "known_hosts"),
+		FailureWeight:  3,
+	}
+	p := newTestProxy(t, *cfg)
+	metrics, failures := p.metrics, p.failures
+
+	front, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer front.Close()
+	go func() {
+		for {
+			conn, err := front.Accept()
+			if err != nil {
+				return
+			}
+			go p.serveConn(conn, cfg, nil)
+		}
+	}()
+	dial := func(keys ...ssh.Signer) (*ssh.Client, error) {
+		return ssh.Dial("tcp", front.Addr().String(), &ssh.ClientConfig{
+			User:            "alice",
+			Auth:            []ssh.AuthMethod{ssh.PublicKeys(keys...)},
+			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+			Timeout:         5 * time.Second,
+		})
+	}
+
+	// An authorized client reaches the target as the upstream user.
+	client, err := dial(userKey)
+	if err != nil {
+		t.Fatalf("authorized key rejected: %v", err)
+	}
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := session.Output("echo hi")
+	if err != nil || string(out) != "deploy: echo hi\n" {
+		t.Fatalf("got %q, %v from the target", out, err)
+	}
+	client.Close()
+
+	// Keys that are not listed, or listed with options, count as failures,
+	// each of them.
+	if _, err := dial(strangerKey, writeKey(t, dir, "other_key")); err == nil || !strings.Contains(err.Error(), "unable to authenticate") {
+		t.Fatalf("unauthorized key accepted: %v", err)
+	}
+	select {
+	case f := <-failures.entries:
+		if f.Addr != netip.MustParseAddr("127.0.0.1") || f.Weight != 6 {
+			t.Fatalf("unexpected failure %+v", f)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("authentication failure not counted")
+	}
+	wantMetrics(t, metrics,
+		`sshproxy_connections_rejected_total{reason="auth_failed"} 1`,
+		`sshproxy_connections_accepted_total 2`,
+	)
+
+	// A target that refuses the upstream key is not a dial failure.
+	writeKey(t, dir, "upstream_key")
+	client, err = dial(userKey)
+	if err != nil {
+		t.Fatalf("authorized key rejected: %v", err)
+	}
+	if _, err := client.NewSession(); err == nil {
+		t.Fatal("session opened without a login to the target")
+	}
+	client.Close()
+	wantMetrics(t, metrics,
+		`sshproxy_upstream_auth_failures_total 1`,
+		`sshproxy_upstream_dial_failures_total 0`,
+	)
+}
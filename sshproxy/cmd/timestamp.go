@@ -0,0 +1,56 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"time"
+)
+
+// rfc5424Header matches the "<PRI>VERSION " prefix of an RFC5424 message.
+var rfc5424Header = regexp.MustCompile(`^<\d{1,3}>\d{1,2} `)
+
+// isoLayouts cover RFC3339 as written by rsyslog and RFC5424, and the
+// ISO8601 variants of `journalctl -o short-iso` / `short-iso-precise`.
+// Fractional seconds are accepted by time.Parse even if the layout omits
+// them.
+var isoLayouts = []string{
+	"2006-01-02T15:04:05Z07:00",
+	"2006-01-02T15:04:05Z0700",
+}
+
+// parseLogTime extracts the event time from the beginning of a log line.
+// Classic syslog stamps carry neither a year nor a zone, so they are read in
+// loc and given the year that puts them closest to, but not after, now.
+func parseLogTime(line string, now time.Time, loc *time.Location) (time.Time, bool) {
+	line = rfc5424Header.ReplaceAllString(line, "")
+	if len(line) >= len("2006-01-02T15:04:05") && line[4] == '-' && line[10] == 'T' {
+		field, _, _ := strings.Cut(line, " ")
+		for _, layout := range isoLayouts {
+			if t, err := time.Parse(layout, field); err == nil {
+				return t, true
+			}
+		}
+		return time.Time{}, false
+	}
+	if len(line) < len(time.Stamp) {
+		return time.Time{}, false
+	}
+	// The stamp may carry fractional seconds (RSYSLOG_FileFormat-like high
+	// precision templates without a year), so parse up to the first space
+	// after the clock.
+	end := len(time.Stamp)
+	for end < len(line) && line[end] != ' ' {
+		end++
+	}
+	t, err := time.ParseInLocation(time.Stamp, line[:end], loc)
+	if err != nil {
+		return time.Time{}, false
+	}
+	t = time.Date(now.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), loc)
+	// Allow a day of clock skew; anything further ahead was logged last
+	// year (e.g. a "Dec 31" line read on Jan 1).
+	if t.After(now.Add(24 * time.Hour)) {
+		t = t.AddDate(-1, 0, 0)
+	}
+	return t, true
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseLogTime(t *testing.T) {
+	loc := time.FixedZone("UTC+8", 8*3600)
+	now := time.Date(2025, time.March, 10, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name string
+		line string
+		want time.Time
+	}{
+		{
+			name: "syslog zero padded",
+			line: "Mar 09 15:04:05 host sshd[1]: Failed password for root from 1.2.3.4 port 22 ssh2",
+			want: time.Date(2025, time.March, 9, 15, 4, 5, 0, loc),
+		},
+		{
+			name: "syslog space padded",
+			line: "Mar  9 15:04:05 host sshd[1]: Failed password",
+			want: time.Date(2025, time.March, 9, 15, 4, 5, 0, loc),
+		},
+		{
+			name: "syslog previous year",
+			line: "Dec 31 23:59:59 host sshd[1]: Failed password",
+			want: time.Date(2024, time.December, 31, 23, 59, 59, 0, loc),
+		},
+		{
+			name: "rfc3339",
+			line: "2025-03-10T11:58:00.123456+00:00 host sshd[1]: Failed password",
+			want: time.Date(2025, time.March, 10, 11, 58, 0, 123456000, time.UTC),
+		},
+		{
+			name: "rfc5424",
+			line: "<38>1 2025-03-10T11:58:00.003Z host sshd 1 - - Failed password",
+			want: time.Date(2025, time.March, 10, 11, 58, 0, 3000000, time.UTC),
+		},
+		{
+			name: "journald short-iso",
+			line: "2025-03-10T19:58:00+0800 host sshd[1]: Failed password",
+			want: time.Date(2025, time.March, 10, 11, 58, 0, 0, time.UTC),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := parseLogTime(tt.line, now, loc)
+			if !ok {
+				t.Fatalf("parseLogTime(%q) failed", tt.line)
+			}
+			if !got.Equal(tt.want) {
+				t.Fatalf("parseLogTime(%q) = %v, want %v", tt.line, got, tt.want)
+			}
+		})
+	}
+
+	if _, ok := parseLogTime("sshd[1]: Failed password", now, loc); ok {
+		t.Fatal("expected no timestamp")
+	}
+}